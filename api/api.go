@@ -89,13 +89,42 @@ func Mount(
 		err = fmt.Errorf("Mount: initialization failed")
 		return
 	}
-	server := fuseutil.NewFileSystemServer(FusePanicLogger{fs})
+
+	if flags.Standby {
+		err = fs.Standby(flags.MountPoint)
+		if err != nil {
+			err = fmt.Errorf("Mount: %v", err)
+			return
+		}
+	}
+
+	var fuseFs fuseutil.FileSystem = fs
+	if flags.ChaosErrorRate != 0 || flags.ChaosDelayRate != 0 {
+		log.Warnf("Chaos mode: failing %v%% and delaying %v%% of the operations",
+			flags.ChaosErrorRate, flags.ChaosDelayRate)
+		fuseFs = internal.NewChaosFS(fuseFs, flags.ChaosErrorRate/100,
+			flags.ChaosDelayRate/100, flags.ChaosDelay)
+	}
+	// outside of chaos, so the trace has what the kernel saw
+	if flags.Trace != "" {
+		var trace *os.File
+		trace, err = os.OpenFile(flags.Trace, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			err = fmt.Errorf("Mount: %v", err)
+			return
+		}
+		fuseFs = internal.NewTraceFS(fuseFs, trace, flags.TraceAnonymize)
+	}
+
+	server := fuseutil.NewFileSystemServer(FusePanicLogger{fuseFs})
 
 	mfs, err = fuse.Mount(flags.MountPoint, server, mountCfg)
 	if err != nil {
 		err = fmt.Errorf("Mount: %v", err)
 		return
 	}
+	go fs.StartupBurst()
+	fs.FireHook(internal.HOOK_MOUNT_READY, flags.MountPoint)
 
 	if len(flags.Cache) != 0 {
 		log.Infof("Starting catfs %v", flags.Cache)
@@ -158,8 +187,11 @@ var (
 	NewGoofys         = internal.NewGoofys
 	TryUnmount        = internal.TryUnmount
 	MyUserAndGroup    = internal.MyUserAndGroup
+	DefaultFlags      = internal.DefaultFlags
+	ValidateFlags     = internal.ValidateFlags
 )
 
 type (
-	Goofys = internal.Goofys
+	Goofys     = internal.Goofys
+	MountStats = internal.MountStats
 )
@@ -50,6 +50,11 @@ func (config *AZBlobConfig) Init() {
 	config.TokenRenewBuffer = 15 * time.Minute
 }
 
+func (config *AZBlobConfig) Clone() *AZBlobConfig {
+	clone := *config
+	return &clone
+}
+
 type ADLv1Config struct {
 	Endpoint   string
 	Authorizer autorest.Authorizer
@@ -58,6 +63,11 @@ type ADLv1Config struct {
 func (config *ADLv1Config) Init() {
 }
 
+func (config *ADLv1Config) Clone() *ADLv1Config {
+	clone := *config
+	return &clone
+}
+
 type AzureAuthorizerConfig struct {
 	Log      *LogHandle
 	TenantId string
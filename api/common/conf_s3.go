@@ -16,10 +16,14 @@ package common
 
 import (
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -49,28 +53,63 @@ type S3Config struct {
 	KMSKeyID   string
 	SseC       string
 	SseCDigest string
+	SseCKeyId  string // keyring description NewS3 reads the key from instead of SseC
 	ACL        string
 
 	Subdomain bool
 
+	// create the bucket if it doesn't exist, with these settings
+	// in addition to Region, ACL and SSE
+	EnsureBucket      bool
+	BucketVersioning  bool
+	BlockPublicAccess bool
+
+	// SigningRegion overrides the region requests are signed for,
+	// SigV4A signs for a set of regions instead (required by
+	// multi-region access points)
+	SigningRegion string
+	SigV4A        bool
+
+	// Proxy overrides HTTP_PROXY/HTTPS_PROXY for this backend,
+	// NoProxy lists the hosts that should be reached directly
+	Proxy   string
+	NoProxy string
+
+	// PEM files used to verify the endpoint and to authenticate
+	// ourselves to it (mTLS)
+	CABundle   string
+	ClientCert string
+	ClientKey  string
+
+	// cache DNS lookups for this long, and fail over between all
+	// the addresses of the endpoint plus the fallback host:ports
+	DNSCacheTTL      time.Duration
+	EndpointFallback []string
+
 	Credentials *credentials.Credentials
 	Session     *session.Session
 }
 
-var s3HTTPTransport = http.Transport{
-	Proxy: http.ProxyFromEnvironment,
-	DialContext: (&net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-		DualStack: true,
-	}).DialContext,
-	MaxIdleConns:          1000,
-	MaxIdleConnsPerHost:   1000,
-	IdleConnTimeout:       90 * time.Second,
-	TLSHandshakeTimeout:   10 * time.Second,
-	ExpectContinueTimeout: 10 * time.Second,
+func newS3HTTPTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          1000,
+		MaxIdleConnsPerHost:   1000,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 10 * time.Second,
+	}
 }
 
+// shared by all the backends that don't need their own connection
+// settings
+var s3HTTPTransport = newS3HTTPTransport()
+
 var s3Session *session.Session
 
 func (c *S3Config) Init() *S3Config {
@@ -83,12 +122,109 @@ func (c *S3Config) Init() *S3Config {
 	return c
 }
 
+// Clone returns a copy of c, because mounting c changes it, ie: to
+// decode the sse-c key. The credentials and the session are shared
+func (c *S3Config) Clone() *S3Config {
+	clone := *c
+	clone.EndpointFallback = append([]string(nil), c.EndpointFallback...)
+	return &clone
+}
+
+func (c *S3Config) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if c.CABundle != "" {
+		pem, err := ioutil.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca bundle: %v", err)
+		}
+
+		// trust the bundle in addition to the system roots
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %v", c.CABundle)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, fmt.Errorf("client certificate and key must be specified together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func (c *S3Config) transport(endpoint string) (*http.Transport, error) {
+	if c.Proxy == "" && c.NoProxy == "" && c.CABundle == "" && c.ClientCert == "" && c.ClientKey == "" &&
+		c.DNSCacheTTL == 0 && len(c.EndpointFallback) == 0 {
+		return s3HTTPTransport, nil
+	}
+
+	t := newS3HTTPTransport()
+	if c.DNSCacheTTL != 0 || len(c.EndpointFallback) != 0 {
+		var host string
+		if endpoint != "" {
+			u, err := url.Parse(endpoint)
+			if err != nil {
+				return nil, err
+			}
+			host = u.Hostname()
+		}
+
+		t.DialContext = (&EndpointDialer{
+			Dialer: &net.Dialer{
+				// fail over quickly instead of waiting
+				// on a dead node
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			},
+			TTL:      c.DNSCacheTTL,
+			Host:     host,
+			Fallback: c.EndpointFallback,
+		}).Init().DialContext
+	}
+
+	if c.Proxy != "" || c.NoProxy != "" {
+		proxy, err := ProxyFunc(c.Proxy, c.NoProxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = proxy
+	}
+
+	if c.CABundle != "" || c.ClientCert != "" || c.ClientKey != "" {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = tlsConfig
+	}
+
+	return t, nil
+}
+
 func (c *S3Config) ToAwsConfig(flags *FlagStorage) (*aws.Config, error) {
+	transport, err := c.transport(flags.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
 	awsConfig := (&aws.Config{
 		Region: &c.Region,
 		Logger: GetLogger("s3"),
 	}).WithHTTPClient(&http.Client{
-		Transport: &s3HTTPTransport,
+		Transport: transport,
 		Timeout:   flags.HTTPTimeout,
 	})
 	if flags.DebugS3 {
@@ -108,7 +244,6 @@ func (c *S3Config) ToAwsConfig(flags *FlagStorage) (*aws.Config, error) {
 
 	if c.Session == nil {
 		if s3Session == nil {
-			var err error
 			s3Session, err = session.NewSessionWithOptions(session.Options{
 				Profile:           c.Profile,
 				SharedConfigState: session.SharedConfigEnable,
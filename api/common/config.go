@@ -36,6 +36,17 @@ type FlagStorage struct {
 	Uid      uint32
 	Gid      uint32
 
+	// may change the runtime knobs on the mount root
+	AdminUid uint32
+
+	// file declaring the tenants, see internal/tenant.go
+	Tenants string
+
+	// use credentials limited to the prefix that last this long,
+	// optionally by assuming this role
+	ScopedSession     time.Duration
+	ScopedSessionRole string
+
 	// Common Backend Config
 	UseContentType bool
 	Endpoint       string
@@ -49,10 +60,96 @@ type FlagStorage struct {
 	TypeCacheTTL time.Duration
 	HTTPTimeout  time.Duration
 
+	// take the stat cache TTL of objects from their Cache-Control
+	UseCacheControl bool
+
+	// invalidate the caches on MinIO's bucket notifications
+	MinioNotify bool
+
+	// CLASS=ERRNO,... overriding what backend errors turn into
+	ErrnoMap string
+
+	// comma separated prefixes to spread the objects over
+	ShardPrefixes string
+
+	MultipartAge            time.Duration
+	MultipartExpireInterval time.Duration
+
+	// shared by all the mounts in this process
+	MaxRequests  uint32
+	MaxBandwidth uint64 // bytes per second
+	// PATH=WEIGHT,... of how the above are shared
+	MountWeights string
+
+	// how long SIGTERM takes to upload the files being written
+	DrainTimeout time.Duration
+
+	// buffer writes on disk when out of memory for them
+	SpillDir  string
+	SpillSize uint64
+
+	// tails of Parquet/ORC files kept in memory
+	FooterCache uint64
+
+	// be more aggressive for a while after mounting
+	StartupBurst       time.Duration
+	StartupBurstFactor float64
+
 	// Debugging
 	DebugFuse  bool
 	DebugS3    bool
 	Foreground bool
+
+	CheckPermissions bool
+
+	// serve stats under /.goofys/
+	StatsDir bool
+
+	// wait for the mountpoint to be free before mounting
+	Standby          bool
+	StandbyWarmDepth int
+
+	// record the fuse ops to this file
+	Trace          string
+	TraceAnonymize bool
+
+	// daily budget in dollars and the prices, going over it fires
+	// the budget-exceeded hook
+	CostBudget float64
+	CostPrices string
+
+	// run this command and/or POST to this URL on the events
+	HookExec    string
+	HookWebhook string
+	HookEvents  string
+
+	// percentages of the fuse ops to fail with EIO and to delay
+	// by up to ChaosDelay, for testing only
+	ChaosErrorRate float64
+	ChaosDelayRate float64
+	ChaosDelay     time.Duration
+}
+
+// Clone returns a copy of flags that doesn't share the backend config
+// or the mount options, so mounting it doesn't change flags
+func (flags *FlagStorage) Clone() *FlagStorage {
+	f := *flags
+
+	f.MountOptions = make(map[string]string, len(flags.MountOptions))
+	for k, v := range flags.MountOptions {
+		f.MountOptions[k] = v
+	}
+	f.Cache = append([]string(nil), flags.Cache...)
+
+	switch config := flags.Backend.(type) {
+	case *S3Config:
+		f.Backend = config.Clone()
+	case *AZBlobConfig:
+		f.Backend = config.Clone()
+	case *ADLv1Config:
+		f.Backend = config.Clone()
+	}
+	return &f
 }
 
 func (flags *FlagStorage) GetMimeType(fileName string) (retMime *string) {
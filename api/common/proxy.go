@@ -0,0 +1,140 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type noProxyRule struct {
+	domain string
+	port   string
+	ipNet  *net.IPNet
+	ip     net.IP
+}
+
+// parseNoProxy parses a NO_PROXY style list: comma separated
+// hostnames, domain suffixes (.example.com), IPs, CIDRs, optionally
+// with a port. A single "*" disables the proxy for every host
+func parseNoProxy(s string) (rules []noProxyRule, all bool) {
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			return nil, true
+		}
+
+		if _, ipNet, err := net.ParseCIDR(p); err == nil {
+			rules = append(rules, noProxyRule{ipNet: ipNet})
+			continue
+		}
+
+		var rule noProxyRule
+		if host, port, err := net.SplitHostPort(p); err == nil {
+			p = host
+			rule.port = port
+		}
+		if ip := net.ParseIP(p); ip != nil {
+			rule.ip = ip
+		} else {
+			rule.domain = strings.TrimPrefix(p, "*")
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func (r *noProxyRule) match(host string, port string) bool {
+	if r.port != "" && r.port != port {
+		return false
+	}
+
+	if r.ipNet != nil || r.ip != nil {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		if r.ipNet != nil {
+			return r.ipNet.Contains(ip)
+		}
+		return r.ip.Equal(ip)
+	}
+
+	if strings.HasPrefix(r.domain, ".") {
+		// .example.com matches example.com and all its subdomains
+		return host == r.domain[1:] || strings.HasSuffix(host, r.domain)
+	}
+	return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+}
+
+// ProxyFunc returns the proxy selection function for an http
+// transport. If proxy is empty we fall back to the usual
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables, noProxy
+// applies to both. Proxy credentials can be embedded in the url as
+// user:password@
+func ProxyFunc(proxy string, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	var proxyURL func(*http.Request) (*url.URL, error)
+
+	if proxy == "" {
+		if noProxy == "" {
+			return http.ProxyFromEnvironment, nil
+		}
+		proxyURL = http.ProxyFromEnvironment
+	} else {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %v: %v", proxy, err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %v, "+
+				"possible values: http, https, socks5", u.Scheme)
+		}
+		proxyURL = http.ProxyURL(u)
+	}
+
+	rules, all := parseNoProxy(noProxy)
+
+	return func(req *http.Request) (*url.URL, error) {
+		if all {
+			return nil, nil
+		}
+
+		host := strings.ToLower(req.URL.Hostname())
+		port := req.URL.Port()
+		if port == "" {
+			if req.URL.Scheme == "https" {
+				port = "443"
+			} else {
+				port = "80"
+			}
+		}
+
+		for i := range rules {
+			if rules[i].match(host, port) {
+				return nil, nil
+			}
+		}
+		return proxyURL(req)
+	}, nil
+}
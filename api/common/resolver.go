@@ -0,0 +1,243 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+var dnsLog = GetLogger("dns")
+
+type dnsEntry struct {
+	addrs  []string
+	expire time.Time
+}
+
+// EndpointDialer caches name resolution and fails over between all
+// the addresses of the endpoint (and the configured fallback
+// endpoints), so a dead node of an on-prem cluster only costs us a
+// connect timeout once instead of on every request.
+//
+// The go resolver doesn't expose record TTLs, so the cache TTL is
+// configured instead.
+type EndpointDialer struct {
+	Dialer *net.Dialer
+	// how long to cache resolved addresses, 0 disables the cache
+	TTL time.Duration
+	// the endpoint host whose connections can fail over
+	Host string
+	// host:port of the other nodes serving the same endpoint
+	Fallback []string
+	// how long a failed address is avoided before we probe it
+	// again
+	DownTime time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*dnsEntry
+	down  map[string]time.Time
+	// whether healthCheck is running, and when we were last used
+	// so it can stop once the backend is gone
+	checking bool
+	lastDial time.Time
+}
+
+func (d *EndpointDialer) Init() *EndpointDialer {
+	d.cache = make(map[string]*dnsEntry)
+	d.down = make(map[string]time.Time)
+	if d.DownTime == 0 {
+		d.DownTime = 30 * time.Second
+	}
+	return d
+}
+
+func (d *EndpointDialer) lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	now := time.Now()
+
+	d.mu.Lock()
+	e := d.cache[host]
+	d.mu.Unlock()
+	if e != nil && e.expire.After(now) {
+		return e.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		if e != nil {
+			// better to try stale addresses than to fail
+			dnsLog.Warnf("lookup %v: %v, using cached %v", host, err, e.addrs)
+			return e.addrs, nil
+		}
+		return nil, err
+	}
+
+	if d.TTL != 0 {
+		d.mu.Lock()
+		d.cache[host] = &dnsEntry{addrs: addrs, expire: now.Add(d.TTL)}
+		d.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+func (d *EndpointDialer) candidates(ctx context.Context, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.lookup(ctx, host)
+	if err != nil && (host != d.Host || len(d.Fallback) == 0) {
+		return nil, err
+	}
+
+	var ret []string
+	for _, ip := range ips {
+		ret = append(ret, net.JoinHostPort(ip, port))
+	}
+
+	if host == d.Host {
+		for _, f := range d.Fallback {
+			fhost, fport, err := net.SplitHostPort(f)
+			if err != nil {
+				fhost = f
+				fport = port
+			}
+			fips, ferr := d.lookup(ctx, fhost)
+			if ferr != nil {
+				dnsLog.Warnf("lookup %v: %v", fhost, ferr)
+				err = ferr
+				continue
+			}
+			for _, ip := range fips {
+				ret = append(ret, net.JoinHostPort(ip, fport))
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		// nothing resolved, report the last lookup error
+		if err == nil {
+			err = &net.DNSError{Err: "no addresses", Name: host}
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (d *EndpointDialer) isDown(addr string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	until, ok := d.down[addr]
+	return ok && until.After(now)
+}
+
+func (d *EndpointDialer) markDown(addr string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.down[addr]; !ok {
+		dnsLog.Warnf("%v is down: %v", addr, err)
+	}
+	d.down[addr] = time.Now().Add(d.DownTime)
+	if !d.checking {
+		d.checking = true
+		go d.healthCheck()
+	}
+}
+
+func (d *EndpointDialer) markUp(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.down[addr]; ok {
+		dnsLog.Infof("%v is back up", addr)
+		delete(d.down, addr)
+	}
+}
+
+func (d *EndpointDialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	addrs, err := d.candidates(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	d.lastDial = now
+	d.mu.Unlock()
+
+	var up, down []string
+	for _, a := range addrs {
+		if d.isDown(a, now) {
+			down = append(down, a)
+		} else {
+			up = append(up, a)
+		}
+	}
+
+	// if everything is down we still have to try something
+	for _, a := range append(up, down...) {
+		conn, err = d.Dialer.DialContext(ctx, network, a)
+		if err == nil {
+			d.markUp(a)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		d.markDown(a, err)
+	}
+
+	return
+}
+
+// healthCheck periodically probes the addresses that failed so they
+// are put back into rotation as soon as they recover. It runs only
+// while something is down and the dialer is still in use, markDown
+// starts it again
+func (d *EndpointDialer) healthCheck() {
+	for {
+		time.Sleep(d.DownTime)
+
+		d.mu.Lock()
+		if len(d.down) == 0 || time.Since(d.lastDial) > 10*d.DownTime {
+			d.checking = false
+			d.mu.Unlock()
+			return
+		}
+		var addrs []string
+		for a := range d.down {
+			addrs = append(addrs, a)
+		}
+		d.mu.Unlock()
+
+		for _, a := range addrs {
+			conn, err := d.Dialer.Dial("tcp", a)
+			if err == nil {
+				conn.Close()
+				d.markUp(a)
+			} else {
+				d.markDown(a, err)
+			}
+		}
+	}
+}
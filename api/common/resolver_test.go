@@ -0,0 +1,152 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	. "gopkg.in/check.v1"
+
+	"context"
+	"net"
+	"time"
+)
+
+type ResolverTest struct {
+}
+
+var _ = Suite(&ResolverTest{})
+
+// deadAddr returns an address nobody is listening on
+func deadAddr(t *C) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func acceptAll(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+func (d *EndpointDialer) isChecking() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.checking
+}
+
+func waitFor(t *C, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+func (s *ResolverTest) TestEndpointFallback(t *C) {
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer live.Close()
+	go acceptAll(live)
+
+	dead := deadAddr(t)
+	d := (&EndpointDialer{
+		Dialer:   &net.Dialer{Timeout: time.Second},
+		Host:     "127.0.0.1",
+		Fallback: []string{live.Addr().String()},
+		DownTime: time.Hour,
+	}).Init()
+	t.Assert(d.isChecking(), Equals, false)
+
+	conn, err := d.DialContext(context.Background(), "tcp", dead)
+	t.Assert(err, IsNil)
+	t.Assert(conn.RemoteAddr().String(), Equals, live.Addr().String())
+	conn.Close()
+
+	t.Assert(d.isDown(dead, time.Now()), Equals, true)
+	t.Assert(d.isDown(live.Addr().String(), time.Now()), Equals, false)
+	t.Assert(d.isChecking(), Equals, true)
+
+	// other hosts don't fail over
+	_, err = d.DialContext(context.Background(), "tcp",
+		net.JoinHostPort("localhost", "1"))
+	t.Assert(err, NotNil)
+}
+
+func (s *ResolverTest) TestEndpointFallbackUnresolved(t *C) {
+	d := (&EndpointDialer{
+		Dialer:   &net.Dialer{Timeout: time.Second},
+		Host:     "endpoint.invalid",
+		Fallback: []string{"fallback.invalid:80"},
+	}).Init()
+
+	// fails instead of returning no connection and no error
+	conn, err := d.DialContext(context.Background(), "tcp", "endpoint.invalid:80")
+	t.Assert(err, NotNil)
+	t.Assert(conn, IsNil)
+}
+
+func (s *ResolverTest) TestEndpointHealthCheck(t *C) {
+	dead := deadAddr(t)
+	d := (&EndpointDialer{
+		Dialer:   &net.Dialer{Timeout: time.Second},
+		Host:     "127.0.0.1",
+		DownTime: 10 * time.Millisecond,
+	}).Init()
+
+	_, err := d.DialContext(context.Background(), "tcp", dead)
+	t.Assert(err, NotNil)
+	t.Assert(d.isChecking(), Equals, true)
+
+	// the address comes back, the check notices and then stops
+	// because nothing is down anymore
+	l, err := net.Listen("tcp", dead)
+	t.Assert(err, IsNil)
+	defer l.Close()
+	go acceptAll(l)
+
+	waitFor(t, func() bool {
+		return !d.isDown(dead, time.Now().Add(-time.Hour)) && !d.isChecking()
+	})
+}
+
+func (s *ResolverTest) TestEndpointHealthCheckIdle(t *C) {
+	dead := deadAddr(t)
+	d := (&EndpointDialer{
+		Dialer:   &net.Dialer{Timeout: time.Second},
+		Host:     "127.0.0.1",
+		DownTime: 10 * time.Millisecond,
+	}).Init()
+
+	_, err := d.DialContext(context.Background(), "tcp", dead)
+	t.Assert(err, NotNil)
+	t.Assert(d.isChecking(), Equals, true)
+
+	// nobody dials anymore, the check stops even though the
+	// address is still down
+	waitFor(t, func() bool { return !d.isChecking() })
+
+	d.mu.Lock()
+	_, down := d.down[dead]
+	d.mu.Unlock()
+	t.Assert(down, Equals, true)
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goofys
+
+import (
+	. "github.com/kahing/goofys/api/common"
+	"github.com/kahing/goofys/internal"
+
+	"context"
+	"fmt"
+
+	"github.com/jacobsa/fuse"
+)
+
+// Config describes a mount for MountWithConfig
+type Config struct {
+	// bucket[:prefix], or a wasb:// or adl:// url
+	Bucket     string
+	MountPoint string
+
+	// optional, DefaultFlags() if nil. MountPoint above takes
+	// precedence over the one in here
+	Flags *FlagStorage
+}
+
+// Mounted is a mount served by this process
+type Mounted struct {
+	fs    *Goofys
+	mfs   *fuse.MountedFileSystem
+	flags *FlagStorage
+}
+
+// MountWithConfig mounts a bucket for programs that embed goofys. It
+// returns once the file system is ready to be used
+func MountWithConfig(ctx context.Context, config Config) (*Mounted, error) {
+	if config.Bucket == "" || config.MountPoint == "" {
+		return nil, fmt.Errorf("Mount: Bucket and MountPoint are required")
+	}
+
+	flags, err := mountFlags(config)
+	if err != nil {
+		return nil, err
+	}
+
+	fs, mfs, err := Mount(ctx, config.Bucket, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &Mounted{fs: fs, mfs: mfs, flags: flags}, nil
+}
+
+// mountFlags returns the flags to mount config with
+func mountFlags(config Config) (*FlagStorage, error) {
+	var flags *FlagStorage
+	if config.Flags == nil {
+		flags = DefaultFlags()
+	} else {
+		// the caller may mount the same flags more than once,
+		// and mounting changes them
+		flags = config.Flags.Clone()
+	}
+	flags.MountPoint = config.MountPoint
+	flags.MountPointArg = config.MountPoint
+
+	err := ValidateFlags(flags)
+	if err != nil {
+		return nil, fmt.Errorf("Mount: %v", err)
+	}
+	return flags, nil
+}
+
+func (m *Mounted) Stats() MountStats {
+	return m.fs.Stats()
+}
+
+// Flush uploads the files that are being written, as if they were
+// closed
+func (m *Mounted) Flush(ctx context.Context) error {
+	return m.fs.FlushAll(ctx)
+}
+
+// InvalidatePath forgets what is cached about path, relative to the
+// mount point, and everything below it
+func (m *Mounted) InvalidatePath(path string) error {
+	return m.fs.InvalidatePath(path)
+}
+
+// Unmount flushes the files being written, unmounts, and waits for
+// the file system to be released. Fails if the mount is busy
+func (m *Mounted) Unmount(ctx context.Context) error {
+	err := m.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = TryUnmount(m.flags.MountPoint)
+	if err != nil {
+		return err
+	}
+	return m.Join(ctx)
+}
+
+// Join waits until the file system is unmounted, by Unmount or
+// otherwise
+func (m *Mounted) Join(ctx context.Context) error {
+	err := m.mfs.Join(ctx)
+	if err == nil {
+		m.fs.FireHook(internal.HOOK_UNMOUNTED, m.flags.MountPoint)
+		m.fs.WaitHooks(internal.HOOK_TIMEOUT)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goofys
+
+import (
+	. "github.com/kahing/goofys/api/common"
+	"github.com/kahing/goofys/internal"
+	. "gopkg.in/check.v1"
+
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type EmbedTest struct {
+}
+
+var _ = Suite(&EmbedTest{})
+
+func (s *EmbedTest) TestMountFlagsTwice(t *C) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	config := (&S3Config{
+		AccessKey:        "foo",
+		SecretKey:        "bar",
+		SseC:             key,
+		EndpointFallback: []string{"127.0.0.1:9000"},
+	}).Init()
+	flags := DefaultFlags()
+	flags.Backend = config
+	flags.MountOptions["ro"] = ""
+
+	for _, mnt := range []string{"/mnt/a", "/mnt/b"} {
+		f, err := mountFlags(Config{Bucket: "bucket", MountPoint: mnt, Flags: flags})
+		t.Assert(err, IsNil)
+		t.Assert(f.MountPoint, Equals, mnt)
+
+		// opening the bucket decodes the key in its copy
+		_, err = internal.NewBackend("bucket", f)
+		t.Assert(err, IsNil)
+		t.Assert(f.Backend.(*S3Config).SseC, Not(Equals), key)
+
+		f.MountOptions["allow_other"] = ""
+		f.Backend.(*S3Config).EndpointFallback[0] = "127.0.0.1:9001"
+	}
+
+	t.Assert(flags.MountPoint, Equals, "")
+	t.Assert(flags.MountOptions, DeepEquals, map[string]string{"ro": ""})
+	t.Assert(config.SseC, Equals, key)
+	t.Assert(config.SseCDigest, Equals, "")
+	t.Assert(config.EndpointFallback, DeepEquals, []string{"127.0.0.1:9000"})
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ACL_XATTR is not included in listxattr because reading it costs a
+// request per object
+const ACL_XATTR = "s3.acl"
+
+// s3Backend returns the S3 implementation behind cloud, or nil if
+// cloud isn't S3
+func s3Backend(cloud StorageBackend) *S3Backend {
+	switch c := unwrapBackend(cloud).(type) {
+	case *S3Backend:
+		return c
+	case *GCS3:
+		return c.S3Backend
+	default:
+		return nil
+	}
+}
+
+// s3Object returns the S3 implementation behind cloud, or nil if
+// cloud isn't S3, and the key that stores key in it
+func s3Object(cloud StorageBackend, key string) (*S3Backend, string) {
+	if sharded := shardedBackend(cloud); sharded != nil {
+		key = sharded.key(key)
+	}
+	return s3Backend(cloud), key
+}
+
+func formatGrantee(g *s3.Grantee) string {
+	switch {
+	case g.ID != nil:
+		return "id=" + *g.ID
+	case g.URI != nil:
+		return "uri=" + *g.URI
+	case g.EmailAddress != nil:
+		return "email=" + *g.EmailAddress
+	default:
+		return "unknown"
+	}
+}
+
+// formatACL renders one GRANTEE:PERMISSION per line, the owner first
+func formatACL(resp *s3.GetObjectAclOutput) []byte {
+	var buf bytes.Buffer
+
+	if resp.Owner != nil && resp.Owner.ID != nil {
+		fmt.Fprintf(&buf, "owner=%v\n", *resp.Owner.ID)
+	}
+	for _, g := range resp.Grants {
+		if g.Grantee == nil || g.Permission == nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "%v:%v\n", formatGrantee(g.Grantee), *g.Permission)
+	}
+	return buf.Bytes()
+}
+
+func (s *S3Backend) getObjectACL(key string) ([]byte, error) {
+	resp, err := s.GetObjectAcl(&s3.GetObjectAclInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	return formatACL(resp), nil
+}
+
+func (s *S3Backend) putObjectACL(key string, canned string) error {
+	_, err := s.PutObjectAcl(&s3.PutObjectAclInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+		ACL:    &canned,
+	})
+	return mapAwsError(err)
+}
+
+func (inode *Inode) getACL() ([]byte, error) {
+	if inode.isDir() {
+		return nil, syscall.ENODATA
+	}
+
+	s, key := s3Object(inode.cloud())
+	if s == nil {
+		return nil, syscall.ENOTSUP
+	}
+	return s.getObjectACL(key)
+}
+
+// setACL applies a canned ACL, like the one --acl applies to new
+// objects
+func (inode *Inode) setACL(value []byte) error {
+	if inode.isDir() {
+		return syscall.EPERM
+	}
+
+	s, key := s3Object(inode.cloud())
+	if s == nil {
+		return syscall.ENOTSUP
+	}
+
+	canned := string(bytes.TrimSpace(value))
+	if canned == "" {
+		return syscall.EINVAL
+	}
+	return s.putObjectACL(key, canned)
+}
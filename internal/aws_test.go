@@ -18,7 +18,18 @@ import (
 	. "github.com/kahing/goofys/api/common"
 	. "gopkg.in/check.v1"
 
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
 )
 
 type AwsTest struct {
@@ -51,3 +62,375 @@ func (s *AwsTest) TestBucket404(t *C) {
 	t.Assert(err, Equals, fuse.ENOENT)
 	t.Assert(isAws, Equals, true)
 }
+
+// fakeBucketServer answers just enough of S3 for Init with
+// --ensure-bucket. Unsigned HEADs are region detection.
+type fakeBucketServer struct {
+	mu       sync.Mutex
+	region   string
+	exists   bool
+	requests []string
+	create   *http.Request
+	body     string
+}
+
+func (f *fakeBucketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	signed := r.Header.Get("Authorization") != ""
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization"))
+
+	switch {
+	case r.Method == "HEAD" && r.URL.Path == "/bucket" && !signed:
+		if f.exists {
+			w.Header().Set("X-Amz-Bucket-Region", f.region)
+			w.WriteHeader(403)
+		} else {
+			w.WriteHeader(404)
+		}
+	case r.Method == "HEAD" && r.URL.Path == "/bucket":
+		if f.exists {
+			w.WriteHeader(200)
+		} else {
+			w.WriteHeader(404)
+		}
+	case r.Method == "PUT" && r.URL.Path == "/bucket":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.create = r
+		f.body = string(body)
+		f.exists = true
+		w.WriteHeader(200)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func (s *AwsTest) newEnsureBucket(t *C, f *fakeBucketServer) (*S3Backend, *httptest.Server) {
+	server := httptest.NewServer(f)
+	s3, err := NewS3("bucket", &FlagStorage{Endpoint: server.URL}, &S3Config{
+		Region:       "eu-west-1",
+		AccessKey:    "foo",
+		SecretKey:    "bar",
+		ACL:          "bucket-owner-full-control",
+		EnsureBucket: true,
+	})
+	t.Assert(err, IsNil)
+	return s3, server
+}
+
+func (s *AwsTest) TestEnsureBucketCreate(t *C) {
+	f := &fakeBucketServer{}
+	s3, server := s.newEnsureBucket(t, f)
+	defer server.Close()
+
+	t.Assert(s3.Init("key"), IsNil)
+	t.Assert(f.create, NotNil)
+	// object ACLs are not valid on buckets
+	t.Assert(f.create.Header.Get("X-Amz-Acl"), Equals, "")
+	t.Assert(strings.Contains(f.body, "<LocationConstraint>eu-west-1</LocationConstraint>"),
+		Equals, true, Commentf("%v", f.body))
+}
+
+func (s *AwsTest) TestEnsureBucketOtherRegion(t *C) {
+	f := &fakeBucketServer{region: "ap-south-1", exists: true}
+	s3, server := s.newEnsureBucket(t, f)
+	defer server.Close()
+
+	t.Assert(s3.Init("key"), IsNil)
+	t.Assert(f.create, IsNil)
+	t.Assert(*s3.awsConfig.Region, Equals, "ap-south-1")
+	// the bucket is checked in the region we detected
+	t.Assert(len(f.requests) > 1, Equals, true)
+	t.Assert(strings.Contains(f.requests[1], "/ap-south-1/s3/"), Equals, true,
+		Commentf("%v", f.requests))
+}
+
+// fakeLifecycleServer stores the lifecycle configuration of "bucket"
+type fakeLifecycleServer struct {
+	mu     sync.Mutex
+	config string
+}
+
+func (f *fakeLifecycleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := r.URL.Query()["lifecycle"]; !ok || r.URL.Path != "/bucket" {
+		w.WriteHeader(400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if f.config == "" {
+			w.WriteHeader(404)
+			w.Write([]byte("<Error><Code>NoSuchLifecycleConfiguration</Code></Error>"))
+		} else {
+			w.Write([]byte(f.config))
+		}
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.config = string(body)
+	case "DELETE":
+		f.config = ""
+		w.WriteHeader(204)
+	}
+}
+
+func (f *fakeLifecycleServer) get() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.config
+}
+
+func (s *AwsTest) newLifecycleBackend(t *C, f *fakeLifecycleServer) (*S3Backend, *httptest.Server) {
+	server := httptest.NewServer(f)
+	s3, err := NewS3("bucket", &FlagStorage{Endpoint: server.URL}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "foo",
+		SecretKey: "bar",
+	})
+	t.Assert(err, IsNil)
+	return s3, server
+}
+
+func (s *AwsTest) TestParseTransition(t *C) {
+	tr, err := parseTransition("30:glacier")
+	t.Assert(err, IsNil)
+	t.Assert(tr, DeepEquals, LifecycleTransition{30, "GLACIER"})
+
+	for _, bad := range []string{"30", "x:GLACIER", "-1:GLACIER"} {
+		_, err = parseTransition(bad)
+		t.Assert(err, NotNil, Commentf("%v", bad))
+	}
+
+	config := &LifecycleConfig{
+		ExpireDays:      365,
+		Transitions:     []LifecycleTransition{{30, "STANDARD_IA"}},
+		AbortUploadDays: 7,
+	}
+	rule := config.rule("dir/")
+	t.Assert(*rule.ID, Equals, "goofys-dir/")
+	t.Assert(*rule.Filter.Prefix, Equals, "dir/")
+	t.Assert(*rule.Expiration.Days, Equals, int64(365))
+	t.Assert(rule.Transitions, HasLen, 1)
+	t.Assert(*rule.Transitions[0].StorageClass, Equals, "STANDARD_IA")
+	t.Assert(*rule.AbortIncompleteMultipartUpload.DaysAfterInitiation, Equals, int64(7))
+
+	t.Assert((&LifecycleConfig{}).empty(), Equals, true)
+}
+
+func (s *AwsTest) TestApplyLifecycle(t *C) {
+	f := &fakeLifecycleServer{
+		config: `<LifecycleConfiguration><Rule><ID>theirs</ID><Filter><Prefix>other/</Prefix></Filter>` +
+			`<Status>Enabled</Status><Expiration><Days>1</Days></Expiration></Rule></LifecycleConfiguration>`,
+	}
+	backend, server := s.newLifecycleBackend(t, f)
+	defer server.Close()
+
+	err := ApplyLifecycle(backend, "dir/", &LifecycleConfig{ExpireDays: 10})
+	t.Assert(err, IsNil)
+	t.Assert(strings.Contains(f.get(), "<ID>theirs</ID>"), Equals, true)
+	t.Assert(strings.Contains(f.get(), "<ID>goofys-dir/</ID>"), Equals, true)
+
+	// applying again replaces our rule
+	err = ApplyLifecycle(backend, "dir/", &LifecycleConfig{ExpireDays: 20})
+	t.Assert(err, IsNil)
+	t.Assert(strings.Count(f.get(), "<ID>goofys-dir/</ID>"), Equals, 1)
+	t.Assert(strings.Contains(f.get(), "<Days>20</Days>"), Equals, true)
+
+	// removing ours leaves theirs alone
+	err = ApplyLifecycle(backend, "dir/", &LifecycleConfig{})
+	t.Assert(err, IsNil)
+	t.Assert(strings.Contains(f.get(), "<ID>theirs</ID>"), Equals, true)
+	t.Assert(strings.Contains(f.get(), "goofys-dir/"), Equals, false)
+
+	// and the configuration goes away once nothing is left
+	f.config = ""
+	err = ApplyLifecycle(backend, "dir/", &LifecycleConfig{ExpireDays: 10})
+	t.Assert(err, IsNil)
+	err = ApplyLifecycle(backend, "dir/", &LifecycleConfig{})
+	t.Assert(err, IsNil)
+	t.Assert(f.get(), Equals, "")
+}
+
+func (s *AwsTest) TestApplyLifecycleSharded(t *C) {
+	f := &fakeLifecycleServer{}
+	backend, server := s.newLifecycleBackend(t, f)
+	defer server.Close()
+
+	sched := Scheduler{Requests: 1}.Init()
+	cloud := NewScheduledBackend(NewShardedBackend(backend, []string{"a/", "b/"}),
+		sched.NewClass(1))
+
+	err := ApplyLifecycle(cloud, "dir/", &LifecycleConfig{ExpireDays: 10})
+	t.Assert(err, IsNil)
+	t.Assert(strings.Contains(f.get(), "<Prefix>a/dir/</Prefix>"), Equals, true)
+	t.Assert(strings.Contains(f.get(), "<Prefix>b/dir/</Prefix>"), Equals, true)
+
+	err = ApplyLifecycle(cloud, "dir/", &LifecycleConfig{})
+	t.Assert(err, IsNil)
+	t.Assert(f.get(), Equals, "")
+}
+
+// fakeMinioServer streams notifications and then keeps the connection
+// open like MinIO does
+type fakeMinioServer struct {
+	notifications []string
+	closed        chan bool
+	prefix        string
+}
+
+func (f *fakeMinioServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.prefix = r.URL.Query().Get("prefix")
+	for _, n := range f.notifications {
+		w.Write([]byte(n + "\n \n"))
+	}
+	w.(http.Flusher).Flush()
+
+	<-r.Context().Done()
+	f.closed <- true
+}
+
+func (s *AwsTest) TestMinioNotify(t *C) {
+	// longer than a bufio.Scanner line
+	long := strings.Repeat("x", 100*1024)
+	f := &fakeMinioServer{
+		notifications: []string{
+			`{"Records":[{"eventName":"s3:ObjectCreated:Put","s3":{"object":{"key":"prefix/` + long + `"}}}]}`,
+			`{"Records":[{"eventName":"s3:ObjectRemoved:Delete","s3":{"object":{"key":"prefix/file"}}}]}`,
+		},
+		closed: make(chan bool, 1),
+	}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	s3, err := NewS3("bucket", &FlagStorage{Endpoint: server.URL}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "foo",
+		SecretKey: "bar",
+	})
+	t.Assert(err, IsNil)
+
+	fs := &Goofys{
+		inodes: make(map[fuseops.InodeID]*Inode),
+		clock:  systemClock{},
+	}
+	fs.ctx, fs.cancel = context.WithCancel(context.Background())
+	root := NewInode(fs, nil, PString(""))
+	root.ToDir()
+	fs.inodes[fuseops.RootInodeID] = root
+
+	events := minioEvents.Value()
+	done := make(chan bool)
+	go func() {
+		fs.listenMinio(s3, "prefix/")
+		done <- true
+	}()
+
+	for i := 0; minioEvents.Value() != events+2; i++ {
+		t.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// unmounting hangs up
+	fs.Destroy()
+	<-f.closed
+	<-done
+	t.Assert(f.prefix, Equals, "prefix/")
+}
+
+func (s *AwsTest) TestMinioNotifySharded(t *C) {
+	f := &fakeMinioServer{
+		notifications: []string{
+			// not in a shard
+			`{"Records":[{"eventName":"s3:ObjectCreated:Put","s3":{"object":{"key":"prefix/file"}}}]}`,
+			// not in the mount
+			`{"Records":[{"eventName":"s3:ObjectCreated:Put","s3":{"object":{"key":"b/other/file"}}}]}`,
+			`{"Records":[{"eventName":"s3:ObjectCreated:Put","s3":{"object":{"key":"a/prefix/file"}}}]}`,
+		},
+		closed: make(chan bool, 1),
+	}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	s3, err := NewS3("bucket", &FlagStorage{Endpoint: server.URL}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "foo",
+		SecretKey: "bar",
+	})
+	t.Assert(err, IsNil)
+
+	fs := &Goofys{
+		inodes: make(map[fuseops.InodeID]*Inode),
+		clock:  systemClock{},
+	}
+	fs.ctx, fs.cancel = context.WithCancel(context.Background())
+	root := NewInode(fs, nil, PString(""))
+	root.ToDir()
+	fs.inodes[fuseops.RootInodeID] = root
+
+	events := minioEvents.Value()
+	done := make(chan bool)
+	go func() {
+		fs.listenMinio(NewShardedBackend(s3, []string{"a/", "b/"}), "prefix/")
+		done <- true
+	}()
+
+	// the events are handled in order, so the others were
+	// dropped by the time the last one is counted
+	for i := 0; minioEvents.Value() != events+1; i++ {
+		t.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fs.Destroy()
+	<-f.closed
+	<-done
+	t.Assert(minioEvents.Value(), Equals, events+1)
+	// the keys start with the shard, not the prefix
+	t.Assert(f.prefix, Equals, "")
+}
+
+type fakeExpiredServer struct{}
+
+func (f fakeExpiredServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(400)
+	w.Write([]byte("<Error><Code>ExpiredToken</Code><Message>expired</Message></Error>"))
+}
+
+func (s *AwsTest) TestCredentialHook(t *C) {
+	server := httptest.NewServer(fakeExpiredServer{})
+	defer server.Close()
+
+	s3, err := NewS3("bucket", &FlagStorage{Endpoint: server.URL}, &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "foo",
+		SecretKey: "bar",
+	})
+	t.Assert(err, IsNil)
+
+	dir, err := ioutil.TempDir("", "goofys-hooks")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "events")
+
+	h := &hookSet{
+		exec:   "echo $GOOFYS_EVENT $GOOFYS_DETAIL >> " + out,
+		events: map[string]bool{HOOK_CREDENTIAL_REFRESH_FAILED: true},
+		last:   make(map[string]time.Time),
+	}
+	h.watch(NewShardedBackend(s3, []string{"a/"}))
+	t.Assert(s3.hooks, Equals, h)
+
+	_, err = s3.HeadBlob(&HeadBlobInput{Key: "file"})
+	t.Assert(err, NotNil)
+	_, err = s3.ListBlobs(&ListBlobsInput{})
+	t.Assert(err, NotNil)
+	h.wait(HOOK_TIMEOUT)
+
+	data, err := ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Assert(string(data), Equals, "credential-refresh-failed ExpiredToken\n")
+}
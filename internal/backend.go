@@ -15,6 +15,7 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -35,6 +36,9 @@ type Capabilities struct {
 
 type HeadBlobInput struct {
 	Key string
+
+	// cancels the request, optional
+	Context context.Context
 }
 
 type BlobItemOutput struct {
@@ -51,6 +55,14 @@ type HeadBlobOutput struct {
 	ContentType *string
 	Metadata    map[string]*string
 	IsDirBlob   bool
+
+	CacheControl *string
+	Expires      *string
+
+	// S3 Object Lock, nil if the object is not locked
+	ObjectLockMode            *string
+	ObjectLockRetainUntilDate *time.Time
+	ObjectLockLegalHoldStatus *string
 }
 
 type ListBlobsInput struct {
@@ -59,6 +71,9 @@ type ListBlobsInput struct {
 	MaxKeys           *uint32
 	StartAfter        *string // XXX: not supported by Azure
 	ContinuationToken *string
+
+	// cancels the request, optional
+	Context context.Context
 }
 
 type BlobPrefixOutput struct {
@@ -104,6 +119,11 @@ type CopyBlobInput struct {
 	ETag         *string            // if non-nil, do conditional copy
 	Metadata     map[string]*string // if nil, copy from Source
 	StorageClass *string            // if nil, copy from Source
+	Tags         map[string]string  // if nil, copy from Source
+
+	// copy in parts this large if the object is larger, 0 is the
+	// backend's default. Only supported by S3
+	PartSize uint64
 }
 
 type CopyBlobOutput struct {
@@ -114,6 +134,9 @@ type GetBlobInput struct {
 	Start   uint64
 	Count   uint64
 	IfMatch *string
+
+	// cancels the request, optional
+	Context context.Context
 }
 
 type GetBlobOutput struct {
@@ -128,8 +151,16 @@ type PutBlobInput struct {
 	ContentType *string
 	DirBlob     bool
 
+	// override the backend's storage class and set these tags,
+	// optional and only supported by S3
+	StorageClass *string
+	Tags         map[string]string
+
 	Body io.ReadSeeker
 	Size *uint64
+
+	// cancels the request, optional
+	Context context.Context
 }
 
 type PutBlobOutput struct {
@@ -141,6 +172,10 @@ type MultipartBlobBeginInput struct {
 	Key         string
 	Metadata    map[string]*string
 	ContentType *string
+
+	// same as PutBlobInput
+	StorageClass *string
+	Tags         map[string]string
 }
 
 type MultipartBlobCommitInput struct {
@@ -176,6 +211,10 @@ type MultipartBlobAbortOutput struct {
 }
 
 type MultipartExpireInput struct {
+	Prefix string
+	// uploads initiated longer ago than this are aborted, 0
+	// means the backend's default
+	Age time.Duration
 }
 
 type MultipartExpireOutput struct {
@@ -222,6 +261,13 @@ type StorageBackend interface {
 
 var SmallActionsGate = Ticket{Total: 100}.Init()
 
+func contextOrTODO(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.TODO()
+	}
+	return ctx
+}
+
 type sortBlobPrefixOutput []BlobPrefixOutput
 
 func (p sortBlobPrefixOutput) Len() int {
@@ -275,6 +321,9 @@ type StorageBackendInitWrapper struct {
 	init    sync.Once
 	initKey string
 	initErr error
+
+	// set when mounted, see hookSet.watch
+	hooks *hookSet
 }
 
 const INIT_ERR_BLOB = "mount.err"
@@ -284,6 +333,7 @@ func (s *StorageBackendInitWrapper) Init(key string) error {
 		s.initErr = s.StorageBackend.Init(s.initKey)
 		if s.initErr != nil {
 			log.Errorf("%T Init: %v", s.StorageBackend, s.initErr)
+			s.hooks.fire(HOOK_DEGRADED_MODE_ENTERED, fmt.Sprintf("%v unavailable: %v", s.initKey, s.initErr))
 			s.StorageBackend = StorageBackendInitError{s.initErr}
 		}
 	})
@@ -162,7 +162,7 @@ func NewADLv1(bucket string, flags *FlagStorage, config *ADLv1Config) (*ADLv1, e
 func mapADLv1Error(resp *http.Response, err error, rawError bool) error {
 	if resp == nil {
 		if err != nil {
-			return syscall.EAGAIN
+			return classError("server")
 		} else {
 			return err
 		}
@@ -180,7 +180,7 @@ func mapADLv1Error(resp *http.Response, err error, rawError bool) error {
 				return adlErr
 			} else {
 				adls1Log.Errorf("cannot parse error: %v", err)
-				return syscall.EAGAIN
+				return classError("server")
 			}
 		} else {
 			err = mapHttpError(resp.StatusCode)
@@ -188,7 +188,7 @@ func mapADLv1Error(resp *http.Response, err error, rawError bool) error {
 				return err
 			} else {
 				adlLogResp(logrus.ErrorLevel, resp)
-				return syscall.EINVAL
+				return classError("invalid")
 			}
 		}
 	}
@@ -235,7 +235,7 @@ func adlv1FileStatus2BlobItem(f *adl.FileStatusProperties, key *string) BlobItem
 }
 
 func (b *ADLv1) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
-	res, err := b.client.GetFileStatus(context.TODO(), b.account, b.path(param.Key), nil)
+	res, err := b.client.GetFileStatus(contextOrTODO(param.Context), b.account, b.path(param.Key), nil)
 	err = mapADLv1Error(res.Response.Response, err, false)
 	if err != nil {
 		return nil, err
@@ -461,7 +461,7 @@ func (b *ADLv1) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 		filesessionid = &u
 	}
 
-	resp, err := b.client.Open(context.TODO(), b.account, b.path(param.Key), length, offset,
+	resp, err := b.client.Open(contextOrTODO(param.Context), b.account, b.path(param.Key), length, offset,
 		filesessionid)
 	err = mapADLv1Error(resp.Response.Response, err, false)
 	if err != nil {
@@ -506,7 +506,7 @@ func (b *ADLv1) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 			return nil, err
 		}
 	} else {
-		res, err := b.client.Create(context.TODO(), b.account, b.path(param.Key),
+		res, err := b.client.Create(contextOrTODO(param.Context), b.account, b.path(param.Key),
 			&ReadSeekerCloser{param.Body}, PBool(true), adl.CLOSE, nil,
 			PInt32(int32(b.flags.FileMode)))
 		err = mapADLv1Error(res.Response, err, false)
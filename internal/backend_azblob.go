@@ -53,6 +53,9 @@ type AZBlob struct {
 	tokenExpire      time.Time
 	tokenRenewBuffer time.Duration
 	tokenRenewGate   *Ticket
+
+	// set when mounted, see hookSet.watch
+	hooks *hookSet
 }
 
 const AzuriteEndpoint = "http://127.0.0.1:8080/devstoreaccount1/"
@@ -166,6 +169,7 @@ func (b *AZBlob) refreshToken() (*azblob.ContainerURL, error) {
 			_, err := b.updateToken()
 			if err != nil {
 				azbLog.Errorf("Unable to refresh token: %v", err)
+				b.hooks.fire(HOOK_CREDENTIAL_REFRESH_FAILED, err.Error())
 				return nil, syscall.EACCES
 			}
 		} else {
@@ -182,6 +186,7 @@ func (b *AZBlob) refreshToken() (*azblob.ContainerURL, error) {
 				_, err := b.updateToken()
 				if err != nil {
 					azbLog.Errorf("Unable to refresh token: %v", err)
+					b.hooks.fire(HOOK_CREDENTIAL_REFRESH_FAILED, err.Error())
 				}
 			}()
 
@@ -285,47 +290,47 @@ func mapAZBError(err error) error {
 	if stgErr, ok := err.(azblob.StorageError); ok {
 		switch stgErr.ServiceCode() {
 		case azblob.ServiceCodeBlobAlreadyExists:
-			return syscall.EACCES
+			return classError("denied")
 		case azblob.ServiceCodeBlobNotFound:
 			return fuse.ENOENT
 		case azblob.ServiceCodeContainerAlreadyExists:
 			return syscall.EEXIST
 		case azblob.ServiceCodeContainerBeingDeleted:
-			return syscall.EAGAIN
+			return classError("server")
 		case azblob.ServiceCodeContainerDisabled:
-			return syscall.EACCES
+			return classError("denied")
 		case azblob.ServiceCodeContainerNotFound:
 			return syscall.ENODEV
 		case azblob.ServiceCodeCopyAcrossAccountsNotSupported:
-			return fuse.EINVAL
+			return classError("invalid")
 		case azblob.ServiceCodeSourceConditionNotMet:
-			return fuse.EINVAL
+			return classError("invalid")
 		case azblob.ServiceCodeSystemInUse:
-			return syscall.EAGAIN
+			return classError("throttled")
 		case azblob.ServiceCodeTargetConditionNotMet:
-			return fuse.EINVAL
+			return classError("invalid")
 		case azblob.ServiceCodeBlobBeingRehydrated:
-			return syscall.EAGAIN
+			return classError("server")
 		case azblob.ServiceCodeBlobArchived:
-			return fuse.EINVAL
+			return classError("invalid")
 		case azblob.ServiceCodeAccountBeingCreated:
-			return syscall.EAGAIN
+			return classError("server")
 		case azblob.ServiceCodeAuthenticationFailed:
-			return syscall.EACCES
+			return classError("denied")
 		case azblob.ServiceCodeConditionNotMet:
 			return syscall.EBUSY
 		case azblob.ServiceCodeInternalError:
-			return syscall.EAGAIN
+			return classError("server")
 		case azblob.ServiceCodeInvalidAuthenticationInfo:
-			return syscall.EACCES
+			return classError("denied")
 		case azblob.ServiceCodeOperationTimedOut:
-			return syscall.EAGAIN
+			return classError("server")
 		case azblob.ServiceCodeResourceNotFound:
 			return fuse.ENOENT
 		case azblob.ServiceCodeServerBusy:
-			return syscall.EAGAIN
+			return classError("throttled")
 		case "AuthorizationFailure": // from Azurite emulator
-			return syscall.EACCES
+			return classError("denied")
 		default:
 			err = mapHttpError(stgErr.Response().StatusCode)
 			if err != nil {
@@ -366,7 +371,7 @@ func (b *AZBlob) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 	}
 
 	blob := c.NewBlobURL(param.Key)
-	resp, err := blob.GetProperties(context.TODO(), azblob.BlobAccessConditions{})
+	resp, err := blob.GetProperties(contextOrTODO(param.Context), azblob.BlobAccessConditions{})
 	if err != nil {
 		return nil, mapAZBError(err)
 	}
@@ -440,7 +445,7 @@ func (b *AZBlob) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 	}
 
 	if param.Delimiter != nil {
-		resp, err := c.ListBlobsHierarchySegment(context.TODO(),
+		resp, err := c.ListBlobsHierarchySegment(contextOrTODO(param.Context),
 			azblob.Marker{
 				param.ContinuationToken,
 			},
@@ -464,7 +469,7 @@ func (b *AZBlob) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 		blobItems = resp.Segment.BlobItems
 		nextMarker = resp.NextMarker.Val
 	} else {
-		resp, err := c.ListBlobsFlatSegment(context.TODO(),
+		resp, err := c.ListBlobsFlatSegment(contextOrTODO(param.Context),
 			azblob.Marker{
 				param.ContinuationToken,
 			},
@@ -639,7 +644,7 @@ func (b *AZBlob) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 		ifMatch = azblob.ETag(*param.IfMatch)
 	}
 
-	resp, err := blob.Download(context.TODO(),
+	resp, err := blob.Download(contextOrTODO(param.Context),
 		int64(param.Start), int64(param.Count),
 		azblob.BlobAccessConditions{
 			ModifiedAccessConditions: azblob.ModifiedAccessConditions{
@@ -677,7 +682,7 @@ func (b *AZBlob) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	}
 
 	blob := c.NewBlobURL(param.Key).ToBlockBlobURL()
-	resp, err := blob.Upload(context.TODO(),
+	resp, err := blob.Upload(contextOrTODO(param.Context),
 		body,
 		azblob.BlobHTTPHeaders{
 			ContentType: nilStr(param.ContentType),
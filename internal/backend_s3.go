@@ -17,11 +17,15 @@ package internal
 import (
 	. "github.com/kahing/goofys/api/common"
 
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -49,6 +53,18 @@ type S3Backend struct {
 	aws      bool
 	gcs      bool
 	v2Signer bool
+
+	// multipart uploads that are in progress in this process,
+	// so MultipartExpire won't abort them
+	mu      sync.Mutex
+	uploads map[string]bool
+
+	// set when mounted, see hookSet.watch
+	hooks *hookSet
+
+	// the SSE-C key and its MD5, from --sse-c or the keyring
+	sseC       string
+	sseCDigest string
 }
 
 func NewS3(bucket string, flags *FlagStorage, config *S3Config) (*S3Backend, error) {
@@ -64,6 +80,23 @@ func NewS3(bucket string, flags *FlagStorage, config *S3Config) (*S3Backend, err
 		cap: Capabilities{
 			Name: "s3",
 		},
+		uploads: make(map[string]bool),
+		// decoded by ToAwsConfig
+		sseC:       config.SseC,
+		sseCDigest: config.SseCDigest,
+	}
+
+	// the key is read from the keyring when the bucket is opened
+	// and not when the flags are parsed, so every command that
+	// opens a bucket gets it and it's never kept in the flags
+	if config.SseCKeyId != "" {
+		key, err := sseCFromKeyring(config.SseCKeyId)
+		if err != nil {
+			return nil, err
+		}
+		m := md5.Sum([]byte(key))
+		s.sseC = key
+		s.sseCDigest = base64.StdEncoding.EncodeToString(m[:])
 	}
 
 	if flags.DebugS3 {
@@ -110,15 +143,55 @@ func (s *S3Backend) setV2Signer(handlers *request.Handlers) {
 	handlers.Sign.PushBackNamed(corehandlers.BuildContentLengthHandler)
 }
 
+func (s *S3Backend) setV4ASigner(handlers *request.Handlers) {
+	// multi-region access points route the request to any of the
+	// regions so the signature has to cover all of them unless
+	// told otherwise
+	regionSet := s.config.SigningRegion
+	if regionSet == "" {
+		regionSet = "*"
+	}
+
+	handlers.Sign.Clear()
+	handlers.Sign.PushBack(SignV4A(regionSet))
+	handlers.Sign.PushBackNamed(corehandlers.BuildContentLengthHandler)
+}
+
 func (s *S3Backend) newS3() {
 	s.S3 = s3.New(s.config.Session, s.awsConfig)
 	if s.config.RequesterPays {
 		s.S3.Handlers.Build.PushBack(addRequestPayer)
 	}
-	if s.v2Signer {
+	if s.config.SigningRegion != "" {
+		// the endpoint may be in a different region than the
+		// one the request has to be signed for
+		s.S3.Client.ClientInfo.SigningRegion = s.config.SigningRegion
+	}
+	if s.config.SigV4A {
+		s.setV4ASigner(&s.S3.Handlers)
+	} else if s.v2Signer {
 		s.setV2Signer(&s.S3.Handlers)
 	}
 	s.S3.Handlers.Sign.PushBack(addAcceptEncoding)
+	s.S3.Handlers.Complete.PushBack(countRequest)
+	s.S3.Handlers.Complete.PushBack(s.checkCredentials)
+}
+
+// checkCredentials is an S3 Complete handler that tells the hooks
+// when a request failed because the credentials couldn't be
+// refreshed
+func (s *S3Backend) checkCredentials(r *request.Request) {
+	awsErr, ok := r.Error.(awserr.Error)
+	if !ok {
+		return
+	}
+
+	switch awsErr.Code() {
+	case "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired":
+		s.hooks.fire(HOOK_CREDENTIAL_REFRESH_FAILED, awsErr.Code())
+	case "NoCredentialProviders":
+		s.hooks.fire(HOOK_CREDENTIAL_REFRESH_FAILED, awsErr.Message())
+	}
 }
 
 func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
@@ -146,9 +219,16 @@ func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
 		return
 	}
 
+	// use the same transport as the S3 client so we go through the
+	// configured proxy
+	transport := http.DefaultTransport
+	if s.awsConfig.HTTPClient != nil && s.awsConfig.HTTPClient.Transport != nil {
+		transport = s.awsConfig.HTTPClient.Transport
+	}
+
 	allowFails := 3
 	for i := 0; i < allowFails; i++ {
-		resp, err = http.DefaultTransport.RoundTrip(req)
+		resp, err = transport.RoundTrip(req)
 		if err != nil {
 			return
 		}
@@ -199,6 +279,10 @@ func (s *S3Backend) detectBucketLocationByHEAD() (err error, isAws bool) {
 				*s.awsConfig.Region, region[0])
 			s.awsConfig.Region = &region[0]
 		}
+		if s.config.SigningRegion != "" && s.config.SigningRegion != region[0] {
+			s3Log.Infof("Bucket is in region '%v' but signing for '%v'",
+				region[0], s.config.SigningRegion)
+		}
 
 		// we detected a region, this is aws, the error is irrelevant
 		err = nil
@@ -242,7 +326,9 @@ func (s *S3Backend) Init(key string) error {
 			s.newS3()
 			s.aws = isAws
 		} else if err == fuse.ENOENT {
-			return fmt.Errorf("bucket %v does not exist", s.bucket)
+			if !s.config.EnsureBucket {
+				return fmt.Errorf("bucket %v does not exist", s.bucket)
+			}
 		} else {
 			// this is NOT AWS, we expect the request to fail with 403 if this is not
 			// an anonymous bucket
@@ -252,14 +338,23 @@ func (s *S3Backend) Init(key string) error {
 		}
 	}
 
+	// after region detection so the bucket is created where
+	// we are going to look for it
+	if s.config.EnsureBucket {
+		err = s.ensureBucket()
+		if err != nil {
+			return err
+		}
+	}
+
 	// try again with the credential to make sure
 	err = mapAwsError(s.testBucket(key))
 	if err != nil {
-		if !isAws {
+		if !isAws && !s.config.SigV4A {
 			// EMC returns 403 because it doesn't support v4 signing
 			// swift3, ceph-s3 returns 400
 			// Amplidata just gives up and return 500
-			if err == syscall.EACCES || err == fuse.EINVAL || err == syscall.EAGAIN {
+			if isErrorClass(err, "denied", "invalid", "server") {
 				err = s.fallbackV2Signer()
 				if err != nil {
 					return err
@@ -276,9 +371,9 @@ func (s *S3Backend) Init(key string) error {
 	return nil
 }
 
-func (s *S3Backend) ListObjectsV2(params *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+func (s *S3Backend) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
 	if s.aws {
-		return s.S3.ListObjectsV2(params)
+		return s.S3.ListObjectsV2WithContext(ctx, params)
 	} else {
 		v1 := s3.ListObjectsInput{
 			Bucket:       params.Bucket,
@@ -294,7 +389,7 @@ func (s *S3Backend) ListObjectsV2(params *s3.ListObjectsV2Input) (*s3.ListObject
 			v1.Marker = params.ContinuationToken
 		}
 
-		objs, err := s.S3.ListObjects(&v1)
+		objs, err := s.S3.ListObjectsWithContext(ctx, &v1)
 		if err != nil {
 			return nil, err
 		}
@@ -336,18 +431,32 @@ func metadataToLower(m map[string]*string) map[string]*string {
 	return m
 }
 
+// withKeyId adds the id of the SSE-C key to the metadata of an object
+// we are writing, if the key came from the keyring
+func (s *S3Backend) withKeyId(m map[string]*string) map[string]*string {
+	if s.config.SseCKeyId == "" {
+		return m
+	}
+
+	meta := map[string]*string{SSE_C_KEY_ID_METADATA: &s.config.SseCKeyId}
+	for k, v := range m {
+		meta[k] = v
+	}
+	return meta
+}
+
 func (s *S3Backend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 	head := s3.HeadObjectInput{
 		Bucket: &s.bucket,
 		Key:    &param.Key,
 	}
-	if s.config.SseC != "" {
+	if s.sseC != "" {
 		head.SSECustomerAlgorithm = PString("AES256")
-		head.SSECustomerKey = &s.config.SseC
-		head.SSECustomerKeyMD5 = &s.config.SseCDigest
+		head.SSECustomerKey = &s.sseC
+		head.SSECustomerKeyMD5 = &s.sseCDigest
 	}
 
-	resp, err := s.S3.HeadObject(&head)
+	resp, err := s.S3.HeadObjectWithContext(contextOrTODO(param.Context), &head)
 	if err != nil {
 		return nil, mapAwsError(err)
 	}
@@ -359,9 +468,15 @@ func (s *S3Backend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
 			Size:         uint64(*resp.ContentLength),
 			StorageClass: resp.StorageClass,
 		},
-		ContentType: resp.ContentType,
-		Metadata:    metadataToLower(resp.Metadata),
-		IsDirBlob:   strings.HasSuffix(param.Key, "/"),
+		ContentType:  resp.ContentType,
+		Metadata:     metadataToLower(resp.Metadata),
+		IsDirBlob:    strings.HasSuffix(param.Key, "/"),
+		CacheControl: resp.CacheControl,
+		Expires:      resp.Expires,
+
+		ObjectLockMode:            resp.ObjectLockMode,
+		ObjectLockRetainUntilDate: resp.ObjectLockRetainUntilDate,
+		ObjectLockLegalHoldStatus: resp.ObjectLockLegalHoldStatus,
 	}, nil
 }
 
@@ -372,7 +487,7 @@ func (s *S3Backend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
 		maxKeys = aws.Int64(int64(*param.MaxKeys))
 	}
 
-	resp, err := s.ListObjectsV2(&s3.ListObjectsV2Input{
+	resp, err := s.ListObjectsV2(contextOrTODO(param.Context), &s3.ListObjectsV2Input{
 		Bucket:            &s.bucket,
 		Prefix:            param.Prefix,
 		Delimiter:         param.Delimiter,
@@ -463,13 +578,13 @@ func (s *S3Backend) mpuCopyPart(from string, to string, mpuId string, bytes stri
 		CopySourceIfMatch: srcEtag,
 		PartNumber:        &part,
 	}
-	if s.config.SseC != "" {
+	if s.sseC != "" {
 		params.SSECustomerAlgorithm = PString("AES256")
-		params.SSECustomerKey = &s.config.SseC
-		params.SSECustomerKeyMD5 = &s.config.SseCDigest
+		params.SSECustomerKey = &s.sseC
+		params.SSECustomerKeyMD5 = &s.sseCDigest
 		params.CopySourceSSECustomerAlgorithm = PString("AES256")
-		params.CopySourceSSECustomerKey = &s.config.SseC
-		params.CopySourceSSECustomerKeyMD5 = &s.config.SseCDigest
+		params.CopySourceSSECustomerKey = &s.sseC
+		params.CopySourceSSECustomerKeyMD5 = &s.sseCDigest
 	}
 
 	s3Log.Debug(params)
@@ -485,7 +600,9 @@ func (s *S3Backend) mpuCopyPart(from string, to string, mpuId string, bytes stri
 	return
 }
 
-func sizeToParts(size int64) (int, int64) {
+// sizeToParts splits size into parts at least minPartSize large, 0
+// picks a default
+func sizeToParts(size int64, minPartSize int64) (int, int64) {
 	const MAX_S3_MPU_SIZE = 5 * 1024 * 1024 * 1024 * 1024
 	if size > MAX_S3_MPU_SIZE {
 		panic(fmt.Sprintf("object size: %v exceeds maximum S3 MPU size: %v", size, MAX_S3_MPU_SIZE))
@@ -494,8 +611,10 @@ func sizeToParts(size int64) (int, int64) {
 	// Use the maximum number of parts to allow the most server-side copy
 	// parallelism.
 	const MAX_PARTS = 10 * 1000
-	const MIN_PART_SIZE = 50 * 1024 * 1024
-	partSize := MaxInt64(size/(MAX_PARTS-1), MIN_PART_SIZE)
+	if minPartSize == 0 {
+		minPartSize = 50 * 1024 * 1024
+	}
+	partSize := MaxInt64(size/(MAX_PARTS-1), minPartSize)
 
 	nParts := int(size / partSize)
 	if size%partSize != 0 {
@@ -531,8 +650,9 @@ func (s *S3Backend) mpuCopyParts(size int64, from string, to string, mpuId strin
 }
 
 func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuId string,
-	srcEtag *string, metadata map[string]*string, storageClass *string) (err error) {
-	nParts, partSize := sizeToParts(size)
+	srcEtag *string, metadata map[string]*string, storageClass *string, tags map[string]string,
+	minPartSize int64) (err error) {
+	nParts, partSize := sizeToParts(size, minPartSize)
 	etags := make([]*string, nParts)
 
 	if mpuId == "" {
@@ -542,6 +662,7 @@ func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuI
 			StorageClass: storageClass,
 			ContentType:  s.flags.GetMimeType(to),
 			Metadata:     metadataToLower(metadata),
+			Tagging:      encodeTags(tags),
 		}
 
 		if s.config.UseSSE {
@@ -549,10 +670,10 @@ func (s *S3Backend) copyObjectMultipart(size int64, from string, to string, mpuI
 			if s.config.UseKMS && s.config.KMSKeyID != "" {
 				params.SSEKMSKeyId = &s.config.KMSKeyID
 			}
-		} else if s.config.SseC != "" {
+		} else if s.sseC != "" {
 			params.SSECustomerAlgorithm = PString("AES256")
-			params.SSECustomerKey = &s.config.SseC
-			params.SSECustomerKeyMD5 = &s.config.SseCDigest
+			params.SSECustomerKey = &s.sseC
+			params.SSECustomerKeyMD5 = &s.sseCDigest
 		}
 
 		if s.config.ACL != "" {
@@ -608,6 +729,9 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 	}
 
 	COPY_LIMIT := uint64(5 * 1024 * 1024 * 1024)
+	if param.PartSize != 0 && param.PartSize < COPY_LIMIT {
+		COPY_LIMIT = param.PartSize
+	}
 
 	if param.Size == nil || param.ETag == nil || (*param.Size > COPY_LIMIT &&
 		(param.Metadata == nil || param.StorageClass == nil)) {
@@ -637,7 +761,7 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 	from := s.bucket + "/" + param.Source
 
 	if !s.gcs && *param.Size > COPY_LIMIT {
-		err := s.copyObjectMultipart(int64(*param.Size), from, param.Destination, "", param.ETag, param.Metadata, param.StorageClass)
+		err := s.copyObjectMultipart(int64(*param.Size), from, param.Destination, "", param.ETag, param.Metadata, param.StorageClass, param.Tags, int64(param.PartSize))
 		if err != nil {
 			return nil, err
 		}
@@ -654,6 +778,11 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 		MetadataDirective: &metadataDirective,
 	}
 
+	if param.Tags != nil {
+		params.Tagging = encodeTags(param.Tags)
+		params.TaggingDirective = PString(s3.TaggingDirectiveReplace)
+	}
+
 	s3Log.Debug(params)
 
 	if s.config.UseSSE {
@@ -661,13 +790,13 @@ func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
 		if s.config.UseKMS && s.config.KMSKeyID != "" {
 			params.SSEKMSKeyId = &s.config.KMSKeyID
 		}
-	} else if s.config.SseC != "" {
+	} else if s.sseC != "" {
 		params.SSECustomerAlgorithm = PString("AES256")
-		params.SSECustomerKey = &s.config.SseC
-		params.SSECustomerKeyMD5 = &s.config.SseCDigest
+		params.SSECustomerKey = &s.sseC
+		params.SSECustomerKeyMD5 = &s.sseCDigest
 		params.CopySourceSSECustomerAlgorithm = PString("AES256")
-		params.CopySourceSSECustomerKey = &s.config.SseC
-		params.CopySourceSSECustomerKeyMD5 = &s.config.SseCDigest
+		params.CopySourceSSECustomerKey = &s.sseC
+		params.CopySourceSSECustomerKeyMD5 = &s.sseCDigest
 	}
 
 	if s.config.ACL != "" {
@@ -689,10 +818,10 @@ func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 		Key:    &param.Key,
 	}
 
-	if s.config.SseC != "" {
+	if s.sseC != "" {
 		get.SSECustomerAlgorithm = PString("AES256")
-		get.SSECustomerKey = &s.config.SseC
-		get.SSECustomerKeyMD5 = &s.config.SseCDigest
+		get.SSECustomerKey = &s.sseC
+		get.SSECustomerKeyMD5 = &s.sseCDigest
 	}
 
 	if param.Start != 0 || param.Count != 0 {
@@ -706,7 +835,7 @@ func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 	}
 	// TODO handle IfMatch
 
-	resp, err := s.GetObject(&get)
+	resp, err := s.GetObjectWithContext(contextOrTODO(param.Context), &get)
 	if err != nil {
 		return nil, mapAwsError(err)
 	}
@@ -720,8 +849,14 @@ func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 				Size:         uint64(*resp.ContentLength),
 				StorageClass: resp.StorageClass,
 			},
-			ContentType: resp.ContentType,
-			Metadata:    metadataToLower(resp.Metadata),
+			ContentType:  resp.ContentType,
+			Metadata:     metadataToLower(resp.Metadata),
+			CacheControl: resp.CacheControl,
+			Expires:      resp.Expires,
+
+			ObjectLockMode:            resp.ObjectLockMode,
+			ObjectLockRetainUntilDate: resp.ObjectLockRetainUntilDate,
+			ObjectLockLegalHoldStatus: resp.ObjectLockLegalHoldStatus,
 		},
 		Body: resp.Body,
 	}, nil
@@ -729,6 +864,9 @@ func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
 
 func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	storageClass := s.config.StorageClass
+	if param.StorageClass != nil {
+		storageClass = *param.StorageClass
+	}
 	if param.Size != nil && *param.Size < 128*1024 && storageClass == "STANDARD_IA" {
 		storageClass = "STANDARD"
 	}
@@ -736,10 +874,11 @@ func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 	put := &s3.PutObjectInput{
 		Bucket:       &s.bucket,
 		Key:          &param.Key,
-		Metadata:     metadataToLower(param.Metadata),
+		Metadata:     s.withKeyId(metadataToLower(param.Metadata)),
 		Body:         param.Body,
 		StorageClass: &storageClass,
 		ContentType:  param.ContentType,
+		Tagging:      encodeTags(param.Tags),
 	}
 
 	if s.config.UseSSE {
@@ -747,17 +886,17 @@ func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 		if s.config.UseKMS && s.config.KMSKeyID != "" {
 			put.SSEKMSKeyId = &s.config.KMSKeyID
 		}
-	} else if s.config.SseC != "" {
+	} else if s.sseC != "" {
 		put.SSECustomerAlgorithm = PString("AES256")
-		put.SSECustomerKey = &s.config.SseC
-		put.SSECustomerKeyMD5 = &s.config.SseCDigest
+		put.SSECustomerKey = &s.sseC
+		put.SSECustomerKeyMD5 = &s.sseCDigest
 	}
 
 	if s.config.ACL != "" {
 		put.ACL = &s.config.ACL
 	}
 
-	resp, err := s.PutObject(put)
+	resp, err := s.PutObjectWithContext(contextOrTODO(param.Context), put)
 	if err != nil {
 		return nil, mapAwsError(err)
 	}
@@ -769,11 +908,18 @@ func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
 }
 
 func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	storageClass := s.config.StorageClass
+	if param.StorageClass != nil {
+		storageClass = *param.StorageClass
+	}
+
 	mpu := s3.CreateMultipartUploadInput{
 		Bucket:       &s.bucket,
 		Key:          &param.Key,
-		StorageClass: &s.config.StorageClass,
+		StorageClass: &storageClass,
 		ContentType:  param.ContentType,
+		Tagging:      encodeTags(param.Tags),
+		Metadata:     s.withKeyId(nil),
 	}
 
 	if s.config.UseSSE {
@@ -781,10 +927,10 @@ func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*Multipa
 		if s.config.UseKMS && s.config.KMSKeyID != "" {
 			mpu.SSEKMSKeyId = &s.config.KMSKeyID
 		}
-	} else if s.config.SseC != "" {
+	} else if s.sseC != "" {
 		mpu.SSECustomerAlgorithm = PString("AES256")
-		mpu.SSECustomerKey = &s.config.SseC
-		mpu.SSECustomerKeyMD5 = &s.config.SseCDigest
+		mpu.SSECustomerKey = &s.sseC
+		mpu.SSECustomerKeyMD5 = &s.sseCDigest
 	}
 
 	if s.config.ACL != "" {
@@ -797,6 +943,10 @@ func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*Multipa
 		return nil, mapAwsError(err)
 	}
 
+	s.mu.Lock()
+	s.uploads[*resp.UploadId] = true
+	s.mu.Unlock()
+
 	return &MultipartBlobCommitInput{
 		Key:      &param.Key,
 		Metadata: metadataToLower(param.Metadata),
@@ -816,10 +966,10 @@ func (s *S3Backend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBl
 		UploadId:   param.Commit.UploadId,
 		Body:       param.Body,
 	}
-	if s.config.SseC != "" {
+	if s.sseC != "" {
 		params.SSECustomerAlgorithm = PString("AES256")
-		params.SSECustomerKey = &s.config.SseC
-		params.SSECustomerKeyMD5 = &s.config.SseCDigest
+		params.SSECustomerKey = &s.sseC
+		params.SSECustomerKeyMD5 = &s.sseCDigest
 	}
 	s3Log.Debug(params)
 
@@ -861,6 +1011,10 @@ func (s *S3Backend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*Multi
 		return nil, mapAwsError(err)
 	}
 
+	s.mu.Lock()
+	delete(s.uploads, *param.UploadId)
+	s.mu.Unlock()
+
 	s3Log.Debug(resp)
 
 	return &MultipartBlobCommitOutput{
@@ -878,37 +1032,66 @@ func (s *S3Backend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*Multip
 	if err != nil {
 		return nil, mapAwsError(err)
 	}
+
+	s.mu.Lock()
+	delete(s.uploads, *param.UploadId)
+	s.mu.Unlock()
+
 	return &MultipartBlobAbortOutput{}, nil
 }
 
 func (s *S3Backend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
-	mpu, err := s.ListMultipartUploads(&s3.ListMultipartUploadsInput{
+	age := param.Age
+	if age == 0 {
+		age = 48 * time.Hour
+	}
+
+	params := &s3.ListMultipartUploadsInput{
 		Bucket: &s.bucket,
-	})
-	if err != nil {
-		return nil, mapAwsError(err)
 	}
-	s3Log.Debug(mpu)
+	if param.Prefix != "" {
+		params.Prefix = &param.Prefix
+	}
 
 	now := time.Now()
-	for _, upload := range mpu.Uploads {
-		expireTime := upload.Initiated.Add(48 * time.Hour)
-
-		if !expireTime.After(now) {
-			params := &s3.AbortMultipartUploadInput{
-				Bucket:   &s.bucket,
-				Key:      upload.Key,
-				UploadId: upload.UploadId,
-			}
-			resp, err := s.AbortMultipartUpload(params)
-			s3Log.Debug(resp)
+	for {
+		mpu, err := s.ListMultipartUploads(params)
+		if err != nil {
+			return nil, mapAwsError(err)
+		}
+		s3Log.Debug(mpu)
+
+		for _, upload := range mpu.Uploads {
+			expireTime := upload.Initiated.Add(age)
+
+			s.mu.Lock()
+			live := s.uploads[*upload.UploadId]
+			s.mu.Unlock()
+
+			if !live && !expireTime.After(now) {
+				s3Log.Infof("Aborting MPU Key=%v Id=%v initiated at %v",
+					*upload.Key, *upload.UploadId, *upload.Initiated)
+				params := &s3.AbortMultipartUploadInput{
+					Bucket:   &s.bucket,
+					Key:      upload.Key,
+					UploadId: upload.UploadId,
+				}
+				resp, err := s.AbortMultipartUpload(params)
+				s3Log.Debug(resp)
 
-			if mapAwsError(err) == syscall.EACCES {
-				break
+				if isErrorClass(mapAwsError(err), "denied") {
+					return &MultipartExpireOutput{}, nil
+				}
+			} else {
+				s3Log.Debugf("Keeping MPU Key=%v Id=%v", *upload.Key, *upload.UploadId)
 			}
-		} else {
-			s3Log.Debugf("Keeping MPU Key=%v Id=%v", *upload.Key, *upload.UploadId)
 		}
+
+		if mpu.IsTruncated == nil || !*mpu.IsTruncated {
+			break
+		}
+		params.KeyMarker = mpu.NextKeyMarker
+		params.UploadIdMarker = mpu.NextUploadIdMarker
 	}
 
 	return &MultipartExpireOutput{}, nil
@@ -932,3 +1115,87 @@ func (s *S3Backend) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error
 	}
 	return &MakeBucketOutput{}, nil
 }
+
+// ensureBucket creates the bucket with the configured settings if it
+// doesn't exist yet. An existing bucket is left alone.
+func (s *S3Backend) ensureBucket() error {
+	_, err := s.HeadBucket(&s3.HeadBucketInput{Bucket: &s.bucket})
+	if mapAwsError(err) != fuse.ENOENT {
+		// either the bucket exists, or we will find out what's
+		// wrong when we try to use it
+		return nil
+	}
+
+	// --acl is for objects, canned ACLs such as
+	// bucket-owner-full-control are rejected on buckets
+	params := &s3.CreateBucketInput{
+		Bucket: &s.bucket,
+	}
+	if region := *s.awsConfig.Region; region != "us-east-1" {
+		params.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: &region,
+		}
+	}
+
+	s3Log.Infof("Creating bucket %v in %v", s.bucket, *s.awsConfig.Region)
+	_, err = s.CreateBucket(params)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok ||
+			awsErr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
+			return mapAwsError(err)
+		}
+		// someone else just created it for us, still apply
+		// the settings below
+	}
+
+	if s.config.BucketVersioning {
+		_, err = s.PutBucketVersioning(&s3.PutBucketVersioningInput{
+			Bucket: &s.bucket,
+			VersioningConfiguration: &s3.VersioningConfiguration{
+				Status: PString(s3.BucketVersioningStatusEnabled),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to enable versioning on %v: %v", s.bucket, mapAwsError(err))
+		}
+	}
+
+	if s.sseType != "" {
+		rule := &s3.ServerSideEncryptionByDefault{
+			SSEAlgorithm: PString(s.sseType),
+		}
+		if s.config.KMSKeyID != "" {
+			rule.KMSMasterKeyID = &s.config.KMSKeyID
+		}
+		_, err = s.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+			Bucket: &s.bucket,
+			ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+				Rules: []*s3.ServerSideEncryptionRule{
+					&s3.ServerSideEncryptionRule{
+						ApplyServerSideEncryptionByDefault: rule,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set default encryption on %v: %v", s.bucket, mapAwsError(err))
+		}
+	}
+
+	if s.config.BlockPublicAccess {
+		_, err = s.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+			Bucket: &s.bucket,
+			PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+				BlockPublicAcls:       aws.Bool(true),
+				BlockPublicPolicy:     aws.Bool(true),
+				IgnorePublicAcls:      aws.Bool(true),
+				RestrictPublicBuckets: aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to block public access on %v: %v", s.bucket, mapAwsError(err))
+		}
+	}
+
+	return nil
+}
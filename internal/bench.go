@@ -0,0 +1,447 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// goofys bench runs the same workloads against a mount, through the
+// kernel, or against the backend layer directly, so the two can be
+// told apart when something is slow. Results are JSON so runs with
+// different options or versions can be compared.
+
+var benchWorkloads = []string{"seq-write", "seq-read", "create", "walk", "mixed", "delete"}
+
+var benchCommand = cli.Command{
+	Name:  "bench",
+	Usage: "Measure the performance of a mount, or of the bucket without going through a mount",
+	ArgsUsage: "mountpoint|bucket[:prefix]\n\n" +
+		"   An existing directory is taken as a mountpoint. The workloads work\n" +
+		"   in a temporary directory under it, which is removed afterwards",
+	Action: commandAction(benchAction),
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "workload",
+			Usage: "Workload to run, can be repeated (default: all of them)",
+		},
+		cli.IntFlag{
+			Name:  "size",
+			Value: 256,
+			Usage: "Size of the file for seq-write and seq-read in MB",
+		},
+		cli.IntFlag{
+			Name:  "files",
+			Value: 1000,
+			Usage: "Number of small files for create, walk, mixed and delete",
+		},
+		cli.IntFlag{
+			Name:  "file-size",
+			Value: 4,
+			Usage: "Size of the small files in KB",
+		},
+		cli.IntFlag{
+			Name:  "parallel",
+			Value: 16,
+			Usage: "Number of concurrent operations, except for the sequential workloads",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "File to write the results to (default: stdout)",
+		},
+	},
+}
+
+type benchResult struct {
+	Workload  string  `json:"workload"`
+	Ops       int     `json:"ops"`
+	Errors    int     `json:"errors"`
+	Bytes     int64   `json:"bytes"`
+	Seconds   float64 `json:"seconds"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	MBPerSec  float64 `json:"mb_per_sec"`
+	P50Ms     float64 `json:"p50_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+	MaxMs     float64 `json:"max_ms"`
+}
+
+type benchReport struct {
+	Version  string        `json:"version"`
+	Target   string        `json:"target"`
+	Mode     string        `json:"mode"`
+	Time     string        `json:"time"`
+	Parallel int           `json:"parallel"`
+	Size     int64         `json:"size"`
+	Files    int           `json:"files"`
+	FileSize int64         `json:"file_size"`
+	Results  []benchResult `json:"results"`
+}
+
+// benchData is an endless source of incompressible bytes
+type benchData []byte
+
+func (d benchData) ReadAt(p []byte, off int64) (int, error) {
+	for n := 0; n < len(p); {
+		n += copy(p[n:], d[(off+int64(n))%int64(len(d)):])
+	}
+	return len(p), nil
+}
+
+type benchTarget interface {
+	write(name string, data io.ReaderAt, size int64) error
+	read(name string) (int64, error)
+	stat(name string) error
+	// walk returns the number of files found
+	walk() (int, error)
+	remove(name string) error
+	cleanup() error
+}
+
+// mountTarget goes through the kernel like any other program would
+type mountTarget struct {
+	dir string
+}
+
+func (t *mountTarget) write(name string, data io.ReaderAt, size int64) error {
+	f, err := os.Create(filepath.Join(t.dir, name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(data, 0, size))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// this is when goofys uploads
+	return f.Close()
+}
+
+func (t *mountTarget) read(name string) (int64, error) {
+	f, err := os.Open(filepath.Join(t.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(ioutil.Discard, f)
+}
+
+func (t *mountTarget) stat(name string) error {
+	_, err := os.Stat(filepath.Join(t.dir, name))
+	return err
+}
+
+func (t *mountTarget) walk() (n int, err error) {
+	err = filepath.Walk(t.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return err
+	})
+	return
+}
+
+func (t *mountTarget) remove(name string) error {
+	return os.Remove(filepath.Join(t.dir, name))
+}
+
+func (t *mountTarget) cleanup() error {
+	return os.RemoveAll(t.dir)
+}
+
+// backendTarget uses the same backend code as a mount, without the
+// kernel and the inode cache
+type backendTarget struct {
+	cloud  StorageBackend
+	prefix string
+}
+
+func (t *backendTarget) write(name string, data io.ReaderAt, size int64) error {
+	return uploadBlob(t.cloud, t.prefix+name, data, uint64(size), nil)
+}
+
+func (t *backendTarget) read(name string) (int64, error) {
+	resp, err := t.cloud.GetBlob(&GetBlobInput{Key: t.prefix + name})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(ioutil.Discard, resp.Body)
+}
+
+func (t *backendTarget) stat(name string) error {
+	_, err := t.cloud.HeadBlob(&HeadBlobInput{Key: t.prefix + name})
+	return err
+}
+
+func (t *backendTarget) walk() (int, error) {
+	files, err := listRemote(t.cloud, t.prefix)
+	return len(files), err
+}
+
+func (t *backendTarget) remove(name string) error {
+	_, err := t.cloud.DeleteBlob(&DeleteBlobInput{Key: t.prefix + name})
+	return err
+}
+
+func (t *backendTarget) cleanup() error {
+	files, err := listRemote(t.cloud, t.prefix)
+	if err != nil {
+		return err
+	}
+	for name, _ := range files {
+		err = t.remove(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type bench struct {
+	target   benchTarget
+	data     benchData
+	parallel int
+	size     int64
+	files    int
+	fileSize int64
+
+	// what the previous workloads left behind
+	large bool
+	small bool
+}
+
+func smallFileName(i int) string {
+	return fmt.Sprintf("small-%06d", i)
+}
+
+// run does op n times, parallel at a time
+func (b *bench) run(workload string, n int, parallel int, op func(i int) (int64, error)) benchResult {
+	log.Infof("running %v", workload)
+
+	latencies := make([]time.Duration, n)
+	var bytes int64
+	var errors int32
+	var wg sync.WaitGroup
+	ch := make(chan int)
+
+	start := time.Now()
+	for w := 0; w < MinInt(parallel, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				opStart := time.Now()
+				nbytes, err := op(i)
+				latencies[i] = time.Since(opStart)
+				if err != nil {
+					log.Errorf("%v: %v", workload, err)
+					atomic.AddInt32(&errors, 1)
+				} else {
+					atomic.AddInt64(&bytes, nbytes)
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	res := benchResult{
+		Workload:  workload,
+		Ops:       n,
+		Errors:    int(errors),
+		Bytes:     bytes,
+		Seconds:   elapsed.Seconds(),
+		OpsPerSec: float64(n) / elapsed.Seconds(),
+		MBPerSec:  float64(bytes) / 1024 / 1024 / elapsed.Seconds(),
+	}
+	if n != 0 {
+		res.P50Ms = ms(latencies[n/2])
+		res.P99Ms = ms(latencies[n*99/100])
+		res.MaxMs = ms(latencies[n-1])
+	}
+	return res
+}
+
+func (b *bench) seqWrite() benchResult {
+	b.large = true
+	return b.run("seq-write", 1, 1, func(i int) (int64, error) {
+		return b.size, b.target.write("large", b.data, b.size)
+	})
+}
+
+func (b *bench) seqRead() benchResult {
+	if !b.large {
+		b.seqWrite()
+	}
+	return b.run("seq-read", 1, 1, func(i int) (int64, error) {
+		return b.target.read("large")
+	})
+}
+
+func (b *bench) create() benchResult {
+	b.small = true
+	return b.run("create", b.files, b.parallel, func(i int) (int64, error) {
+		return b.fileSize, b.target.write(smallFileName(i), b.data, b.fileSize)
+	})
+}
+
+func (b *bench) walk() benchResult {
+	if !b.small {
+		b.create()
+	}
+	return b.run("walk", 1, 1, func(i int) (int64, error) {
+		n, err := b.target.walk()
+		if err == nil && n < b.files {
+			err = fmt.Errorf("found %v files instead of at least %v", n, b.files)
+		}
+		return 0, err
+	})
+}
+
+// mixed reads 60% of the time, stats 20% of the time and overwrites
+// the rest, picking the files at random
+func (b *bench) mixed() benchResult {
+	if !b.small {
+		b.create()
+	}
+	return b.run("mixed", b.files, b.parallel, func(i int) (int64, error) {
+		name := smallFileName(rand.Intn(b.files))
+		switch op := i % 10; {
+		case op < 6:
+			return b.target.read(name)
+		case op < 8:
+			return 0, b.target.stat(name)
+		default:
+			return b.fileSize, b.target.write(name, b.data, b.fileSize)
+		}
+	})
+}
+
+func (b *bench) delete() benchResult {
+	if !b.small {
+		b.create()
+	}
+	b.small = false
+	return b.run("delete", b.files, b.parallel, func(i int) (int64, error) {
+		return 0, b.target.remove(smallFileName(i))
+	})
+}
+
+func benchAction(c *cli.Context) error {
+	arg, err := commandArg(c, "mountpoint|bucket[:prefix]")
+	if err != nil {
+		return err
+	}
+
+	workloads := c.StringSlice("workload")
+	if len(workloads) == 0 {
+		workloads = benchWorkloads
+	}
+
+	b := &bench{
+		data:     make(benchData, 1024*1024),
+		parallel: c.Int("parallel"),
+		size:     int64(c.Int("size")) * 1024 * 1024,
+		files:    c.Int("files"),
+		fileSize: int64(c.Int("file-size")) * 1024,
+	}
+	rand.Read(b.data)
+
+	run := map[string]func() benchResult{
+		"seq-write": b.seqWrite,
+		"seq-read":  b.seqRead,
+		"create":    b.create,
+		"walk":      b.walk,
+		"mixed":     b.mixed,
+		"delete":    b.delete,
+	}
+	for _, w := range workloads {
+		if run[w] == nil {
+			return fmt.Errorf("Unknown workload %v, must be one of %v", w, benchWorkloads)
+		}
+	}
+
+	report := benchReport{
+		Version:  rootContext(c).App.Version,
+		Target:   arg,
+		Time:     time.Now().Format(time.RFC3339),
+		Parallel: b.parallel,
+		Size:     b.size,
+		Files:    b.files,
+		FileSize: b.fileSize,
+	}
+
+	name := ".goofys-bench-" + RandStringBytesMaskImprSrc(8)
+	if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+		report.Mode = "mount"
+		dir := filepath.Join(arg, name)
+		err = os.Mkdir(dir, 0755)
+		if err != nil {
+			return err
+		}
+		b.target = &mountTarget{dir}
+	} else {
+		report.Mode = "backend"
+		cloud, prefix, _, err := commandBackend(c, arg)
+		if err != nil {
+			return err
+		}
+		b.target = &backendTarget{cloud, prefix + name + "/"}
+	}
+
+	for _, w := range workloads {
+		report.Results = append(report.Results, run[w]())
+	}
+
+	err = b.target.cleanup()
+	if err != nil {
+		log.Errorf("Unable to clean up %v: %v", name, err)
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+
+	if c.IsSet("output") {
+		return ioutil.WriteFile(c.String("output"), out, 0644)
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -148,6 +148,30 @@ func (pool *BufferPool) RequestMultiple(size uint64, block bool) (buffers [][]by
 	return
 }
 
+// reserve accounts for n buffers of memory that is used outside of
+// the pool, like the footer cache, if there's room for them
+func (pool *BufferPool) reserve(n uint64) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.computedMaxbuffers == 0 {
+		pool.recomputeBufferLimit()
+	}
+	if pool.numBuffers+n > pool.computedMaxbuffers {
+		return false
+	}
+	pool.numBuffers += n
+	return true
+}
+
+func (pool *BufferPool) unreserve(n uint64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.numBuffers -= n
+	pool.cond.Broadcast()
+}
+
 func (pool *BufferPool) MaybeGC() {
 	if pool.numBuffers == 0 {
 		debug.FreeOSMemory()
@@ -331,6 +355,10 @@ func (mb *MBuf) Free() {
 	mb.buffers = nil
 }
 
+func (mb *MBuf) Freed() bool {
+	return mb.buffers == nil
+}
+
 var bufferLog = GetLogger("buffer")
 
 type Buffer struct {
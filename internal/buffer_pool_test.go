@@ -17,9 +17,12 @@ package internal
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/jacobsa/fuse/fuseops"
 	"github.com/sirupsen/logrus"
 	. "gopkg.in/check.v1"
 )
@@ -274,3 +277,73 @@ func (s *BufferTest) TestCGroupMemory(t *C) {
 	mem_path, _ := getMemoryCgroupPath(test_input)
 	t.Assert(mem_path, Equals, "/user.slice")
 }
+
+func (s *BufferTest) TestSpillBuffer(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-spill")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	p := newSpillPool(dir, 10)
+	b := p.request(8)
+	t.Assert(b, NotNil)
+	// over the budget
+	t.Assert(p.request(8), IsNil)
+
+	n, err := b.Write([]byte("0123456789"))
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 8)
+	t.Assert(b.Full(), Equals, true)
+	t.Assert(b.Len(), Equals, 8)
+
+	// nothing is left in dir even while the buffer is in use
+	files, err := ioutil.ReadDir(dir)
+	t.Assert(err, IsNil)
+	t.Assert(files, HasLen, 0)
+
+	content, err := ioutil.ReadAll(b)
+	t.Assert(err, IsNil)
+	t.Assert(string(content), Equals, "01234567")
+
+	// retries rewind the body
+	off, err := b.Seek(0, io.SeekStart)
+	t.Assert(err, IsNil)
+	t.Assert(off, Equals, int64(0))
+	content, err = ioutil.ReadAll(b)
+	t.Assert(err, IsNil)
+	t.Assert(string(content), Equals, "01234567")
+
+	b.Free()
+	t.Assert(b.Freed(), Equals, true)
+	t.Assert(p.request(8), NotNil)
+}
+
+func (s *BufferTest) TestFooterCachePool(t *C) {
+	pool := BufferPool{maxBuffers: 2}.Init()
+	c := newFooterCache(100*1024*1024, pool)
+
+	footer := func(id fuseops.InodeID) *footer {
+		return &footer{id: id, data: make([]byte, 2*1024*1024)}
+	}
+
+	c.add(footer(1))
+	c.add(footer(2))
+	t.Assert(pool.numBuffers, Equals, uint64(1))
+
+	// the rest of the pool is in use, so the footers make room
+	// for each other instead of growing
+	buf := pool.RequestBuffer()
+	c.add(footer(3))
+	t.Assert(pool.numBuffers, Equals, uint64(2))
+	t.Assert(c.lru.Len(), Equals, 2)
+	t.Assert(c.get(1, "", 0), IsNil)
+
+	pool.Free(buf)
+	c.add(footer(4))
+	t.Assert(pool.numBuffers, Equals, uint64(2))
+	t.Assert(c.lru.Len(), Equals, 3)
+
+	for id := fuseops.InodeID(2); id <= 4; id++ {
+		c.remove(c.entries[id])
+	}
+	t.Assert(pool.numBuffers, Equals, uint64(0))
+}
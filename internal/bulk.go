@@ -0,0 +1,394 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3control"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/urfave/cli"
+)
+
+// goofys bulk hands off changes that are too big to do through the
+// mount to S3 Batch Operations. We list the keys like a mount would,
+// write them as a manifest into the bucket, and create a job that
+// works on it.
+
+const BULK_MANIFEST_PREFIX = ".goofys-bulk/"
+
+var bulkCommonFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "job-role",
+		Usage: "ARN of the IAM role S3 Batch Operations assumes to run the job",
+	},
+	cli.StringFlag{
+		Name:  "account-id",
+		Usage: "AWS account to run the job in (default: the account of the credentials)",
+	},
+	cli.IntFlag{
+		Name:  "priority",
+		Value: 10,
+		Usage: "Priority of the job",
+	},
+	cli.BoolFlag{
+		Name:  "wait",
+		Usage: "Wait for the job to finish",
+	},
+	cli.StringFlag{
+		Name: "mountpoint",
+		Usage: "Once the job finishes, forget what the goofys mounted here " +
+			"has cached about the affected keys. Implies --wait",
+	},
+	cli.StringFlag{
+		Name:  "mount-path",
+		Usage: "Path of the affected keys relative to --mountpoint (default: the prefix)",
+	},
+}
+
+var bulkCommand = cli.Command{
+	Name:  "bulk",
+	Usage: "Change many objects at once with S3 Batch Operations",
+	Subcommands: []cli.Command{
+		{
+			Name:      "copy",
+			Usage:     "Copy every object under the prefix to another bucket or prefix",
+			ArgsUsage: "bucket[:prefix]",
+			Action:    commandAction(bulkCopy),
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "bucket[:prefix] to copy to. Batch Operations can only prepend to the keys, so the source prefix is kept",
+				},
+				cli.StringFlag{
+					Name:  "storage-class",
+					Usage: "Storage class of the copies (default: STANDARD)",
+				},
+			}, bulkCommonFlags...),
+		},
+		{
+			Name:      "tag",
+			Usage:     "Replace the tags of every object under the prefix",
+			ArgsUsage: "bucket[:prefix]",
+			Action:    commandAction(bulkTag),
+			Flags: append([]cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "tag",
+					Usage: "KEY=VALUE, can be repeated",
+				},
+			}, bulkCommonFlags...),
+		},
+	},
+}
+
+// manifestKey URL encodes key the way Batch Operations expects in a
+// CSV manifest
+func manifestKey(key string) string {
+	return strings.Replace(url.QueryEscape(key), "+", "%20", -1)
+}
+
+// writeManifest lists every object under prefix and writes them as a
+// Batch Operations CSV manifest to key
+func writeManifest(s *S3Backend, prefix string, key string) (etag string, count int, err error) {
+	var buf bytes.Buffer
+	var token *string
+
+	for {
+		resp, err := s.ListBlobs(&ListBlobsInput{
+			Prefix:            &prefix,
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return "", 0, err
+		}
+
+		for _, item := range resp.Items {
+			if strings.HasPrefix(*item.Key, BULK_MANIFEST_PREFIX) {
+				continue
+			}
+			fmt.Fprintf(&buf, "%v,%v\n", s.bucket, manifestKey(*item.Key))
+			count++
+		}
+
+		if !resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+
+	if count == 0 {
+		return
+	}
+
+	size := uint64(buf.Len())
+	resp, err := s.PutBlob(&PutBlobInput{
+		Key:  key,
+		Body: bytes.NewReader(buf.Bytes()),
+		Size: &size,
+	})
+	if err != nil {
+		return
+	}
+	etag = strings.Trim(*resp.ETag, "\"")
+	return
+}
+
+type bulkJob struct {
+	s          *S3Backend
+	prefix     string
+	control    *s3control.S3Control
+	accountId  string
+	jobId      string
+	mountPoint string
+	mountPath  string
+}
+
+func newBulkJob(c *cli.Context, bucket string) (*bulkJob, error) {
+	if c.String("job-role") == "" {
+		return nil, fmt.Errorf("--job-role is required")
+	}
+
+	cloud, prefix, _, err := commandBackend(c, bucket)
+	if err != nil {
+		return nil, err
+	}
+	s := s3Backend(cloud)
+	if s == nil || !s.aws {
+		return nil, fmt.Errorf("bulk is only supported on AWS S3")
+	}
+	if shardedBackend(cloud) != nil {
+		return nil, fmt.Errorf("bulk doesn't support --shard-prefixes")
+	}
+
+	// --endpoint is for S3 only
+	awsConfig := s.awsConfig.Copy().WithEndpoint("")
+
+	accountId := c.String("account-id")
+	if accountId == "" {
+		id, err := sts.New(s.config.Session, awsConfig).GetCallerIdentity(
+			&sts.GetCallerIdentityInput{})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find the account id, use --account-id: %v", err)
+		}
+		accountId = *id.Account
+	}
+
+	job := &bulkJob{
+		s:          s,
+		prefix:     prefix,
+		control:    s3control.New(s.config.Session, awsConfig),
+		accountId:  accountId,
+		mountPoint: c.String("mountpoint"),
+		mountPath:  c.String("mount-path"),
+	}
+	if job.mountPath == "" {
+		job.mountPath = prefix
+	}
+	return job, nil
+}
+
+func (job *bulkJob) create(c *cli.Context, description string, op *s3control.JobOperation) error {
+	now := time.Now()
+	key := fmt.Sprintf("%v%v.csv", BULK_MANIFEST_PREFIX, now.UTC().Format("20060102T150405Z"))
+
+	etag, count, err := writeManifest(job.s, job.prefix, key)
+	if err != nil {
+		return fmt.Errorf("Unable to write manifest: %v", err)
+	}
+	if count == 0 {
+		log.Infof("No object under %v, nothing to do", job.prefix)
+		return nil
+	}
+	log.Infof("Wrote %v keys to manifest s3://%v/%v", count, job.s.bucket, key)
+
+	resp, err := job.control.CreateJob(&s3control.CreateJobInput{
+		AccountId:            &job.accountId,
+		ClientRequestToken:   aws.String(fmt.Sprintf("goofys-%v", now.UnixNano())),
+		ConfirmationRequired: aws.Bool(false),
+		Description:          &description,
+		Priority:             aws.Int64(int64(c.Int("priority"))),
+		RoleArn:              aws.String(c.String("job-role")),
+		Operation:            op,
+		Manifest: &s3control.JobManifest{
+			Spec: &s3control.JobManifestSpec{
+				Format: aws.String(s3control.JobManifestFormatS3batchOperationsCsv20180820),
+				Fields: []*string{
+					aws.String(s3control.JobManifestFieldNameBucket),
+					aws.String(s3control.JobManifestFieldNameKey),
+				},
+			},
+			Location: &s3control.JobManifestLocation{
+				ObjectArn: aws.String(fmt.Sprintf("arn:aws:s3:::%v/%v", job.s.bucket, key)),
+				ETag:      &etag,
+			},
+		},
+		Report: &s3control.JobReport{
+			Enabled: aws.Bool(false),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to create job: %v", err)
+	}
+	job.jobId = *resp.JobId
+	log.Infof("Created job %v", job.jobId)
+
+	if c.Bool("wait") || job.mountPoint != "" {
+		return job.wait()
+	}
+	return nil
+}
+
+func (job *bulkJob) wait() error {
+	for {
+		resp, err := job.control.DescribeJob(&s3control.DescribeJobInput{
+			AccountId: &job.accountId,
+			JobId:     &job.jobId,
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to describe job %v: %v", job.jobId, err)
+		}
+
+		status := *resp.Job.Status
+		if p := resp.Job.ProgressSummary; p != nil {
+			log.Infof("Job %v %v: %v/%v succeeded, %v failed", job.jobId, status,
+				aws.Int64Value(p.NumberOfTasksSucceeded),
+				aws.Int64Value(p.TotalNumberOfTasks),
+				aws.Int64Value(p.NumberOfTasksFailed))
+		}
+
+		switch status {
+		case s3control.JobStatusComplete:
+			return nil
+		case s3control.JobStatusFailed, s3control.JobStatusCancelled:
+			var reasons []string
+			for _, r := range resp.Job.FailureReasons {
+				reasons = append(reasons, aws.StringValue(r.FailureReason))
+			}
+			return fmt.Errorf("Job %v %v: %v", job.jobId, status, strings.Join(reasons, ", "))
+		}
+
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// invalidate tells the mount to forget the keys the job has changed
+func (job *bulkJob) invalidate(path string) error {
+	if job.mountPoint == "" {
+		return nil
+	}
+
+	err := setMountKnob(job.mountPoint, "invalidate", path)
+	if err != nil {
+		return fmt.Errorf("Unable to invalidate %v under %v: %v", path, job.mountPoint, err)
+	}
+	log.Infof("Invalidated %v under %v", path, job.mountPoint)
+	return nil
+}
+
+func bulkCopy(c *cli.Context) error {
+	bucket, err := commandArg(c, "bucket[:prefix]")
+	if err != nil {
+		return err
+	}
+
+	to := c.String("to")
+	if to == "" {
+		return fmt.Errorf("--to is required")
+	}
+	toBucket, toPrefix := to, ""
+	if colon := strings.Index(to, ":"); colon != -1 {
+		toBucket = to[:colon]
+		toPrefix = strings.Trim(to[colon+1:], "/")
+		if toPrefix != "" {
+			toPrefix += "/"
+		}
+	}
+
+	job, err := newBulkJob(c, bucket)
+	if err != nil {
+		return err
+	}
+	op := &s3control.S3CopyObjectOperation{
+		TargetResource:    aws.String("arn:aws:s3:::" + toBucket),
+		MetadataDirective: aws.String(s3control.S3MetadataDirectiveCopy),
+	}
+	if toPrefix != "" {
+		op.TargetKeyPrefix = &toPrefix
+	}
+	if class := c.String("storage-class"); class != "" {
+		op.StorageClass = aws.String(strings.ToUpper(class))
+	}
+	if job.s.config.ACL != "" {
+		op.CannedAccessControlList = &job.s.config.ACL
+	}
+
+	err = job.create(c, fmt.Sprintf("goofys bulk copy %v %v", bucket, to),
+		&s3control.JobOperation{S3PutObjectCopy: op})
+	if err != nil || job.jobId == "" {
+		return err
+	}
+
+	if toBucket == job.s.bucket {
+		path := c.String("mount-path")
+		if path == "" {
+			path = toPrefix + job.prefix
+		}
+		return job.invalidate(path)
+	}
+	return nil
+}
+
+func bulkTag(c *cli.Context) error {
+	bucket, err := commandArg(c, "bucket[:prefix]")
+	if err != nil {
+		return err
+	}
+
+	var tags []*s3control.S3Tag
+	for _, t := range c.StringSlice("tag") {
+		eq := strings.Index(t, "=")
+		if eq == -1 {
+			return fmt.Errorf("invalid tag %v, expected KEY=VALUE", t)
+		}
+		tags = append(tags, &s3control.S3Tag{
+			Key:   aws.String(t[:eq]),
+			Value: aws.String(t[eq+1:]),
+		})
+	}
+	if len(tags) == 0 {
+		return fmt.Errorf("--tag is required")
+	}
+
+	job, err := newBulkJob(c, bucket)
+	if err != nil {
+		return err
+	}
+
+	err = job.create(c, fmt.Sprintf("goofys bulk tag %v", bucket),
+		&s3control.JobOperation{
+			S3PutObjectTagging: &s3control.S3SetObjectTaggingOperation{
+				TagSet: tags,
+			},
+		})
+	if err != nil || job.jobId == "" {
+		return err
+	}
+	return job.invalidate(job.mountPath)
+}
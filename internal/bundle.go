@@ -0,0 +1,389 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// goofys debug bundle collects what we usually ask for in a bug
+// report from a running mount. Everything goes through a redactor
+// first: credentials are always removed and file names are replaced
+// with a hash unless --keep-names is given.
+
+var debugCommand = cli.Command{
+	Name:  "debug",
+	Usage: "Troubleshoot a running mount",
+	Subcommands: []cli.Command{
+		{
+			Name: "bundle",
+			Usage: "Collect the configuration, logs and state of a mount into an archive " +
+				"to attach to a bug report. Mount with --stats-dir to include the state",
+			ArgsUsage: "mountpoint",
+			Action:    commandAction(debugBundle),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "Archive to write (default: goofys-bundle-TIME.tar.gz)",
+				},
+				cli.DurationFlag{
+					Name:  "since",
+					Value: time.Hour,
+					Usage: "How far back to collect the log",
+				},
+				cli.BoolFlag{
+					Name:  "keep-names",
+					Usage: "Don't replace file and directory names with a hash",
+				},
+			},
+		},
+	},
+}
+
+var credentialPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// access key ids
+	{regexp.MustCompile(`\b(AKIA|ASIA)[A-Z0-9]{16}\b`), "${1}REDACTED"},
+	{regexp.MustCompile(`(?i)(aws_secret_access_key|aws_session_token|x-amz-security-token|` +
+		`x-amz-server-side-encryption-customer-key|signature|credential|password|secret|token)` +
+		`(["']?\s*[=:]\s*["']?)[^\s&"',]+`), "${1}${2}REDACTED"},
+	{regexp.MustCompile(`(?i)(authorization:\s*).*`), "${1}REDACTED"},
+	{regexp.MustCompile(`(--(?:sse-c|sse-kms)[= ])\S+`), "${1}REDACTED"},
+	// user:password@ in proxy and endpoint urls
+	{regexp.MustCompile(`(\w+://)[^/\s:@]+:[^/\s@]+@`), "${1}REDACTED@"},
+}
+
+// characters that can't be part of a name token in the log, so we
+// only replace whole names
+var nameToken = regexp.MustCompile(`[^/\s"'=:,()\[\]{}]+`)
+
+type redactor struct {
+	keepNames bool
+	// names that can be matched as a whole token
+	names map[string]string
+	// names with characters that split tokens
+	others []string
+}
+
+func newRedactor(keepNames bool) *redactor {
+	return &redactor{
+		keepNames: keepNames,
+		names:     make(map[string]string),
+	}
+}
+
+func redactedName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "name-" + hex.EncodeToString(sum[:4])
+}
+
+// addPath registers the components of path as names to redact. Our
+// own files and numbers, which would clobber too much of the log,
+// are left alone
+func (r *redactor) addPath(path string) {
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" || name == STATS_DIR || statsFiles[name] != nil {
+			continue
+		}
+		if _, err := strconv.ParseUint(name, 10, 64); err == nil {
+			continue
+		}
+		if _, ok := r.names[name]; ok {
+			continue
+		}
+
+		r.names[name] = redactedName(name)
+		if nameToken.FindString(name) != name {
+			r.others = append(r.others, name)
+		}
+	}
+}
+
+func (r *redactor) redact(text string) string {
+	for _, p := range credentialPatterns {
+		text = p.re.ReplaceAllString(text, p.repl)
+	}
+
+	if r.keepNames || len(r.names) == 0 {
+		return text
+	}
+
+	if len(r.others) != 0 {
+		// longest first, so a name doesn't break up a longer one
+		sort.Slice(r.others, func(i, j int) bool {
+			return len(r.others[i]) > len(r.others[j])
+		})
+		var pairs []string
+		for _, name := range r.others {
+			pairs = append(pairs, name, r.names[name])
+		}
+		text = strings.NewReplacer(pairs...).Replace(text)
+	}
+
+	return nameToken.ReplaceAllStringFunc(text, func(token string) string {
+		if repl, ok := r.names[token]; ok {
+			return repl
+		}
+		return token
+	})
+}
+
+// inodesPath returns the path of a line of STATS_DIR/inodes. The
+// path may have spaces, the 5 fields after it don't
+func inodesPath(line string) string {
+	fields := strings.Split(line, " ")
+	if len(fields) < 6 {
+		return ""
+	}
+	return strings.Join(fields[:len(fields)-5], " ")
+}
+
+// summarizeInodes counts the cached inodes by type and state
+func summarizeInodes(inodes string) []byte {
+	counts := make(map[string]uint64)
+	var keys []string
+	count := func(key string, n uint64) {
+		if _, ok := counts[key]; !ok {
+			keys = append(keys, key)
+		}
+		counts[key] += n
+	}
+
+	for _, line := range strings.Split(inodes, "\n") {
+		path := inodesPath(line)
+		if path == "" {
+			continue
+		}
+		fields := strings.Split(line[len(path)+1:], " ")
+		typ, state := fields[0], fields[3]
+		size, _ := strconv.ParseUint(fields[1], 10, 64)
+		handles, _ := strconv.ParseUint(fields[4], 10, 64)
+
+		count(typ+"s", 1)
+		if typ == "file" {
+			count("bytes", size)
+		}
+		count(state, 1)
+		count("handles", handles)
+	}
+
+	var buf bytes.Buffer
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%v %v\n", k, counts[k])
+	}
+	return buf.Bytes()
+}
+
+// mountEntry returns the line of mount(8) for mountPoint
+func mountEntry(mountPoint string) (string, error) {
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, " on "+mountPoint+" ") {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("%v is not mounted", mountPoint)
+}
+
+// mountCommandLine returns how the goofys that serves mountPoint was
+// started
+func mountCommandLine(mountPoint string) (string, error) {
+	out, err := exec.Command("ps", "axww", "-o", "pid=,args=").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		args := strings.Fields(line)
+		if len(args) < 3 || !strings.Contains(filepath.Base(args[1]), "goofys") {
+			continue
+		}
+		if args[len(args)-1] == mountPoint {
+			return strings.TrimSpace(line), nil
+		}
+	}
+	return "", fmt.Errorf("no goofys process found for %v", mountPoint)
+}
+
+func mountKnobs(mountPoint string) ([]byte, error) {
+	var buf bytes.Buffer
+	for name := range knobs {
+		value, err := getMountKnob(mountPoint, name)
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			fmt.Fprintf(&buf, "%v %v\n", name, value)
+		}
+	}
+	lines := strings.SplitAfter(buf.String(), "\n")
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, "")), nil
+}
+
+type bundleFile struct {
+	name    string
+	content []byte
+}
+
+func writeBundle(output string, files []bundleFile) error {
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	dir := strings.TrimSuffix(filepath.Base(output), ".tar.gz")
+	now := time.Now()
+
+	for _, file := range files {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    dir + "/" + file.name,
+			Mode:    0600,
+			Size:    int64(len(file.content)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(file.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func debugBundle(c *cli.Context) error {
+	mountPoint, err := commandArg(c, "mountpoint")
+	if err != nil {
+		return err
+	}
+	mountPoint, err = filepath.Abs(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	output := c.String("output")
+	if output == "" {
+		output = fmt.Sprintf("goofys-bundle-%v.tar.gz", time.Now().Format("20060102-150405"))
+	}
+
+	r := newRedactor(c.Bool("keep-names"))
+	var files []bundleFile
+	var problems []string
+	add := func(name string, content []byte, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", name, err))
+		} else {
+			files = append(files, bundleFile{name, content})
+		}
+	}
+
+	// read the state first, it has the names to redact
+	statsDir := filepath.Join(mountPoint, STATS_DIR)
+	stats, err := ioutil.ReadFile(filepath.Join(statsDir, "stats"))
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("mount with --stats-dir to include the state")
+	}
+	add("stats.txt", stats, err)
+	goroutines, err := ioutil.ReadFile(filepath.Join(statsDir, "goroutines"))
+	add("goroutines.txt", goroutines, err)
+
+	inodes, err := ioutil.ReadFile(filepath.Join(statsDir, "inodes"))
+	if err == nil {
+		for _, line := range strings.Split(string(inodes), "\n") {
+			r.addPath(inodesPath(line))
+		}
+		add("cache.txt", summarizeInodes(string(inodes)), nil)
+		add("inodes.txt", []byte(r.redact(string(inodes))), nil)
+	} else {
+		add("inodes.txt", nil, err)
+	}
+
+	mount, err := mountEntry(mountPoint)
+	if err == nil {
+		// the bucket is useful, the prefix is a name like any other
+		source := strings.Fields(mount)[0]
+		if colon := strings.Index(source, ":"); colon != -1 {
+			r.addPath(source[colon+1:])
+		}
+	}
+	add("mount.txt", []byte(r.redact(mount+"\n")), err)
+
+	cmdline, err := mountCommandLine(mountPoint)
+	add("cmdline.txt", []byte(r.redact(cmdline+"\n")), err)
+
+	// the bucket knob has the prefix
+	values, err := mountKnobs(mountPoint)
+	add("knobs.txt", []byte(r.redact(string(values))), err)
+
+	logs, err := recentLogs(c.Duration("since"))
+	add("log.txt", []byte(r.redact(string(logs))), err)
+
+	var summary bytes.Buffer
+	fmt.Fprintf(&summary, "version %v\n", rootContext(c).App.Version)
+	fmt.Fprintf(&summary, "os %v/%v\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&summary, "time %v\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&summary, "names redacted %v\n", !r.keepNames)
+	for _, p := range problems {
+		fmt.Fprintf(&summary, "missing %v\n", p)
+	}
+	files = append([]bundleFile{{"bundle.txt", summary.Bytes()}}, files...)
+
+	err = writeBundle(output, files)
+	if err != nil {
+		return fmt.Errorf("Unable to write %v: %v", output, err)
+	}
+
+	for _, p := range problems {
+		log.Warnf("missing %v", p)
+	}
+	fmt.Println(output)
+	return nil
+}
@@ -0,0 +1,28 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// recentLogs returns what goofys logged to syslog in the last since
+func recentLogs(since time.Duration) ([]byte, error) {
+	return exec.Command("log", "show", "--style", "syslog",
+		"--last", fmt.Sprintf("%vs", int64(since.Seconds())),
+		"--predicate", `process == "goofys"`).Output()
+}
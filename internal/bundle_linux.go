@@ -0,0 +1,61 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// recentLogs returns what goofys logged to syslog in the last since
+func recentLogs(since time.Duration) ([]byte, error) {
+	out, err := exec.Command("journalctl", "--no-pager", "-q", "-o", "short-iso",
+		fmt.Sprintf("--since=-%vs", int64(since.Seconds())),
+		"SYSLOG_IDENTIFIER=goofys").Output()
+	if err == nil {
+		return out, nil
+	}
+
+	// no journald, there's no telling the time of the lines
+	// without knowing the format, so take the last ones instead
+	const maxLines = 10000
+	for _, path := range []string{"/var/log/syslog", "/var/log/messages"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		var lines []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if strings.Contains(scanner.Text(), "goofys") {
+				lines = append(lines, scanner.Text()+"\n")
+				if len(lines) > 2*maxLines {
+					lines = lines[maxLines:]
+				}
+			}
+		}
+		if len(lines) > maxLines {
+			lines = lines[len(lines)-maxLines:]
+		}
+		return []byte(strings.Join(lines, "")), scanner.Err()
+	}
+	return nil, fmt.Errorf("neither journalctl nor syslog is available")
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Services that stat thousands of files when they start want a mount
+// that is as fast as it can be for the first minute, and then as
+// polite as it's configured to be. During the startup burst lookups
+// HEAD and list in parallel even with --cheap, and the request limit
+// and readahead start at --startup-burst-factor times their steady
+// values, stepping down to them over --startup-burst.
+
+const STARTUP_BURST_STEPS = 10
+
+// cheap is --cheap, unless we are in the startup burst
+func (fs *Goofys) cheap() bool {
+	return fs.flags.Cheap && atomic.LoadInt32(&fs.bursting) == 0
+}
+
+func burstValue(steady uint32, factor float64) uint32 {
+	v := float64(steady) * factor
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
+
+// StartupBurst runs the startup burst if --startup-burst is set,
+// and returns when it's over
+func (fs *Goofys) StartupBurst() {
+	duration := fs.flags.StartupBurst
+	factor := fs.flags.StartupBurstFactor
+	if duration == 0 {
+		return
+	}
+	if factor < 1 {
+		factor = 1
+	}
+
+	steadyReadahead := atomic.LoadUint32(&fs.maxReadahead)
+	var steadyRequests uint32
+	if fs.scheduler != nil {
+		steadyRequests = fs.scheduler.MaxRequests()
+	}
+
+	log.Infof("Startup burst for %v at %vx", duration, factor)
+	atomic.StoreInt32(&fs.bursting, 1)
+
+	readahead := steadyReadahead
+	for i := 0; i <= STARTUP_BURST_STEPS; i++ {
+		f := 1 + (factor-1)*float64(STARTUP_BURST_STEPS-i)/STARTUP_BURST_STEPS
+
+		// stop touching readahead if someone set the knob
+		next := burstValue(steadyReadahead, f)
+		if readahead != 0 && atomic.CompareAndSwapUint32(&fs.maxReadahead, readahead, next) {
+			readahead = next
+		} else {
+			readahead = 0
+		}
+		if steadyRequests != 0 {
+			fs.scheduler.SetMaxRequests(burstValue(steadyRequests, f))
+		}
+
+		if i != STARTUP_BURST_STEPS {
+			time.Sleep(duration / STARTUP_BURST_STEPS)
+		}
+	}
+
+	atomic.StoreInt32(&fs.bursting, 0)
+	log.Infof("Startup burst is over")
+}
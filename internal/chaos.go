@@ -0,0 +1,281 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"math/rand"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// ChaosFS delays and fails a fraction of the ops that go through it,
+// to test how applications cope with a flaky object store. The
+// failures are injected before the op runs, so retrying it works.
+// Forgets and releases are never touched, the kernel doesn't retry
+// them.
+type ChaosFS struct {
+	Fs fuseutil.FileSystem
+
+	// fractions of the ops, from 0 to 1
+	errorRate float64
+	delayRate float64
+	maxDelay  time.Duration
+}
+
+var (
+	chaosErrors = NewCounter("chaos.errors")
+	chaosDelays = NewCounter("chaos.delays")
+)
+
+func NewChaosFS(fs fuseutil.FileSystem, errorRate float64, delayRate float64, maxDelay time.Duration) *ChaosFS {
+	return &ChaosFS{
+		Fs:        fs,
+		errorRate: errorRate,
+		delayRate: delayRate,
+		maxDelay:  maxDelay,
+	}
+}
+
+func (c *ChaosFS) chaos(ctx context.Context, op string) error {
+	if c.delayRate != 0 && rand.Float64() < c.delayRate {
+		chaosDelays.Inc()
+		delay := time.Duration(rand.Int63n(int64(c.maxDelay) + 1))
+		select {
+		case <-time.After(delay):
+		case <-contextOrTODO(ctx).Done():
+			return syscall.EINTR
+		}
+	}
+
+	if c.errorRate != 0 && rand.Float64() < c.errorRate {
+		chaosErrors.Inc()
+		log.Debugf("chaos: failing %v", op)
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (c *ChaosFS) StatFS(ctx context.Context, op *fuseops.StatFSOp) (err error) {
+	err = c.chaos(ctx, "StatFS")
+	if err != nil {
+		return
+	}
+	return c.Fs.StatFS(ctx, op)
+}
+
+func (c *ChaosFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) (err error) {
+	err = c.chaos(ctx, "LookUpInode")
+	if err != nil {
+		return
+	}
+	return c.Fs.LookUpInode(ctx, op)
+}
+
+func (c *ChaosFS) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) (err error) {
+	err = c.chaos(ctx, "GetInodeAttributes")
+	if err != nil {
+		return
+	}
+	return c.Fs.GetInodeAttributes(ctx, op)
+}
+
+func (c *ChaosFS) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) (err error) {
+	err = c.chaos(ctx, "SetInodeAttributes")
+	if err != nil {
+		return
+	}
+	return c.Fs.SetInodeAttributes(ctx, op)
+}
+
+func (c *ChaosFS) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) (err error) {
+	return c.Fs.ForgetInode(ctx, op)
+}
+
+func (c *ChaosFS) MkDir(ctx context.Context, op *fuseops.MkDirOp) (err error) {
+	err = c.chaos(ctx, "MkDir")
+	if err != nil {
+		return
+	}
+	return c.Fs.MkDir(ctx, op)
+}
+
+func (c *ChaosFS) MkNode(ctx context.Context, op *fuseops.MkNodeOp) (err error) {
+	err = c.chaos(ctx, "MkNode")
+	if err != nil {
+		return
+	}
+	return c.Fs.MkNode(ctx, op)
+}
+
+func (c *ChaosFS) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) (err error) {
+	err = c.chaos(ctx, "CreateFile")
+	if err != nil {
+		return
+	}
+	return c.Fs.CreateFile(ctx, op)
+}
+
+func (c *ChaosFS) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) (err error) {
+	err = c.chaos(ctx, "CreateLink")
+	if err != nil {
+		return
+	}
+	return c.Fs.CreateLink(ctx, op)
+}
+
+func (c *ChaosFS) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) (err error) {
+	err = c.chaos(ctx, "CreateSymlink")
+	if err != nil {
+		return
+	}
+	return c.Fs.CreateSymlink(ctx, op)
+}
+
+func (c *ChaosFS) Rename(ctx context.Context, op *fuseops.RenameOp) (err error) {
+	err = c.chaos(ctx, "Rename")
+	if err != nil {
+		return
+	}
+	return c.Fs.Rename(ctx, op)
+}
+
+func (c *ChaosFS) RmDir(ctx context.Context, op *fuseops.RmDirOp) (err error) {
+	err = c.chaos(ctx, "RmDir")
+	if err != nil {
+		return
+	}
+	return c.Fs.RmDir(ctx, op)
+}
+
+func (c *ChaosFS) Unlink(ctx context.Context, op *fuseops.UnlinkOp) (err error) {
+	err = c.chaos(ctx, "Unlink")
+	if err != nil {
+		return
+	}
+	return c.Fs.Unlink(ctx, op)
+}
+
+func (c *ChaosFS) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) (err error) {
+	err = c.chaos(ctx, "OpenDir")
+	if err != nil {
+		return
+	}
+	return c.Fs.OpenDir(ctx, op)
+}
+
+func (c *ChaosFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) (err error) {
+	err = c.chaos(ctx, "ReadDir")
+	if err != nil {
+		return
+	}
+	return c.Fs.ReadDir(ctx, op)
+}
+
+func (c *ChaosFS) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) (err error) {
+	return c.Fs.ReleaseDirHandle(ctx, op)
+}
+
+func (c *ChaosFS) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err error) {
+	err = c.chaos(ctx, "OpenFile")
+	if err != nil {
+		return
+	}
+	return c.Fs.OpenFile(ctx, op)
+}
+
+func (c *ChaosFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err error) {
+	err = c.chaos(ctx, "ReadFile")
+	if err != nil {
+		return
+	}
+	return c.Fs.ReadFile(ctx, op)
+}
+
+func (c *ChaosFS) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) (err error) {
+	err = c.chaos(ctx, "WriteFile")
+	if err != nil {
+		return
+	}
+	return c.Fs.WriteFile(ctx, op)
+}
+
+func (c *ChaosFS) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) (err error) {
+	err = c.chaos(ctx, "SyncFile")
+	if err != nil {
+		return
+	}
+	return c.Fs.SyncFile(ctx, op)
+}
+
+func (c *ChaosFS) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) (err error) {
+	err = c.chaos(ctx, "FlushFile")
+	if err != nil {
+		return
+	}
+	return c.Fs.FlushFile(ctx, op)
+}
+
+func (c *ChaosFS) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) (err error) {
+	return c.Fs.ReleaseFileHandle(ctx, op)
+}
+
+func (c *ChaosFS) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) (err error) {
+	err = c.chaos(ctx, "ReadSymlink")
+	if err != nil {
+		return
+	}
+	return c.Fs.ReadSymlink(ctx, op)
+}
+
+func (c *ChaosFS) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) (err error) {
+	err = c.chaos(ctx, "RemoveXattr")
+	if err != nil {
+		return
+	}
+	return c.Fs.RemoveXattr(ctx, op)
+}
+
+func (c *ChaosFS) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) (err error) {
+	err = c.chaos(ctx, "GetXattr")
+	if err != nil {
+		return
+	}
+	return c.Fs.GetXattr(ctx, op)
+}
+
+func (c *ChaosFS) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) (err error) {
+	err = c.chaos(ctx, "ListXattr")
+	if err != nil {
+		return
+	}
+	return c.Fs.ListXattr(ctx, op)
+}
+
+func (c *ChaosFS) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) (err error) {
+	err = c.chaos(ctx, "SetXattr")
+	if err != nil {
+		return
+	}
+	return c.Fs.SetXattr(ctx, op)
+}
+
+func (c *ChaosFS) Destroy() {
+	c.Fs.Destroy()
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/kahing/goofys/api/common"
+
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// subcommands are run as `goofys [global options] command ...', the
+// global options are parsed by the top level context
+func rootContext(c *cli.Context) *cli.Context {
+	for c.Parent() != nil {
+		c = c.Parent()
+	}
+	return c
+}
+
+// commandBackend sets up the backend for bucket[:prefix] the same way
+// a mount would, for subcommands that operate on the bucket directly
+func commandBackend(c *cli.Context, bucket string) (cloud StorageBackend, prefix string, flags *FlagStorage, err error) {
+	flags = PopulateBackendFlags(rootContext(c))
+	InitLoggers(false)
+	if flags.DebugS3 {
+		s3Log.Level = logrus.DebugLevel
+	}
+
+	colon := strings.Index(bucket, ":")
+	if colon != -1 {
+		prefix = strings.Trim(bucket[colon+1:], "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		bucket = bucket[0:colon]
+	}
+
+	cloud, err = NewBackend(bucket, flags)
+	if err != nil {
+		err = fmt.Errorf("Unable to setup backend: %v", err)
+		return
+	}
+
+	err = cloud.Init(prefix + RandStringBytesMaskImprSrc(32))
+	if err != nil {
+		err = fmt.Errorf("Unable to access '%v': %v", bucket, err)
+		return
+	}
+	return
+}
+
+// commandAction makes sure errors are printed before we exit, app.Run
+// doesn't do that for us
+func commandAction(action func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		err := action(c)
+		if err != nil {
+			if _, ok := err.(*cli.ExitError); !ok {
+				err = cli.NewExitError(err.Error(), 1)
+			}
+		}
+		return err
+	}
+}
+
+// commandArg returns the only argument of a subcommand
+func commandArg(c *cli.Context, usage string) (string, error) {
+	if len(c.Args()) != 1 {
+		return "", fmt.Errorf("%v takes exactly one argument: %v", c.Command.Name, usage)
+	}
+	return c.Args()[0], nil
+}
+
+// cleanPrefix turns a path relative to the bucket into a prefix with
+// a trailing /, or "" for the root
+func cleanPrefix(prefix string) string {
+	prefix = path.Clean("/" + prefix)[1:]
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// cp -r through the mount reads every byte down and writes it back
+// up, and FUSE doesn't tell us that's what's going on. goofys copy
+// does the same with server side copies instead.
+
+var copyCommand = cli.Command{
+	Name:      "copy",
+	Usage:     "Copy a directory of a mount to another place in the same mount with server side copies",
+	ArgsUsage: "SOURCE DEST",
+	Action:    commandAction(copyAction),
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "parallel",
+			Value: 16,
+			Usage: "Number of objects to copy at the same time",
+		},
+		cli.IntFlag{
+			Name:  "part-size",
+			Usage: "Copy objects larger than this many MB in parts of this size (default: 5GB, in parts of at least 50MB)",
+		},
+		cli.DurationFlag{
+			Name:  "progress",
+			Value: 10 * time.Second,
+			Usage: "How often to log the progress",
+		},
+	},
+}
+
+// mountPath finds the goofys mount path is in, and returns the
+// bucket[:prefix] it's a mount of and path relative to the mount
+func mountPath(path string) (mountPoint string, bucket string, rel string, err error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		bucket, err = getMountKnob(dir, "bucket")
+		if err == nil {
+			rel, err = filepath.Rel(dir, abs)
+			return dir, bucket, filepath.ToSlash(rel), err
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return "", "", "", fmt.Errorf("%v is not in a goofys mount", path)
+}
+
+func copyAction(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return fmt.Errorf("copy takes exactly two arguments: SOURCE DEST")
+	}
+
+	mountPoint, bucket, srcPath, err := mountPath(c.Args()[0])
+	if err != nil {
+		return err
+	}
+	dstMount, _, dstPath, err := mountPath(c.Args()[1])
+	if err != nil {
+		return err
+	}
+	if dstMount != mountPoint {
+		return fmt.Errorf("%v and %v are not in the same mount", c.Args()[0], c.Args()[1])
+	}
+	if part := c.Int("part-size"); part != 0 && (part < 5 || part > 5*1024) {
+		return fmt.Errorf("--part-size must be between 5 and 5120")
+	}
+	partSize := uint64(c.Int("part-size")) * 1024 * 1024
+
+	cloud, prefix, _, err := commandBackend(c, bucket)
+	if err != nil {
+		return err
+	}
+	src := prefix + cleanPrefix(srcPath)
+	dst := prefix + cleanPrefix(dstPath)
+	if strings.HasPrefix(dst, src) || strings.HasPrefix(src, dst) {
+		return fmt.Errorf("%v and %v overlap", c.Args()[0], c.Args()[1])
+	}
+
+	files, err := listRemote(cloud, src)
+	if err != nil {
+		return fmt.Errorf("Unable to list %v: %v", src, err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("Nothing to copy in %v", c.Args()[0])
+	}
+
+	var totalBytes, copied, copiedBytes uint64
+	var tasks []syncTask
+	for name, f := range files {
+		from, to, size := src+name, dst+name, f.size
+		totalBytes += size
+		tasks = append(tasks, syncTask{"copy", name, func() error {
+			_, err := cloud.CopyBlob(&CopyBlobInput{
+				Source:      from,
+				Destination: to,
+				Size:        &size,
+				PartSize:    partSize,
+			})
+			if err == nil {
+				atomic.AddUint64(&copied, 1)
+				atomic.AddUint64(&copiedBytes, size)
+			}
+			return err
+		}})
+	}
+
+	progress := func() {
+		log.Infof("copied %v of %v objects, %v of %v MB", atomic.LoadUint64(&copied), len(tasks),
+			atomic.LoadUint64(&copiedBytes)/1024/1024, totalBytes/1024/1024)
+	}
+	done := make(chan struct{})
+	if interval := c.Duration("progress"); interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					progress()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	err = runSyncTasks(tasks, c.Int("parallel"))
+	close(done)
+	progress()
+
+	// the mount may have cached DEST as missing
+	if kerr := setMountKnob(mountPoint, "invalidate", dstPath); kerr != nil {
+		log.Warnf("Unable to invalidate %v under %v: %v", dstPath, mountPoint, kerr)
+	}
+	return err
+}
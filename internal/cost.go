@@ -0,0 +1,185 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// --cost-budget estimates what the mount costs from the S3 requests
+// it makes and the bytes it moves, and warns once a day when that
+// goes over the budget, to catch runaway jobs before the bill does.
+// The warning also goes to the budget-exceeded hook.
+
+var (
+	// PUT, COPY, POST and LIST are priced the same, and so are GET
+	// and HEAD. DELETE is free
+	costPutRequests = NewCounter("s3.requests.put")
+	costGetRequests = NewCounter("s3.requests.get")
+	costBytesIn     = NewCounter("s3.bytes.in")
+	costBytesOut    = NewCounter("s3.bytes.out")
+)
+
+const COST_CHECK_INTERVAL = time.Minute
+
+// countRequest is an S3 Complete handler that counts every request
+// for the cost estimate
+func countRequest(r *request.Request) {
+	if r.HTTPRequest == nil || r.HTTPResponse == nil || r.Operation == nil {
+		// never sent
+		return
+	}
+
+	switch method := r.Operation.HTTPMethod; {
+	case strings.HasPrefix(r.Operation.Name, "List"):
+		costPutRequests.Inc()
+	case method == "GET" || method == "HEAD":
+		costGetRequests.Inc()
+	case method == "PUT" || method == "POST":
+		costPutRequests.Inc()
+	}
+
+	if r.HTTPRequest.ContentLength > 0 {
+		costBytesIn.Add(uint64(r.HTTPRequest.ContentLength))
+	}
+	if r.Operation.HTTPMethod == "GET" && r.HTTPResponse.ContentLength > 0 {
+		costBytesOut.Add(uint64(r.HTTPResponse.ContentLength))
+	}
+}
+
+// costPrices are in dollars per 1000 requests and per GB
+type costPrices struct {
+	Put float64
+	Get float64
+	In  float64
+	Out float64
+}
+
+// parseCostPrices parses --cost-prices, which is NAME=PRICE,...
+func parseCostPrices(s string) (prices costPrices, err error) {
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		eq := strings.Index(kv, "=")
+		if eq == -1 {
+			return prices, fmt.Errorf("%v is not NAME=PRICE", kv)
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(kv[eq+1:]), 64)
+		if err != nil || price < 0 {
+			return prices, fmt.Errorf("invalid price %v", kv[eq+1:])
+		}
+
+		switch strings.TrimSpace(kv[:eq]) {
+		case "put":
+			prices.Put = price
+		case "get":
+			prices.Get = price
+		case "in":
+			prices.In = price
+		case "out":
+			prices.Out = price
+		default:
+			return prices, fmt.Errorf("unknown price %v", kv[:eq])
+		}
+	}
+	return
+}
+
+type costUsage struct {
+	put, get, in, out uint64
+}
+
+func currentCostUsage() costUsage {
+	return costUsage{
+		put: costPutRequests.Value(),
+		get: costGetRequests.Value(),
+		in:  costBytesIn.Value(),
+		out: costBytesOut.Value(),
+	}
+}
+
+func (u costUsage) since(base costUsage) costUsage {
+	return costUsage{
+		put: u.put - base.put,
+		get: u.get - base.get,
+		in:  u.in - base.in,
+		out: u.out - base.out,
+	}
+}
+
+func (p costPrices) cost(u costUsage) float64 {
+	const GB = 1024 * 1024 * 1024
+	return float64(u.put)/1000*p.Put + float64(u.get)/1000*p.Get +
+		float64(u.in)/GB*p.In + float64(u.out)/GB*p.Out
+}
+
+type costTracker struct {
+	fs     *Goofys
+	prices costPrices
+	budget float64
+
+	// the UTC day we are counting, and the counters when it began
+	day      time.Time
+	baseline costUsage
+	alerted  bool
+}
+
+func newCostTracker(fs *Goofys, prices costPrices, budget float64) *costTracker {
+	return &costTracker{
+		fs:     fs,
+		prices: prices,
+		budget: budget,
+	}
+}
+
+func (c *costTracker) run() {
+	for {
+		c.check()
+		time.Sleep(COST_CHECK_INTERVAL)
+	}
+}
+
+// check alerts if today's cost is over the budget, once a day
+func (c *costTracker) check() {
+	now := c.fs.clock.Now().UTC()
+	usage := currentCostUsage()
+
+	if day := now.Truncate(24 * time.Hour); !day.Equal(c.day) {
+		c.day = day
+		c.baseline = usage
+		c.alerted = false
+	}
+
+	today := usage.since(c.baseline)
+	cost := c.prices.cost(today)
+	if c.alerted || cost < c.budget {
+		return
+	}
+	c.alerted = true
+
+	summary := fmt.Sprintf("%v PUT/COPY/POST/LIST, %v GET/HEAD, %vMB in, %vMB out",
+		today.put, today.get, today.in/1024/1024, today.out/1024/1024)
+	log.Warnf("Estimated cost of %v today is $%.2f, over the budget of $%.2f: %v",
+		c.fs.bucket, cost, c.budget, summary)
+	c.fs.hooks.fire(HOOK_BUDGET_EXCEEDED,
+		fmt.Sprintf("$%.2f over $%.2f: %v", cost, c.budget, summary))
+}
@@ -39,6 +39,12 @@ type DirInodeData struct {
 	DirTime         time.Time
 
 	Children []*Inode
+
+	// the goofys.du xattr
+	du *duCache
+
+	// set on the root of a tenant
+	tenant *Tenant
 }
 
 type DirHandleEntry struct {
@@ -67,9 +73,9 @@ func (inode *Inode) OpenDir() (dh *DirHandle) {
 
 	parent := inode.Parent
 	cloud, _ := inode.cloud()
-	_, isS3 := cloud.(*S3Backend)
+	_, isS3 := unwrapBackend(cloud).(*S3Backend)
 
-	if isS3 && parent != nil && inode.fs.flags.TypeCacheTTL != 0 {
+	if isS3 && parent != nil && inode.fs.TypeCacheTTL() != 0 {
 		parent.mu.Lock()
 		defer parent.mu.Unlock()
 
@@ -190,7 +196,7 @@ func (dh *DirHandle) listObjectsSlurp(prefix string) (resp *ListBlobsOutput, err
 		}
 
 		if sealed || !resp.IsTruncated {
-			d.dir.DirTime = time.Now()
+			d.dir.DirTime = d.fs.clock.Now()
 			d.Attributes.Mtime = d.findChildMaxTime()
 		}
 	}
@@ -230,13 +236,15 @@ func (dh *DirHandle) listObjects(prefix string) (resp *ListBlobsOutput, err erro
 	listChan := make(chan ListBlobsOutput, 1)
 
 	fs := dh.inode.fs
+	// the same for the whole listing even if the startup burst ends
+	cheap := fs.cheap()
 
 	// try to list without delimiter to see if we can slurp up
 	// multiple directories
 	parent := dh.inode.Parent
 
 	if dh.Marker == nil &&
-		fs.flags.TypeCacheTTL != 0 &&
+		fs.TypeCacheTTL() != 0 &&
 		(parent != nil && parent.dir.seqOpenDirScore >= 2) {
 		go func() {
 			resp, err := dh.listObjectsSlurp(prefix)
@@ -269,7 +277,7 @@ func (dh *DirHandle) listObjects(prefix string) (resp *ListBlobsOutput, err erro
 		}
 	}
 
-	if !fs.flags.Cheap {
+	if !cheap {
 		// invoke the fallback in parallel if desired
 		go listObjectsFlat()
 	}
@@ -281,7 +289,7 @@ func (dh *DirHandle) listObjects(prefix string) (resp *ListBlobsOutput, err erro
 	case err = <-errSlurpChan:
 	}
 
-	if fs.flags.Cheap {
+	if cheap {
 		listObjectsFlat()
 	}
 
@@ -350,7 +358,7 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 			}
 
 			if inode := parent.findChildUnlockedFull(dirName); inode != nil {
-				inode.AttrTime = time.Now()
+				inode.AttrTime = fs.clock.Now()
 			} else {
 				inode := NewInode(fs, parent, &dirName)
 				inode.ToDir()
@@ -438,7 +446,7 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 	} else {
 		if offset == numChildren {
 			// we've reached the end
-			parent.dir.DirTime = time.Now()
+			parent.dir.DirTime = parent.fs.clock.Now()
 			parent.Attributes.Mtime = parent.findChildMaxTime()
 			parent.mu.Unlock()
 			return nil, nil
@@ -459,6 +467,7 @@ func (dir *Inode) renameChildren(cloud StorageBackend, prefix string,
 	newParent *Inode, newPrefix string) (err error) {
 
 	var copied []string
+	var markers []BlobItemOutput
 	var res *ListBlobsOutput
 
 	for true {
@@ -475,7 +484,7 @@ func (dir *Inode) renameChildren(cloud StorageBackend, prefix string,
 		}
 
 		if len(res.Items) == 0 {
-			return
+			break
 		}
 
 		if copied == nil {
@@ -487,7 +496,7 @@ func (dir *Inode) renameChildren(cloud StorageBackend, prefix string,
 		// are going to make an arbitrary limit that sounds like a
 		// good one (and we want to have an arbitrary limit because we
 		// don't want to rename a million objects here)
-		total := len(copied) + len(res.Items)
+		total := len(copied) + len(markers) + len(res.Items)
 		if total > 1000 || total == 1000 && res.IsTruncated {
 			return syscall.E2BIG
 		}
@@ -496,16 +505,15 @@ func (dir *Inode) renameChildren(cloud StorageBackend, prefix string,
 		// moving it to "/b/" items will be a/dir/1, a/dir/2, a/dir/3,
 		// and we will copy them to b/1, b/2, b/3 respectively
 		for _, i := range res.Items {
-			key := (*i.Key)[len(prefix):]
+			// publish markers are copied after everything else,
+			// so readers waiting on them see a complete directory
+			if isPublishMarker(*i.Key) {
+				markers = append(markers, i)
+				continue
+			}
 
 			// TODO: coordinate with underlining copy and do this in parallel
-			_, err = cloud.CopyBlob(&CopyBlobInput{
-				Source:       *i.Key,
-				Destination:  newPrefix + key,
-				Size:         &i.Size,
-				ETag:         i.ETag,
-				StorageClass: i.StorageClass,
-			})
+			err = renameChild(cloud, prefix, newPrefix, i)
 			if err != nil {
 				return err
 			}
@@ -518,7 +526,36 @@ func (dir *Inode) renameChildren(cloud StorageBackend, prefix string,
 		}
 	}
 
-	s3Log.Debugf("rename copied %v", copied)
-	_, err = cloud.DeleteBlobs(&DeleteBlobsInput{Items: copied})
+	var copiedMarkers []string
+	for _, i := range markers {
+		err = renameChild(cloud, prefix, newPrefix, i)
+		if err != nil {
+			return err
+		}
+		copiedMarkers = append(copiedMarkers, *i.Key)
+	}
+
+	s3Log.Debugf("rename copied %v %v", copiedMarkers, copied)
+	// unpublish the source before taking it apart
+	if len(copiedMarkers) != 0 {
+		_, err = cloud.DeleteBlobs(&DeleteBlobsInput{Items: copiedMarkers})
+		if err != nil {
+			return err
+		}
+	}
+	if len(copied) != 0 {
+		_, err = cloud.DeleteBlobs(&DeleteBlobsInput{Items: copied})
+	}
+	return err
+}
+
+func renameChild(cloud StorageBackend, prefix string, newPrefix string, i BlobItemOutput) error {
+	_, err := cloud.CopyBlob(&CopyBlobInput{
+		Source:       *i.Key,
+		Destination:  newPrefix + (*i.Key)[len(prefix):],
+		Size:         &i.Size,
+		ETag:         i.ETag,
+		StorageClass: i.StorageClass,
+	})
 	return err
 }
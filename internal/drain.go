@@ -0,0 +1,89 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Drain stops accepting new writes and uploads the files that are
+// being written, taking up to timeout. Returns the files that are
+// still not persisted.
+func (fs *Goofys) Drain(timeout time.Duration) []string {
+	atomic.StoreInt32(&fs.draining, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// FlushAll already logs what failed, what's left dirty is
+	// what the caller wants to know
+	fs.FlushAll(ctx)
+
+	return fs.dirtyFiles()
+}
+
+// checkWritable fails the operations that would change the bucket
+// once we are draining
+func (fs *Goofys) checkWritable() error {
+	if atomic.LoadInt32(&fs.draining) != 0 {
+		return syscall.EROFS
+	}
+	return nil
+}
+
+// dirtyFiles returns the files with data that hasn't been uploaded,
+// either because they are still open or because the upload failed
+func (fs *Goofys) dirtyFiles() (names []string) {
+	for _, fh := range fs.openFiles() {
+		fh.mu.Lock()
+		dirty := fh.dirty
+		fh.mu.Unlock()
+
+		if dirty {
+			names = append(names, *fh.inode.FullName())
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func (fs *Goofys) openFiles() []*FileHandle {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	handles := make([]*FileHandle, 0, len(fs.fileHandles))
+	for _, fh := range fs.fileHandles {
+		handles = append(handles, fh)
+	}
+	return handles
+}
+
+// FlushAll uploads the files that are being written, the same as
+// closing them would. Returns the first error
+func (fs *Goofys) FlushAll(ctx context.Context) (err error) {
+	for _, fh := range fs.openFiles() {
+		flushErr := fh.FlushFile(ctx)
+		if flushErr != nil {
+			fh.inode.errFuse("FlushAll", flushErr)
+			if err == nil {
+				err = flushErr
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DU_XATTR is the total size and number of the objects under a
+// directory, as "BYTES OBJECTS". It's computed from a recursive
+// listing instead of a stat of every file, and cached for
+// --stat-cache-ttl. Not included in listxattr because of the cost.
+const DU_XATTR = "goofys.du"
+
+type duCache struct {
+	bytes   uint64
+	objects uint64
+	time    time.Time
+}
+
+// du lists everything under the directory, it must not be called
+// with inode.mu held
+func (inode *Inode) du() ([]byte, error) {
+	if !inode.isDir() {
+		return nil, syscall.ENODATA
+	}
+
+	inode.mu.Lock()
+	cached := inode.dir.du
+	inode.mu.Unlock()
+
+	if cached == nil || inode.fs.expired(cached.time, inode.fs.StatCacheTTL()) {
+		cloud, key := inode.cloud()
+		prefix := key
+		if prefix != "" {
+			prefix += "/"
+		}
+
+		var err error
+		cached, err = duPrefix(inode.fs.clock, cloud, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		inode.mu.Lock()
+		inode.dir.du = cached
+		inode.mu.Unlock()
+	}
+
+	return []byte(fmt.Sprintf("%v %v", cached.bytes, cached.objects)), nil
+}
+
+func duPrefix(clock Clock, cloud StorageBackend, prefix string) (*duCache, error) {
+	du := &duCache{time: clock.Now()}
+	var token *string
+
+	for {
+		resp, err := cloud.ListBlobs(&ListBlobsInput{
+			Prefix:            &prefix,
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, mapAwsError(err)
+		}
+
+		for _, item := range resp.Items {
+			if strings.HasSuffix(*item.Key, "/") {
+				// dir blob
+				continue
+			}
+			du.bytes += item.Size
+			du.objects++
+		}
+
+		if !resp.IsTruncated {
+			return du, nil
+		}
+		token = resp.NextContinuationToken
+	}
+}
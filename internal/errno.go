@@ -0,0 +1,151 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+)
+
+// The errnos that backend errors turn into, by class. --errno-map
+// overrides them because applications differ in what they retry on:
+// some spin on EAGAIN where they would have given up on EIO. Not
+// found and not supported can't be changed as we depend on them.
+type errnoMap map[string]syscall.Errno
+
+// for the errors that don't go through a mount, like those of the
+// subcommands
+var defaultErrnos = defaultErrnoMap()
+
+func defaultErrnoMap() errnoMap {
+	return errnoMap{
+		"invalid":       fuse.EINVAL,        // 400
+		"denied":        syscall.EACCES,     // 401, 403
+		"throttled":     syscall.EAGAIN,     // 429
+		"server":        syscall.EAGAIN,     // 500
+		"locked":        syscall.EPERM,      // object lock
+		"kms-denied":    ErrKMSAccessDenied, // no access to the key
+		"kms-disabled":  ErrKMSKeyDisabled,  // the key is disabled or gone
+		"kms-throttled": syscall.EAGAIN,
+	}
+}
+
+var errnoNames = map[string]syscall.Errno{
+	"EACCES":    syscall.EACCES,
+	"EAGAIN":    syscall.EAGAIN,
+	"EBUSY":     syscall.EBUSY,
+	"EINTR":     syscall.EINTR,
+	"EINVAL":    syscall.EINVAL,
+	"EIO":       syscall.EIO,
+	"ENOSPC":    syscall.ENOSPC,
+	"EPERM":     syscall.EPERM,
+	"EROFS":     syscall.EROFS,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+}
+
+// classError is a backend error of one of the classes. It stays one
+// until it gets to the kernel, where each mount turns it into the
+// errno of its own --errno-map, so two classes can map to the same
+// errno and still be told apart
+type classError string
+
+func (e classError) Error() string {
+	return defaultErrnos.classErrno(string(e)).Error()
+}
+
+// classErrno returns the errno that errors of class map to
+func (m errnoMap) classErrno(class string) syscall.Errno {
+	errno, ok := m[class]
+	if !ok {
+		panic(fmt.Sprintf("unknown error class %v", class))
+	}
+	return errno
+}
+
+// errno turns err into its errno if it's a classError
+func (m errnoMap) errno(err error) error {
+	if class, ok := err.(classError); ok {
+		return m.classErrno(string(class))
+	}
+	return err
+}
+
+// mapErrno turns the classError an op failed with into the errno of
+// this mount, every op defers it
+func (fs *Goofys) mapErrno(err *error) {
+	*err = fs.errnos.errno(*err)
+}
+
+// isErrorClass reports whether err is of one of classes
+func isErrorClass(err error, classes ...string) bool {
+	class, ok := err.(classError)
+	if !ok {
+		return false
+	}
+	for _, c := range classes {
+		if string(class) == c {
+			return true
+		}
+	}
+	return false
+}
+
+func errorClasses() []string {
+	var classes []string
+	for c := range defaultErrnoMap() {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// parseErrnoMap parses CLASS=ERRNO[,CLASS=ERRNO...], where ERRNO is
+// a name like EIO or a number
+func parseErrnoMap(s string) (errnoMap, error) {
+	m := defaultErrnoMap()
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+
+		eq := strings.Index(kv, "=")
+		if eq == -1 {
+			return nil, fmt.Errorf("%v is not CLASS=ERRNO", kv)
+		}
+		class, name := kv[:eq], strings.ToUpper(kv[eq+1:])
+
+		if _, ok := m[class]; !ok {
+			return nil, fmt.Errorf("unknown error class %v, expected one of %v",
+				class, strings.Join(errorClasses(), ", "))
+		}
+
+		errno, ok := errnoNames[name]
+		if !ok {
+			n, err := strconv.Atoi(name)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("unknown errno %v", name)
+			}
+			errno = syscall.Errno(n)
+		}
+		m[class] = errno
+	}
+	return m, nil
+}
@@ -15,10 +15,12 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/jacobsa/fuse"
@@ -38,24 +40,41 @@ type FileHandle struct {
 	lastPartId      uint32
 
 	poolHandle *BufferPool
-	buf        *MBuf
+	buf        writeBuffer
 
 	lastWriteError error
 
+	// bytes written that count against the tenant's quota
+	reserved uint64
+
 	// read
 	reader        io.ReadCloser
 	readBufOffset int64
 
+	// the GETs of reader and buffers are under readCtx, so they
+	// can be cancelled when a read is interrupted
+	readCtx    context.Context
+	readCancel context.CancelFunc
+
 	// parallel read
 	buffers           []*S3ReadBuffer
 	existingReadahead int
 	seqReadAmount     uint64
 	numOOORead        uint64 // number of out of order read
+
+	// footer first, see footer.go
+	readStarted bool
+	columnar    bool
 }
 
 const MAX_READAHEAD = uint32(400 * 1024 * 1024)
 const READAHEAD_CHUNK = uint32(20 * 1024 * 1024)
 
+// the first read of a file at least as large as the readahead starts
+// with a GET this small so the first bytes come back quickly. The rest
+// of the readahead follows once the reads turn out to be sequential.
+const READAHEAD_FIRST_CHUNK = uint32(1 * 1024 * 1024)
+
 func NewFileHandle(in *Inode) *FileHandle {
 	fh := &FileHandle{inode: in}
 	return fh
@@ -81,9 +100,12 @@ func (fh *FileHandle) initMPU() {
 	cloud, key := fh.cloud()
 	fh.mpuName = &key
 
+	tenant := fh.inode.tenant()
 	resp, err := cloud.MultipartBlobBegin(&MultipartBlobBeginInput{
-		Key:         *fh.mpuName,
-		ContentType: fs.flags.GetMimeType(*fh.mpuName),
+		Key:          *fh.mpuName,
+		ContentType:  fs.flags.GetMimeType(*fh.mpuName),
+		StorageClass: tenant.storageClass(),
+		Tags:         tenant.tags(),
 	})
 
 	fh.mu.Lock()
@@ -98,7 +120,7 @@ func (fh *FileHandle) initMPU() {
 	return
 }
 
-func (fh *FileHandle) mpuPartNoSpawn(buf *MBuf, part uint32, total int64, last bool) (err error) {
+func (fh *FileHandle) mpuPartNoSpawn(buf writeBuffer, part uint32, total int64, last bool) (err error) {
 	fs := fh.inode.fs
 
 	fs.replicators.Take(1, true)
@@ -129,7 +151,7 @@ func (fh *FileHandle) mpuPartNoSpawn(buf *MBuf, part uint32, total int64, last b
 	return
 }
 
-func (fh *FileHandle) mpuPart(buf *MBuf, part uint32, total int64) {
+func (fh *FileHandle) mpuPart(buf writeBuffer, part uint32, total int64) {
 	defer func() {
 		fh.mpuWG.Done()
 	}()
@@ -169,7 +191,7 @@ func (fh *FileHandle) waitForCreateMPU() (err error) {
 func (fh *FileHandle) partSize() uint64 {
 	cloud, _ := fh.cloud()
 
-	if _, ok := cloud.(*ADLv1); ok {
+	if _, ok := unwrapBackend(cloud).(*ADLv1); ok {
 		// ADLv1 fails with 404 if we upload data larger than
 		// 30000000 bytes (28.6MB) (28MB also failed in reality)
 		return 20 * 1024 * 1024
@@ -213,6 +235,25 @@ func (fh *FileHandle) uploadCurrentBuf(parallel bool) (err error) {
 	return
 }
 
+// newWriteBuffer takes memory buffers if there are any left, then
+// spills to disk with --spill-dir, and only then waits for the
+// uploads in flight to free memory
+func (fh *FileHandle) newWriteBuffer() writeBuffer {
+	size := fh.partSize()
+
+	if spill := fh.inode.fs.spill; spill != nil {
+		if buf := (MBuf{}).Init(fh.poolHandle, size, false); buf != nil {
+			return buf
+		}
+		if buf := spill.request(size); buf != nil {
+			fh.inode.logFuse("spilling", fh.nextWriteOffset, size)
+			return buf
+		}
+	}
+
+	return MBuf{}.Init(fh.poolHandle, size, true)
+}
+
 func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
 	fh.inode.logFuse("WriteFile", offset, len(data))
 
@@ -223,6 +264,13 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
 		return fh.lastWriteError
 	}
 
+	if offset == 0 && fh.inode.objectLocked() {
+		fh.inode.errFuse("WriteFile: object is locked until", fh.inode.retainUntil,
+			"legal hold", fh.inode.legalHold)
+		fh.lastWriteError = syscall.EPERM
+		return fh.lastWriteError
+	}
+
 	if offset != fh.nextWriteOffset {
 		fh.inode.errFuse("WriteFile: only sequential writes supported", fh.nextWriteOffset, offset)
 		fh.lastWriteError = syscall.ENOTSUP
@@ -234,13 +282,25 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
 		fh.dirty = true
 	}
 
+	err = fh.inode.tenant().reserve(uint64(len(data)), fh.inode.fs.StatCacheTTL())
+	if err != nil {
+		fh.lastWriteError = err
+		return
+	}
+	fh.reserved += uint64(len(data))
+
 	for {
 		if fh.buf == nil {
-			fh.buf = MBuf{}.Init(fh.poolHandle, fh.partSize(), true)
+			fh.buf = fh.newWriteBuffer()
 		}
 
-		nCopied, _ := fh.buf.Write(data)
+		var nCopied int
+		nCopied, err = fh.buf.Write(data)
 		fh.nextWriteOffset += int64(nCopied)
+		if err != nil {
+			fh.lastWriteError = err
+			return
+		}
 
 		if fh.buf.Full() {
 			cloud, _ := fh.cloud()
@@ -267,6 +327,9 @@ type S3ReadBuffer struct {
 	offset uint64
 	size   uint32
 	buf    *Buffer
+
+	// aborts the GET if we no longer need this buffer
+	cancel context.CancelFunc
 }
 
 func (b S3ReadBuffer) Init(fh *FileHandle, offset uint64, size uint32) *S3ReadBuffer {
@@ -280,11 +343,15 @@ func (b S3ReadBuffer) Init(fh *FileHandle, offset uint64, size uint32) *S3ReadBu
 		return nil
 	}
 
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(fh.readCtx)
+
 	b.buf = Buffer{}.Init(mbuf, func() (io.ReadCloser, error) {
 		resp, err := b.s3.GetBlob(&GetBlobInput{
-			Key:   key,
-			Start: offset,
-			Count: uint64(size),
+			Key:     key,
+			Start:   offset,
+			Count:   uint64(size),
+			Context: ctx,
 		})
 		if err != nil {
 			return nil, err
@@ -296,6 +363,13 @@ func (b S3ReadBuffer) Init(fh *FileHandle, offset uint64, size uint32) *S3ReadBu
 	return &b
 }
 
+// Close cancels the outstanding GET if there is one and frees the
+// buffer
+func (b *S3ReadBuffer) Close() {
+	b.cancel()
+	b.buf.Close()
+}
+
 func (b *S3ReadBuffer) Read(offset uint64, p []byte) (n int, err error) {
 	if b.offset == offset {
 		n, err = io.ReadFull(b.buf, p)
@@ -319,6 +393,39 @@ func (b *S3ReadBuffer) Read(offset uint64, p []byte) (n int, err error) {
 	}
 }
 
+// skipReadAhead moves the readahead forward to offset if it's within
+// what we are already prefetching, so a short seek doesn't throw away
+// all the readahead. The buffers before offset are cancelled.
+func (fh *FileHandle) skipReadAhead(offset uint64) bool {
+	if len(fh.buffers) == 0 || offset < fh.buffers[0].offset {
+		return false
+	}
+	last := fh.buffers[len(fh.buffers)-1]
+	if offset >= last.offset+uint64(last.size) {
+		return false
+	}
+
+	for fh.buffers[0].offset+uint64(fh.buffers[0].size) <= offset {
+		fh.buffers[0].Close()
+		fh.buffers = fh.buffers[1:]
+	}
+
+	// discard the beginning of the buffer we landed in
+	skip := offset - fh.buffers[0].offset
+	scratch := make([]byte, MinUInt64(skip, 64*1024))
+	for skip != 0 {
+		n, err := fh.buffers[0].Read(fh.buffers[0].offset,
+			scratch[:MinUInt64(skip, uint64(len(scratch)))])
+		if err != nil {
+			return false
+		}
+		skip -= uint64(n)
+	}
+
+	fh.readBufOffset = int64(offset)
+	return true
+}
+
 func (fh *FileHandle) readFromReadAhead(offset uint64, buf []byte) (bytesRead int, err error) {
 	var nread int
 	for len(fh.buffers) != 0 {
@@ -330,7 +437,7 @@ func (fh *FileHandle) readFromReadAhead(offset uint64, buf []byte) (bytesRead in
 
 		if fh.buffers[0].size == 0 {
 			// we've exhausted the first buffer
-			fh.buffers[0].buf.Close()
+			fh.buffers[0].Close()
 			fh.buffers = fh.buffers[1:]
 		}
 
@@ -345,22 +452,27 @@ func (fh *FileHandle) readFromReadAhead(offset uint64, buf []byte) (bytesRead in
 	return
 }
 
-func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
+// readAhead fills up the readahead buffers starting at offset. If
+// firstChunk is set, only a buffer that large is read ahead.
+func (fh *FileHandle) readAhead(offset uint64, firstChunk uint32) (err error) {
 	existingReadahead := uint32(0)
 	for _, b := range fh.buffers {
 		existingReadahead += b.size
 	}
 
-	readAheadAmount := MAX_READAHEAD
+	readAheadAmount := atomic.LoadUint32(&fh.inode.fs.maxReadahead)
 
 	for readAheadAmount-existingReadahead >= READAHEAD_CHUNK {
 		off := offset + uint64(existingReadahead)
 		remaining := fh.inode.Attributes.Size - off
 
 		// only read up to readahead chunk each time
-		size := MinUInt32(readAheadAmount-existingReadahead, READAHEAD_CHUNK)
+		chunk := MinUInt32(readAheadAmount-existingReadahead, READAHEAD_CHUNK)
+		if firstChunk != 0 {
+			chunk = MinUInt32(chunk, firstChunk)
+		}
 		// but don't read past the file
-		size = uint32(MinUInt64(uint64(size), remaining))
+		size := uint32(MinUInt64(uint64(chunk), remaining))
 
 		if size != 0 {
 			fh.inode.logFuse("readahead", off, size, existingReadahead)
@@ -381,7 +493,7 @@ func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
 			}
 		}
 
-		if size != READAHEAD_CHUNK {
+		if size != chunk || firstChunk != 0 {
 			// that was the last remaining chunk to readahead
 			break
 		}
@@ -390,7 +502,15 @@ func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
 	return nil
 }
 
-func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err error) {
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) readContext() context.Context {
+	if fh.readCtx == nil || fh.readCtx.Err() != nil {
+		fh.readCtx, fh.readCancel = context.WithCancel(context.Background())
+	}
+	return fh.readCtx
+}
+
+func (fh *FileHandle) ReadFile(ctx context.Context, offset int64, buf []byte) (bytesRead int, err error) {
 	fh.inode.logFuse("ReadFile", offset, len(buf))
 	defer func() {
 		fh.inode.logFuse("< ReadFile", bytesRead, err)
@@ -408,6 +528,12 @@ func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err err
 	nwant := len(buf)
 	var nread int
 
+	fh.readContext()
+	done := onInterrupt(ctx, fh.readCancel)
+
+	fh.detectColumnar(uint64(offset))
+	bytesRead, err = fh.readFooter(uint64(offset), buf)
+
 	for bytesRead < nwant && err == nil {
 		nread, err = fh.readFile(offset+int64(bytesRead), buf[bytesRead:])
 		if nread > 0 {
@@ -415,6 +541,22 @@ func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err err
 		}
 	}
 
+	done()
+	if fh.readCtx.Err() != nil {
+		// the GETs were aborted, nothing we have is usable
+		fh.inode.logFuse("ReadFile interrupted", offset, bytesRead)
+		if fh.reader != nil {
+			fh.reader.Close()
+			fh.reader = nil
+		}
+		for _, b := range fh.buffers {
+			b.Close()
+		}
+		fh.buffers = nil
+		fh.seqReadAmount = 0
+		err = syscall.EINTR
+	}
+
 	return
 }
 
@@ -446,7 +588,7 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 		fh.poolHandle = fs.bufferPool
 	}
 
-	if fh.readBufOffset != offset {
+	if fh.readBufOffset != offset && !fh.skipReadAhead(uint64(offset)) {
 		// XXX out of order read, maybe disable prefetching
 		fh.inode.logFuse("out of order read", offset, fh.readBufOffset)
 
@@ -457,25 +599,38 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 			fh.reader = nil
 		}
 
-		if fh.buffers != nil {
-			// we misdetected
+		if fh.buffers != nil && !fh.columnar {
+			// we misdetected. Columnar files are read in
+			// chunks anyway, keep the readahead for them
 			fh.numOOORead++
 		}
 
 		for _, b := range fh.buffers {
-			b.buf.Close()
+			b.Close()
 		}
 		fh.buffers = nil
 	}
 
-	if !fs.flags.Cheap && fh.seqReadAmount >= uint64(READAHEAD_CHUNK) && fh.numOOORead < 3 {
+	// a single streaming GET of a huge file takes a while to
+	// return anything, so these start with a small range and only
+	// read further ahead if the next read picks up where this one
+	// left off
+	huge := fh.inode.Attributes.Size >= uint64(atomic.LoadUint32(&fs.maxReadahead)) &&
+		!fh.columnar
+	var firstChunk uint32
+	if huge && fh.seqReadAmount == 0 {
+		firstChunk = READAHEAD_FIRST_CHUNK
+	}
+
+	if !fs.cheap() && (fh.seqReadAmount >= uint64(READAHEAD_CHUNK) || huge) &&
+		fh.numOOORead < 3 {
 		if fh.reader != nil {
 			fh.inode.logFuse("cutover to the parallel algorithm")
 			fh.reader.Close()
 			fh.reader = nil
 		}
 
-		err = fh.readAhead(uint64(offset), len(buf))
+		err = fh.readAhead(uint64(offset), firstChunk)
 		if err == nil {
 			bytesRead, err = fh.readFromReadAhead(uint64(offset), buf)
 			return
@@ -484,7 +639,7 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 			fh.inode.logFuse("not enough memory, fallback to serial read")
 			fh.seqReadAmount = 0
 			for _, b := range fh.buffers {
-				b.buf.Close()
+				b.Close()
 			}
 			fh.buffers = nil
 		}
@@ -498,18 +653,21 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 func (fh *FileHandle) Release() {
 	// read buffers
 	for _, b := range fh.buffers {
-		b.buf.Close()
+		b.Close()
 	}
 	fh.buffers = nil
 
 	if fh.reader != nil {
 		fh.reader.Close()
 	}
+	if fh.readCancel != nil {
+		fh.readCancel()
+	}
 
 	// write buffers
 	if fh.poolHandle != nil {
-		if fh.buf != nil && fh.buf.buffers != nil {
-			if fh.lastWriteError == nil {
+		if fh.buf != nil && !fh.buf.Freed() {
+			if fh.lastWriteError == nil && !fh.dirty {
 				panic("buf not freed but error is nil")
 			}
 
@@ -519,6 +677,10 @@ func (fh *FileHandle) Release() {
 		}
 	}
 
+	// never flushed
+	fh.inode.tenant().release(fh.reserved, false)
+	fh.reserved = 0
+
 	fh.inode.mu.Lock()
 	defer fh.inode.mu.Unlock()
 
@@ -545,8 +707,9 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 		cloud, key := fh.cloud()
 
 		resp, err := cloud.GetBlob(&GetBlobInput{
-			Key:   key,
-			Start: uint64(offset),
+			Key:     key,
+			Start:   uint64(offset),
+			Context: fh.readCtx,
 		})
 		if err != nil {
 			return bytesRead, err
@@ -569,31 +732,43 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 	return
 }
 
-func (fh *FileHandle) flushSmallFile() (err error) {
+func (fh *FileHandle) flushSmallFile(ctx context.Context) (err error) {
 	buf := fh.buf
-	fh.buf = nil
-
 	if buf == nil {
 		buf = MBuf{}.Init(fh.poolHandle, 0, true)
+		defer buf.Free()
 	}
 
-	defer buf.Free()
-
 	fs := fh.inode.fs
 
 	fs.replicators.Take(1, true)
 	defer fs.replicators.Return(1)
 
 	cloud, key := fh.cloud()
+	tenant := fh.inode.tenant()
 	resp, err := cloud.PutBlob(&PutBlobInput{
-		Key:         key,
-		Body:        buf,
-		Size:        PUInt64(uint64(buf.Len())),
-		ContentType: fs.flags.GetMimeType(*fh.inode.FullName()),
+		Key:          key,
+		Body:         buf,
+		Size:         PUInt64(uint64(buf.Len())),
+		ContentType:  fs.flags.GetMimeType(*fh.inode.FullName()),
+		StorageClass: tenant.storageClass(),
+		Tags:         tenant.tags(),
+		Context:      ctx,
 	})
 	if err != nil {
-		fh.lastWriteError = err
+		if err == syscall.EINTR {
+			// keep the data around so the next flush can try
+			// again
+			buf.Seek(0, 0)
+		} else {
+			fh.lastWriteError = err
+		}
 	} else {
+		if fh.buf != nil {
+			fh.buf.Free()
+			fh.buf = nil
+		}
+
 		inode := fh.inode
 		inode.mu.Lock()
 		defer inode.mu.Unlock()
@@ -616,7 +791,7 @@ func (fh *FileHandle) resetToKnownSize() {
 	}
 }
 
-func (fh *FileHandle) FlushFile() (err error) {
+func (fh *FileHandle) FlushFile(ctx context.Context) (err error) {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
@@ -633,7 +808,13 @@ func (fh *FileHandle) FlushFile() (err error) {
 	fs := fh.inode.fs
 
 	// abort mpu on error
+	interrupted := false
 	defer func() {
+		if interrupted {
+			// nothing was written, the next flush starts over
+			return
+		}
+
 		if err != nil {
 			if fh.mpuId != nil {
 				go func() {
@@ -657,10 +838,15 @@ func (fh *FileHandle) FlushFile() (err error) {
 		fh.writeInit = sync.Once{}
 		fh.nextWriteOffset = 0
 		fh.lastPartId = 0
+
+		fh.inode.tenant().release(fh.reserved, err == nil)
+		fh.reserved = 0
 	}()
 
 	if fh.lastPartId == 0 {
-		return fh.flushSmallFile()
+		err = fh.flushSmallFile(ctx)
+		interrupted = err == syscall.EINTR
+		return
 	}
 
 	fh.mpuWG.Wait()
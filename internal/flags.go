@@ -18,11 +18,13 @@ package internal
 import (
 	. "github.com/kahing/goofys/api/common"
 
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"text/tabwriter"
 	"text/template"
@@ -49,7 +51,8 @@ func init() {
 
 USAGE:
    {{.Name}} {{if .Flags}}[global options]{{end}} bucket[:prefix] mountpoint
-   {{if .Version}}
+   {{if .Commands}}{{.Name}} [global options] command [command options] [arguments...]
+   {{end}}   {{if .Version}}
 VERSION:
    {{.Version}}
    {{end}}{{if len .Authors}}
@@ -138,6 +141,19 @@ func NewApp() (app *cli.App) {
 				Usage: "GID owner of all inodes.",
 			},
 
+			cli.IntFlag{
+				Name:  "admin-uid",
+				Value: uid,
+				Usage: "UID allowed to change the user.goofys.* xattrs on the mount root, in addition to root.",
+			},
+
+			cli.StringFlag{
+				Name: "tenants",
+				Usage: "JSON file declaring prefixes to serve as tenants, each with its own " +
+					"uid, gid, quota, storage class and tags. A tenant with a uid can only be " +
+					"opened or changed by that uid, root and --admin-uid.",
+			},
+
 			/////////////////////////
 			// S3
 			/////////////////////////
@@ -199,6 +215,25 @@ func NewApp() (app *cli.App) {
 				Value: "",
 			},
 
+			cli.DurationFlag{
+				Name: "scoped-session",
+				Usage: "Mount with temporary credentials that only allow access to bucket[:prefix] " +
+					"and last this long (at least 15m), then flush and unmount (default: off)",
+			},
+
+			cli.StringFlag{
+				Name: "scoped-session-role",
+				Usage: "Role to assume for --scoped-session. Without it the credentials come from " +
+					"GetFederationToken, which needs the credentials of an IAM user",
+			},
+
+			cli.StringFlag{
+				Name: "sse-c-keyring",
+				Usage: "Enable server-side encryption using the user key with this `description` " +
+					"in the kernel keyring, instantiated by request-key(8) if needed. The key is never " +
+					"written anywhere and its description is recorded on the objects (default: off)",
+			},
+
 			/// http://docs.aws.amazon.com/AmazonS3/latest/dev/acl-overview.html#canned-acl
 			cli.StringFlag{
 				Name:  "acl",
@@ -211,6 +246,74 @@ func NewApp() (app *cli.App) {
 				Usage: "Enable subdomain mode of S3",
 			},
 
+			cli.BoolFlag{
+				Name: "ensure-bucket",
+				Usage: "Create the bucket in --region if it doesn't exist, with" +
+					" --sse/--sse-kms as the default encryption (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name:  "bucket-versioning",
+				Usage: "Enable versioning on buckets created by --ensure-bucket (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name:  "block-public-access",
+				Usage: "Block all public access to buckets created by --ensure-bucket (default: off)",
+			},
+
+			cli.StringFlag{
+				Name: "signing-region",
+				Usage: "Sign requests for this region instead of the bucket's, for endpoints" +
+					" that are in a different region (default: same as --region)",
+			},
+
+			cli.BoolFlag{
+				Name: "sigv4a",
+				Usage: "Sign requests with SigV4A, required by multi-region access points." +
+					" --signing-region can be a comma separated list of regions (default: all)",
+			},
+
+			cli.StringFlag{
+				Name:   "proxy",
+				EnvVar: "GOOFYS_PROXY",
+				Usage: "Send S3 requests through this proxy instead of the one in $HTTPS_PROXY." +
+					" Possible values: http://[user:password@]host:port, https://..., socks5://...",
+			},
+
+			cli.StringFlag{
+				Name:   "no-proxy",
+				EnvVar: "GOOFYS_NO_PROXY",
+				Usage: "Comma separated list of hosts, domains (.example.com), IPs or CIDRs " +
+					"that should bypass --proxy or $HTTPS_PROXY",
+			},
+
+			cli.StringFlag{
+				Name:  "ca-bundle",
+				Usage: "PEM file with additional CA certificates to trust when connecting to --endpoint",
+			},
+
+			cli.StringFlag{
+				Name:  "client-cert",
+				Usage: "PEM file with the client certificate to present to --endpoint (requires --client-key)",
+			},
+
+			cli.StringFlag{
+				Name:  "client-key",
+				Usage: "PEM file with the private key for --client-cert",
+			},
+
+			cli.StringSliceFlag{
+				Name: "endpoint-fallback",
+				Usage: "Other host:port serving the same --endpoint, connections fail " +
+					"over to them when the endpoint is unreachable. Can be repeated",
+			},
+
+			cli.DurationFlag{
+				Name:  "dns-cache-ttl",
+				Usage: "How long to cache DNS lookups of the endpoint (default: off)",
+			},
+
 			/////////////////////////
 			// Tuning
 			/////////////////////////
@@ -231,18 +334,106 @@ func NewApp() (app *cli.App) {
 				Usage: "How long to cache StatObject results and inode attributes.",
 			},
 
+			cli.BoolFlag{
+				Name: "use-cache-control",
+				Usage: "Cache attributes of objects with Cache-Control or Expires headers " +
+					"for as long as those allow instead of --stat-cache-ttl (default: off)",
+			},
+
 			cli.DurationFlag{
 				Name:  "type-cache-ttl",
 				Value: time.Minute,
 				Usage: "How long to cache name -> file/dir mappings in directory " +
 					"inodes.",
 			},
+			cli.StringFlag{
+				Name: "errno-map",
+				Usage: "Change the errno backend errors turn into, as CLASS=ERRNO,... Classes and defaults: " +
+					"invalid=EINVAL denied=EACCES throttled=EAGAIN server=EAGAIN locked=EPERM " +
+					"kms-denied, kms-disabled (EKEYREJECTED, EKEYREVOKED on Linux, EAUTH on macOS) kms-throttled=EAGAIN",
+			},
+			cli.StringFlag{
+				Name: "shard-prefixes",
+				Usage: "Spread the objects over these comma separated prefixes by the hash of " +
+					"their keys, to go past the request rate S3 allows per prefix. All writers " +
+					"of the bucket must use the same list, in the same order",
+			},
+			cli.BoolFlag{
+				Name: "minio-notify",
+				Usage: "Listen to the bucket notifications of a MinIO --endpoint and " +
+					"forget the cached state of the objects that change (default: off)",
+			},
 			cli.DurationFlag{
 				Name:  "http-timeout",
 				Value: 30 * time.Second,
 				Usage: "Set the timeout on HTTP requests to S3",
 			},
 
+			cli.DurationFlag{
+				Name:  "multipart-age",
+				Value: 48 * time.Hour,
+				Usage: "Abort incomplete multipart uploads under the prefix that are older than this.",
+			},
+
+			cli.IntFlag{
+				Name:  "max-requests",
+				Usage: "Maximum number of concurrent requests, shared fairly between mounts (default: unlimited)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-bandwidth",
+				Usage: "Maximum bandwidth in MB/s, shared fairly between mounts (default: unlimited)",
+			},
+
+			cli.StringFlag{
+				Name: "mount-weights",
+				Usage: "Comma separated PATH=WEIGHT of how --max-requests and --max-bandwidth " +
+					"are shared between the mounts, \"/\" being the root (default: 1 for every mount)",
+			},
+
+			cli.DurationFlag{
+				Name: "multipart-expire-interval",
+				Usage: "How often to look for incomplete multipart uploads to abort " +
+					"(default: only at mount time)",
+			},
+
+			cli.DurationFlag{
+				Name:  "drain-timeout",
+				Value: 30 * time.Second,
+				Usage: "On SIGTERM, stop accepting new writes and take up to this long to upload the files being written before unmounting",
+			},
+
+			cli.StringFlag{
+				Name: "spill-dir",
+				Usage: "When the memory for write buffers runs out, buffer writes in temporary " +
+					"files here instead of waiting for uploads to finish (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "spill-size",
+				Value: 1024,
+				Usage: "How much of --spill-dir to use at most, in MB",
+			},
+
+			cli.IntFlag{
+				Name: "footer-cache",
+				Usage: "Memory in MB for the footers of Parquet and ORC files, which are read by " +
+					"every task before it jumps to the columns it needs. It comes out of the " +
+					"memory for read and write buffers (default: off)",
+			},
+
+			cli.DurationFlag{
+				Name: "startup-burst",
+				Usage: "For this long after mounting, look up and list in parallel even with --cheap " +
+					"and raise --max-requests and readahead, stepping back down over time (default: off)",
+			},
+
+			cli.Float64Flag{
+				Name:  "startup-burst-factor",
+				Value: 4,
+				Usage: "How many times --max-requests and readahead are raised at the start of --startup-burst",
+			},
+
 			/////////////////////////
 			// Debugging
 			/////////////////////////
@@ -261,9 +452,100 @@ func NewApp() (app *cli.App) {
 				Name:  "f",
 				Usage: "Run goofys in foreground.",
 			},
+
+			cli.BoolFlag{
+				Name: "check-permissions",
+				Usage: "Try list, get, put, delete and multipart upload under the prefix " +
+					"at mount time and report which permissions are missing.",
+			},
+
+			cli.BoolFlag{
+				Name:  "stats-dir",
+				Usage: "Expose the mount's stats and cache state as files under /.goofys/",
+			},
+
+			cli.BoolFlag{
+				Name: "standby",
+				Usage: "Keep the caches warm and wait for whatever is mounted on the mountpoint " +
+					"to go away, then mount. Use to take over from a primary goofys when it dies. " +
+					"Without -f, goofys only returns once it has mounted",
+			},
+
+			cli.IntFlag{
+				Name:  "standby-warm-depth",
+				Value: 2,
+				Usage: "How many levels of directories a --standby lists to warm its caches",
+			},
+
+			cli.StringFlag{
+				Name:  "trace",
+				Usage: "Record the file system operations to this file, to be run again with `goofys replay'",
+			},
+
+			cli.BoolFlag{
+				Name:  "trace-anonymize",
+				Usage: "Replace the file names in --trace with a hash of them",
+			},
+
+			cli.Float64Flag{
+				Name: "cost-budget",
+				Usage: "Warn when the S3 requests and transfers of the mount are estimated to cost " +
+					"more than this many dollars in a day (UTC), and fire the budget-exceeded hook (default: off)",
+			},
+
+			cli.StringFlag{
+				Name:  "cost-prices",
+				Value: "put=0.005,get=0.0004,in=0,out=0",
+				Usage: "Prices for --cost-budget in dollars: put (PUT, COPY, POST, LIST) and get (GET, HEAD) are per 1000 requests, in and out are per GB",
+			},
+
+			cli.StringFlag{
+				Name: "hook-exec",
+				Usage: "Run this shell command when something happens to the mount, with " +
+					"GOOFYS_EVENT, GOOFYS_DETAIL, GOOFYS_BUCKET and GOOFYS_MOUNTPOINT set",
+			},
+
+			cli.StringFlag{
+				Name:  "hook-webhook",
+				Usage: "POST the events as JSON to this URL",
+			},
+
+			cli.StringFlag{
+				Name:  "hook-events",
+				Value: "all",
+				Usage: "Comma separated events to run the hooks on: " + strings.Join(hookEvents, ", "),
+			},
+
+			cli.Float64Flag{
+				Name: "chaos-error-rate",
+				Usage: "TESTING ONLY. Percentage of the file system operations to fail with EIO, " +
+					"to see how applications cope with an unreliable object store",
+			},
+
+			cli.Float64Flag{
+				Name:  "chaos-delay-rate",
+				Usage: "TESTING ONLY. Percentage of the file system operations to delay by up to --chaos-delay",
+			},
+
+			cli.DurationFlag{
+				Name:  "chaos-delay",
+				Value: time.Second,
+				Usage: "TESTING ONLY. Longest delay of --chaos-delay-rate",
+			},
 		},
 	}
 
+	app.Commands = []cli.Command{
+		lifecycleCommand,
+		bulkCommand,
+		syncCommand,
+		publishCommand,
+		copyCommand,
+		debugCommand,
+		benchCommand,
+		replayCommand,
+	}
+
 	var funcMap = template.FuncMap{
 		"category": filterCategory,
 		"join":     strings.Join,
@@ -271,22 +553,30 @@ func NewApp() (app *cli.App) {
 
 	flagCategories = map[string]string{}
 
-	for _, f := range []string{"region", "sse", "sse-kms", "sse-c", "storage-class", "acl", "requester-pays"} {
+	for _, f := range []string{"region", "sse", "sse-kms", "sse-c", "sse-c-keyring", "storage-class", "acl", "requester-pays",
+		"proxy", "no-proxy", "ca-bundle", "client-cert", "client-key", "endpoint-fallback",
+		"signing-region", "sigv4a", "ensure-bucket", "bucket-versioning", "block-public-access",
+		"scoped-session", "scoped-session-role"} {
 		flagCategories[f] = "aws"
 	}
 
-	for _, f := range []string{"cheap", "no-implicit-dir", "stat-cache-ttl", "type-cache-ttl", "http-timeout"} {
+	for _, f := range []string{"cheap", "no-implicit-dir", "stat-cache-ttl", "use-cache-control", "type-cache-ttl", "errno-map", "shard-prefixes", "minio-notify", "http-timeout", "dns-cache-ttl",
+		"multipart-age", "multipart-expire-interval", "max-requests", "max-bandwidth", "mount-weights",
+		"drain-timeout", "spill-dir", "spill-size", "footer-cache", "startup-burst", "startup-burst-factor"} {
 		flagCategories[f] = "tuning"
 	}
 
-	for _, f := range []string{"help, h", "debug_fuse", "debug_s3", "version, v", "f"} {
+	for _, f := range []string{"help, h", "debug_fuse", "debug_s3", "version, v", "f", "check-permissions",
+		"stats-dir", "standby", "standby-warm-depth", "trace", "trace-anonymize",
+		"cost-budget", "cost-prices", "hook-exec", "hook-webhook", "hook-events",
+		"chaos-error-rate", "chaos-delay-rate", "chaos-delay"} {
 		flagCategories[f] = "misc"
 	}
 
 	cli.HelpPrinter = func(w io.Writer, templ string, data interface{}) {
 		w = tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
 		var tmplGet = template.Must(template.New("help").Funcs(funcMap).Parse(templ))
-		tmplGet.Execute(w, app)
+		tmplGet.Execute(w, data)
 	}
 
 	return
@@ -315,16 +605,21 @@ func parseOptions(m map[string]string, s string) {
 	return
 }
 
-// PopulateFlags adds the flags accepted by run to the supplied flag set, returning the
-// variables into which the flags will parse.
-func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
-	flags := &FlagStorage{
+// PopulateBackendFlags parses the flags that don't depend on having a
+// mountpoint, so they can also be used by the subcommands.
+func PopulateBackendFlags(c *cli.Context) (flags *FlagStorage) {
+	flags = &FlagStorage{
 		// File system
 		MountOptions: make(map[string]string),
 		DirMode:      os.FileMode(c.Int("dir-mode")),
 		FileMode:     os.FileMode(c.Int("file-mode")),
 		Uid:          uint32(c.Int("uid")),
 		Gid:          uint32(c.Int("gid")),
+		AdminUid:     uint32(c.Int("admin-uid")),
+		Tenants:      c.String("tenants"),
+
+		ScopedSession:     c.Duration("scoped-session"),
+		ScopedSessionRole: c.String("scoped-session-role"),
 
 		// Tuning,
 		Cheap:        c.Bool("cheap"),
@@ -333,6 +628,23 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		TypeCacheTTL: c.Duration("type-cache-ttl"),
 		HTTPTimeout:  c.Duration("http-timeout"),
 
+		UseCacheControl: c.Bool("use-cache-control"),
+		MinioNotify:     c.Bool("minio-notify"),
+		ErrnoMap:        c.String("errno-map"),
+		ShardPrefixes:   c.String("shard-prefixes"),
+
+		MultipartAge:            c.Duration("multipart-age"),
+		MultipartExpireInterval: c.Duration("multipart-expire-interval"),
+		MaxRequests:             uint32(c.Int("max-requests")),
+		MaxBandwidth:            uint64(c.Int("max-bandwidth")) * 1024 * 1024,
+		MountWeights:            c.String("mount-weights"),
+		DrainTimeout:            c.Duration("drain-timeout"),
+		SpillDir:                c.String("spill-dir"),
+		SpillSize:               uint64(c.Int("spill-size")) * 1024 * 1024,
+		FooterCache:             uint64(c.Int("footer-cache")) * 1024 * 1024,
+		StartupBurst:            c.Duration("startup-burst"),
+		StartupBurstFactor:      c.Float64("startup-burst-factor"),
+
 		// Common Backend Config
 		Endpoint:       c.String("endpoint"),
 		UseContentType: c.Bool("use-content-type"),
@@ -341,12 +653,38 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		DebugFuse:  c.Bool("debug_fuse"),
 		DebugS3:    c.Bool("debug_s3"),
 		Foreground: c.Bool("f"),
+
+		CheckPermissions: c.Bool("check-permissions"),
+		StatsDir:         c.Bool("stats-dir"),
+
+		Standby:          c.Bool("standby"),
+		StandbyWarmDepth: c.Int("standby-warm-depth"),
+
+		Trace:          c.String("trace"),
+		TraceAnonymize: c.Bool("trace-anonymize"),
+
+		CostBudget: c.Float64("cost-budget"),
+		CostPrices: c.String("cost-prices"),
+
+		HookExec:    c.String("hook-exec"),
+		HookWebhook: c.String("hook-webhook"),
+		HookEvents:  c.String("hook-events"),
+
+		ChaosErrorRate: c.Float64("chaos-error-rate"),
+		ChaosDelayRate: c.Float64("chaos-delay-rate"),
+		ChaosDelay:     c.Duration("chaos-delay"),
 	}
 
 	// S3
 	if c.IsSet("region") || c.IsSet("requester-pays") || c.IsSet("storage-class") ||
 		c.IsSet("profile") || c.IsSet("sse") || c.IsSet("sse-kms") ||
-		c.IsSet("sse-c") || c.IsSet("acl") || c.IsSet("subdomain") {
+		c.IsSet("sse-c") || c.IsSet("sse-c-keyring") || c.IsSet("acl") || c.IsSet("subdomain") ||
+		c.IsSet("proxy") || c.IsSet("no-proxy") || c.IsSet("ca-bundle") ||
+		c.IsSet("client-cert") || c.IsSet("client-key") ||
+		c.IsSet("endpoint-fallback") || c.IsSet("dns-cache-ttl") ||
+		c.IsSet("signing-region") || c.IsSet("sigv4a") ||
+		c.IsSet("ensure-bucket") || c.IsSet("bucket-versioning") ||
+		c.IsSet("block-public-access") {
 
 		if flags.Backend == nil {
 			flags.Backend = (&S3Config{}).Init()
@@ -362,8 +700,21 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		config.UseKMS = c.IsSet("sse-kms")
 		config.KMSKeyID = c.String("sse-kms")
 		config.SseC = c.String("sse-c")
+		config.SseCKeyId = c.String("sse-c-keyring")
 		config.ACL = c.String("acl")
 		config.Subdomain = c.Bool("subdomain")
+		config.Proxy = c.String("proxy")
+		config.NoProxy = c.String("no-proxy")
+		config.CABundle = c.String("ca-bundle")
+		config.ClientCert = c.String("client-cert")
+		config.ClientKey = c.String("client-key")
+		config.EndpointFallback = c.StringSlice("endpoint-fallback")
+		config.DNSCacheTTL = c.Duration("dns-cache-ttl")
+		config.SigningRegion = c.String("signing-region")
+		config.SigV4A = c.Bool("sigv4a")
+		config.EnsureBucket = c.Bool("ensure-bucket")
+		config.BucketVersioning = c.Bool("bucket-versioning")
+		config.BlockPublicAccess = c.Bool("block-public-access")
 
 		// KMS implies SSE
 		if config.UseKMS {
@@ -371,6 +722,108 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 		}
 	}
 
+	return
+}
+
+// DefaultFlags returns the flags of a mount when nothing is given on
+// the command line, for programs that mount without it
+func DefaultFlags() *FlagStorage {
+	app := NewApp()
+	set := flag.NewFlagSet(app.Name, flag.ContinueOnError)
+	for _, f := range app.Flags {
+		f.Apply(set)
+	}
+	return PopulateBackendFlags(cli.NewContext(app, set, nil))
+}
+
+// flagError is an invalid flag value, worded like the errors of
+// PopulateFlags
+type flagError struct {
+	name  string
+	value interface{}
+	err   error
+}
+
+func (e flagError) Error() string {
+	return fmt.Sprintf("Invalid value \"%v\" for --%v: %v", e.value, e.name, e.err)
+}
+
+// ValidateFlags checks the flags that can't be checked one at a time
+// by the command line parser, for both the command line and programs
+// that fill in FlagStorage themselves
+func ValidateFlags(flags *FlagStorage) error {
+	for _, f := range []struct {
+		name string
+		rate float64
+	}{
+		{"chaos-error-rate", flags.ChaosErrorRate},
+		{"chaos-delay-rate", flags.ChaosDelayRate},
+	} {
+		if f.rate < 0 || f.rate > 100 {
+			return flagError{f.name, f.rate, fmt.Errorf("must be between 0 and 100")}
+		}
+	}
+
+	if flags.SpillDir != "" {
+		fi, err := os.Stat(flags.SpillDir)
+		if err == nil && !fi.IsDir() {
+			err = fmt.Errorf("not a directory")
+		}
+		if err != nil {
+			return flagError{"spill-dir", flags.SpillDir, err}
+		}
+	}
+
+	if flags.StartupBurstFactor < 1 {
+		return flagError{"startup-burst-factor", flags.StartupBurstFactor,
+			fmt.Errorf("must be at least 1")}
+	}
+
+	if flags.ErrnoMap != "" {
+		if _, err := parseErrnoMap(flags.ErrnoMap); err != nil {
+			return flagError{"errno-map", flags.ErrnoMap, err}
+		}
+	}
+
+	if _, err := parseHookEvents(flags.HookEvents); err != nil {
+		return flagError{"hook-events", flags.HookEvents, err}
+	}
+
+	if flags.CostBudget != 0 {
+		if _, err := parseCostPrices(flags.CostPrices); err != nil {
+			return flagError{"cost-prices", flags.CostPrices, err}
+		}
+	}
+
+	if flags.ShardPrefixes != "" {
+		if _, err := parseShardPrefixes(flags.ShardPrefixes); err != nil {
+			return flagError{"shard-prefixes", flags.ShardPrefixes, err}
+		}
+	}
+
+	if flags.MountWeights != "" {
+		if _, err := parseMountWeights(flags.MountWeights); err != nil {
+			return flagError{"mount-weights", flags.MountWeights, err}
+		}
+	}
+
+	if config, ok := flags.Backend.(*S3Config); ok && config.SseCKeyId != "" && config.SseC != "" {
+		return flagError{"sse-c-keyring", config.SseCKeyId, fmt.Errorf("conflicts with --sse-c")}
+	}
+
+	if flags.ScopedSession != 0 && flags.ScopedSession < 15*time.Minute {
+		return flagError{"scoped-session", flags.ScopedSession,
+			fmt.Errorf("must be at least 15m")}
+	}
+
+	return nil
+}
+
+// PopulateFlags adds the flags accepted by run to the supplied flag set, returning the
+// variables into which the flags will parse.
+func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
+	flags := PopulateBackendFlags(c)
+
 	// Handle the repeated "-o" flag.
 	for _, o := range c.StringSlice("o") {
 		parseOptions(flags.MountOptions, o)
@@ -380,6 +833,48 @@ func PopulateFlags(c *cli.Context) (ret *FlagStorage) {
 	flags.MountPoint = flags.MountPointArg
 	var err error
 
+	if flags.SpillDir != "" {
+		// we may chdir when we daemonize
+		flags.SpillDir, err = filepath.Abs(flags.SpillDir)
+		if err != nil {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --spill-dir: %v\n\n",
+					c.String("spill-dir"), err))
+			return nil
+		}
+	}
+
+	err = ValidateFlags(flags)
+	if err != nil {
+		io.WriteString(cli.ErrWriter, err.Error()+"\n\n")
+		return nil
+	}
+
+	if flags.Tenants != "" {
+		// we may chdir when we daemonize
+		flags.Tenants, err = filepath.Abs(flags.Tenants)
+		if err == nil {
+			_, err = loadTenants(flags.Tenants)
+		}
+		if err != nil {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --tenants: %v\n\n",
+					c.String("tenants"), err))
+			return nil
+		}
+	}
+
+	if flags.Trace != "" {
+		// we may chdir when we daemonize
+		flags.Trace, err = filepath.Abs(flags.Trace)
+		if err != nil {
+			io.WriteString(cli.ErrWriter,
+				fmt.Sprintf("Invalid value \"%v\" for --trace: %v\n\n",
+					c.String("trace"), err))
+			return nil
+		}
+	}
+
 	defer func() {
 		if err != nil {
 			flags.Cleanup()
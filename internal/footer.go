@@ -0,0 +1,244 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"container/list"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Parquet and ORC readers start with the footer at the end of the
+// file, which says where the column chunks are, and then jump
+// between the chunks they need. Every task of a Spark job reading the
+// same file reads the footer again, so we keep the tails of these
+// files and serve them without going to S3. Only tails that end the
+// way Parquet and ORC files do are kept.
+
+// how much of the end of a file we fetch and keep
+const FOOTER_SIZE = uint64(1024 * 1024)
+
+// a first read this close to the end is a footer read, even if the
+// name doesn't say it's a columnar file
+const FOOTER_PROBE = uint64(64 * 1024)
+
+var columnarSuffixes = []string{".parquet", ".orc"}
+
+var (
+	footerHits   = NewCounter("footer.hits")
+	footerMisses = NewCounter("footer.misses")
+)
+
+// hasFooterSignature reports whether tail is the end of a Parquet
+// file, which ends with its magic, or of an ORC file, where the magic
+// ends the postscript and is followed by the length of the postscript
+func hasFooterSignature(tail []byte) bool {
+	n := len(tail)
+	if n < 4 {
+		return false
+	}
+	return string(tail[n-4:]) == "PAR1" || string(tail[n-4:n-1]) == "ORC"
+}
+
+func isColumnar(name string) bool {
+	for _, s := range columnarSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type footer struct {
+	id fuseops.InodeID
+	// the version of the file this is the tail of
+	etag string
+	size uint64
+
+	offset uint64
+	data   []byte
+}
+
+// footerCache holds footers up to max bytes in total, evicting the
+// least recently used. What it holds is taken from the buffer pool a
+// buffer at a time, so it also evicts to leave the pool to the reads
+// and writes
+type footerCache struct {
+	max  uint64
+	pool *BufferPool
+
+	mu      sync.Mutex
+	used    uint64
+	buffers uint64 // reserved from pool
+	lru     *list.List
+	entries map[fuseops.InodeID]*list.Element
+}
+
+func newFooterCache(max uint64, pool *BufferPool) *footerCache {
+	return &footerCache{
+		max:     max,
+		pool:    pool,
+		lru:     list.New(),
+		entries: make(map[fuseops.InodeID]*list.Element),
+	}
+}
+
+func (c *footerCache) get(id fuseops.InodeID, etag string, size uint64) *footer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	f := e.Value.(*footer)
+	if f.etag != etag || f.size != size {
+		// the file has changed
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return f
+}
+
+func (c *footerCache) add(f *footer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[f.id]; ok {
+		c.remove(e)
+	}
+	if uint64(len(f.data)) > c.max {
+		return
+	}
+	for c.used+uint64(len(f.data)) > c.max {
+		c.remove(c.lru.Back())
+	}
+	for uint64(pages(c.used+uint64(len(f.data)), BUF_SIZE)) > c.buffers {
+		if c.pool.reserve(1) {
+			c.buffers++
+		} else if c.lru.Len() != 0 {
+			c.remove(c.lru.Back())
+		} else {
+			// the pool is full
+			return
+		}
+	}
+	c.entries[f.id] = c.lru.PushFront(f)
+	c.used += uint64(len(f.data))
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *footerCache) remove(e *list.Element) {
+	f := c.lru.Remove(e).(*footer)
+	delete(c.entries, f.id)
+	c.used -= uint64(len(f.data))
+
+	if n := uint64(pages(c.used, BUF_SIZE)); n < c.buffers {
+		c.pool.unreserve(c.buffers - n)
+		c.buffers = n
+	}
+}
+
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) detectColumnar(offset uint64) {
+	if fh.readStarted {
+		return
+	}
+	fh.readStarted = true
+
+	size := fh.inode.Attributes.Size
+	fh.columnar = isColumnar(*fh.inode.Name) ||
+		size > FOOTER_PROBE && offset >= size-FOOTER_PROBE
+	if fh.columnar {
+		fh.inode.logFuse("columnar read", offset)
+	}
+}
+
+// readFooter serves reads in the tail of a columnar file from the
+// footer cache, fetching the tail first if it's not there. It reads
+// nothing if this is not a footer read and the caller carries on as
+// usual.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) readFooter(offset uint64, buf []byte) (bytesRead int, err error) {
+	fs := fh.inode.fs
+	if fs.footers == nil || !fh.columnar || fh.dirty {
+		return
+	}
+
+	fh.inode.mu.Lock()
+	etag := string(fh.inode.s3Metadata["etag"])
+	size := fh.inode.Attributes.Size
+	fh.inode.mu.Unlock()
+
+	if etag == "" {
+		// not uploaded yet
+		return
+	}
+	start := size - MinUInt64(size, FOOTER_SIZE)
+	if offset < start || offset >= size {
+		return
+	}
+
+	f := fs.footers.get(fh.inode.Id, etag, size)
+	if f == nil {
+		footerMisses.Inc()
+		cloud, key := fh.cloud()
+		resp, err := cloud.GetBlob(&GetBlobInput{
+			Key:     key,
+			Start:   start,
+			Count:   size - start,
+			IfMatch: &etag,
+			Context: fh.readCtx,
+		})
+		if err != nil {
+			return 0, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+		if uint64(len(data)) != size-start {
+			// changed behind our back, read it the usual way
+			return 0, nil
+		}
+
+		f = &footer{
+			id:     fh.inode.Id,
+			etag:   etag,
+			size:   size,
+			offset: start,
+			data:   data,
+		}
+		if hasFooterSignature(data) {
+			fs.footers.add(f)
+		} else {
+			// not Parquet or ORC after all, this read is
+			// served but the next ones are not footer reads
+			fh.columnar = false
+		}
+	} else {
+		footerHits.Inc()
+	}
+
+	bytesRead = copy(buf, f.data[offset-f.offset:])
+	fh.inode.logFuse("< readFooter", offset, bytesRead)
+	return
+}
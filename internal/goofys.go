@@ -24,10 +24,12 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -57,6 +59,10 @@ type Goofys struct {
 	rootAttrs InodeAttributes
 
 	bufferPool *BufferPool
+	// nil unless --spill-dir
+	spill *spillPool
+	// nil unless --footer-cache
+	footers *footerCache
 
 	// A lock protecting the state of the file system struct itself (distinct
 	// from per-inode locks). Make sure to see the notes on lock ordering above.
@@ -88,6 +94,36 @@ type Goofys struct {
 	replicators *Ticket
 	restorers   *Ticket
 
+	// shares MaxRequests and MaxBandwidth between the mounts
+	scheduler *Scheduler
+	// scheduler weight of each mount by path, see --mount-weights
+	mountWeights map[string]uint32
+
+	// can be changed at runtime, see knobs.go
+	maxReadahead uint32
+	statCacheTTL int64 // time.Duration
+	typeCacheTTL int64 // time.Duration
+
+	// set during the startup burst, see burst.go
+	bursting int32
+
+	// set on shutdown, see drain.go
+	draining int32
+
+	// for the cache TTLs, see clock.go
+	clock Clock
+
+	// what the backend errors turn into, see --errno-map
+	errnos errnoMap
+
+	// nil unless --hook-exec or --hook-webhook, see hooks.go
+	hooks *hookSet
+
+	// canceled by Destroy once we are unmounted, for what runs in
+	// the background for as long as we are mounted
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	forgotCnt uint32
 }
 
@@ -114,6 +150,17 @@ func NewBackend(bucket string, flags *FlagStorage) (cloud StorageBackend, err er
 		err = fmt.Errorf("Unknown backend config: %T", flags.Backend)
 	}
 
+	if err == nil && flags.ShardPrefixes != "" {
+		if _, ok := flags.Backend.(*S3Config); !ok {
+			return nil, fmt.Errorf("--shard-prefixes is only supported on S3")
+		}
+		var shards []string
+		shards, err = parseShardPrefixes(flags.ShardPrefixes)
+		if err != nil {
+			return nil, err
+		}
+		cloud = NewShardedBackend(cloud, shards)
+	}
 	return
 }
 
@@ -164,7 +211,10 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 		bucket: bucket,
 		flags:  flags,
 		umask:  0122,
+		clock:  systemClock{},
+		errnos: defaultErrnos,
 	}
+	fs.ctx, fs.cancel = context.WithCancel(ctx)
 
 	var prefix string
 	colon := strings.Index(bucket, ":")
@@ -183,12 +233,40 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 		s3Log.Level = logrus.DebugLevel
 	}
 
+	if flags.ErrnoMap != "" {
+		m, err := parseErrnoMap(flags.ErrnoMap)
+		if err != nil {
+			log.Errorf("Invalid --errno-map: %v", err)
+			return nil
+		}
+		fs.errnos = m
+	}
+
+	if flags.HookExec != "" || flags.HookWebhook != "" {
+		h, err := newHookSet(flags, bucket)
+		if err != nil {
+			log.Errorf("Invalid --hook-events: %v", err)
+			return nil
+		}
+		fs.hooks = h
+	}
+
 	cloud, err := NewBackend(bucket, flags)
 	if err != nil {
 		log.Errorf("Unable to setup backend: %v", err)
 		return nil
 	}
 	_, fs.gcs = cloud.(*GCS3)
+	fs.hooks.watch(cloud)
+
+	var sessionExpires time.Time
+	if flags.ScopedSession != 0 {
+		sessionExpires, err = scopeSession(cloud, prefix, flags.ScopedSession, flags.ScopedSessionRole)
+		if err != nil {
+			log.Errorf("Unable to get scoped credentials for '%v': %v", bucket, err)
+			return nil
+		}
+	}
 
 	randomObjectName := prefix + (RandStringBytesMaskImprSrc(32))
 	err = cloud.Init(randomObjectName)
@@ -196,7 +274,43 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 		log.Errorf("Unable to access '%v': %v", bucket, err)
 		return nil
 	}
-	go cloud.MultipartExpire(&MultipartExpireInput{})
+
+	if flags.CheckPermissions {
+		missing := 0
+		for _, c := range CheckPermissions(cloud, prefix) {
+			if c.Err == nil {
+				log.Infof("permission check: %v", c)
+			} else {
+				log.Errorf("permission check: %v", c)
+				if c.Missing() {
+					missing++
+				}
+			}
+		}
+		if missing != 0 {
+			log.Errorf("%v permission(s) missing on '%v'", missing, bucket+":"+prefix)
+		}
+	}
+
+	if flags.MaxRequests != 0 || flags.MaxBandwidth != 0 {
+		fs.scheduler = Scheduler{
+			Requests:  flags.MaxRequests,
+			Bandwidth: flags.MaxBandwidth,
+		}.Init()
+		if flags.MountWeights != "" {
+			fs.mountWeights, err = parseMountWeights(flags.MountWeights)
+			if err != nil {
+				log.Errorf("Invalid --mount-weights: %v", err)
+				return nil
+			}
+		}
+		cloud = fs.Scheduled(cloud, fs.mountWeight(""))
+	}
+
+	go fs.expireMultipart(cloud, prefix)
+	if !sessionExpires.IsZero() {
+		go fs.expireSession(sessionExpires)
+	}
 
 	now := time.Now()
 	fs.rootAttrs = InodeAttributes{
@@ -205,6 +319,15 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 	}
 
 	fs.bufferPool = BufferPool{}.Init()
+	if flags.SpillDir != "" {
+		fs.spill = newSpillPool(flags.SpillDir, flags.SpillSize)
+	}
+	if flags.FooterCache != 0 {
+		fs.footers = newFooterCache(flags.FooterCache, fs.bufferPool)
+	}
+	fs.maxReadahead = MAX_READAHEAD
+	fs.statCacheTTL = int64(flags.StatCacheTTL)
+	fs.typeCacheTTL = int64(flags.TypeCacheTTL)
 
 	fs.nextInodeID = fuseops.RootInodeID + 1
 	fs.inodes = make(map[fuseops.InodeID]*Inode)
@@ -226,9 +349,65 @@ func NewGoofys(ctx context.Context, bucket string, flags *FlagStorage) *Goofys {
 	fs.replicators = Ticket{Total: 16}.Init()
 	fs.restorers = Ticket{Total: 20}.Init()
 
+	if flags.StatsDir {
+		fs.mount(root, &Mount{name: STATS_DIR, cloud: NewStatsBackend(fs)})
+	}
+
+	if flags.Tenants != "" {
+		tenants, err := loadTenants(flags.Tenants)
+		if err != nil {
+			log.Errorf("Unable to load tenants from %v: %v", flags.Tenants, err)
+			return nil
+		}
+		fs.mountTenants(root, cloud, prefix, tenants)
+	}
+
+	if flags.CostBudget != 0 {
+		prices, err := parseCostPrices(flags.CostPrices)
+		if err != nil {
+			log.Errorf("Invalid --cost-prices: %v", err)
+			return nil
+		}
+		go newCostTracker(fs, prices, flags.CostBudget).run()
+	}
+
+	if flags.MinioNotify {
+		if s := s3Backend(cloud); s != nil && !s.aws {
+			go fs.listenMinio(cloud, prefix)
+		} else {
+			log.Warnf("--minio-notify is only supported on MinIO")
+		}
+	}
+
 	return fs
 }
 
+// expireMultipart aborts the incomplete multipart uploads under
+// prefix that crashed writers left behind, once at mount time and
+// then every MultipartExpireInterval if set
+func (fs *Goofys) expireMultipart(cloud StorageBackend, prefix string) {
+	for {
+		_, err := cloud.MultipartExpire(&MultipartExpireInput{
+			Prefix: prefix,
+			Age:    fs.flags.MultipartAge,
+		})
+		if err == syscall.ENOTSUP {
+			return
+		} else if err != nil {
+			log.Warnf("Unable to expire multipart uploads under %v: %v", prefix, err)
+		}
+
+		if fs.flags.MultipartExpireInterval == 0 {
+			return
+		}
+		select {
+		case <-fs.ctx.Done():
+			return
+		case <-time.After(fs.flags.MultipartExpireInterval):
+		}
+	}
+}
+
 // from https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-golang
 func RandStringBytesMaskImprSrc(n int) string {
 	const letterBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
@@ -261,9 +440,19 @@ func (fs *Goofys) SigUsr1() {
 	log.Infof("forgot %v inodes", fs.forgotCnt)
 	log.Infof("%v inodes", len(fs.inodes))
 	fs.mu.RUnlock()
+
+	for _, c := range Counters() {
+		log.Infof("%v = %v", c.Name, c.Value())
+	}
 	debug.FreeOSMemory()
 }
 
+func (fs *Goofys) Destroy() {
+	if fs.cancel != nil {
+		fs.cancel()
+	}
+}
+
 // Find the given inode. Panic if it doesn't exist.
 //
 // RLOCKS_REQUIRED(fs.mu)
@@ -280,6 +469,7 @@ type Mount struct {
 	name    string
 	cloud   StorageBackend
 	prefix  string
+	tenant  *Tenant
 	mounted bool
 }
 
@@ -328,6 +518,7 @@ func (fs *Goofys) mount(mp *Inode, b *Mount) {
 		mountInode.ToDir()
 		mountInode.dir.cloud = b.cloud
 		mountInode.dir.mountPrefix = b.prefix
+		mountInode.dir.tenant = b.tenant
 		mountInode.AttrTime = TIME_MAX
 
 		fs.mu.Lock()
@@ -344,6 +535,7 @@ func (fs *Goofys) mount(mp *Inode, b *Mount) {
 		defer prev.mu.Unlock()
 		prev.dir.cloud = b.cloud
 		prev.dir.mountPrefix = b.prefix
+		prev.dir.tenant = b.tenant
 		prev.AttrTime = TIME_MAX
 		// unset this so that if there was a specific mount
 		// for a/b and we are mounted at a/, listing would
@@ -354,12 +546,38 @@ func (fs *Goofys) mount(mp *Inode, b *Mount) {
 	b.mounted = true
 }
 
+// mountWeight is the --mount-weights of the mount at path, 1 if
+// it's not listed
+func (fs *Goofys) mountWeight(path string) uint32 {
+	if w, ok := fs.mountWeights[strings.Trim(path, "/")]; ok {
+		return w
+	}
+	return 1
+}
+
+// Scheduled makes requests to cloud share MaxRequests and
+// MaxBandwidth with the other mounts according to weight. Mounts
+// that are not scheduled explicitly get their --mount-weights.
+func (fs *Goofys) Scheduled(cloud StorageBackend, weight uint32) StorageBackend {
+	if fs.scheduler == nil {
+		return cloud
+	}
+	if _, ok := cloud.(*ScheduledBackend); ok {
+		return cloud
+	}
+	return NewScheduledBackend(cloud, fs.scheduler.NewClass(weight))
+}
+
 func (fs *Goofys) MountAll(mounts []*Mount) {
 	fs.mu.RLock()
 	root := fs.getInodeOrDie(fuseops.RootInodeID)
 	fs.mu.RUnlock()
 
 	for _, m := range mounts {
+		if !m.mounted {
+			m.cloud = fs.Scheduled(m.cloud, fs.mountWeight(m.name))
+			fs.hooks.watch(m.cloud)
+		}
 		fs.mount(root, m)
 	}
 }
@@ -367,6 +585,7 @@ func (fs *Goofys) MountAll(mounts []*Mount) {
 func (fs *Goofys) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	const BLOCK_SIZE = 4096
 	const TOTAL_SPACE = 1 * 1024 * 1024 * 1024 * 1024 * 1024 // 1PB
@@ -385,6 +604,7 @@ func (fs *Goofys) StatFS(
 func (fs *Goofys) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
@@ -393,7 +613,7 @@ func (fs *Goofys) GetInodeAttributes(
 	attr, err := inode.GetAttributes()
 	if err == nil {
 		op.Attributes = *attr
-		op.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+		op.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
 	}
 
 	return
@@ -401,11 +621,25 @@ func (fs *Goofys) GetInodeAttributes(
 
 func (fs *Goofys) GetXattr(ctx context.Context,
 	op *fuseops.GetXattrOp) (err error) {
+	defer fs.mapErrno(&err)
+
 	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.RUnlock()
 
-	value, err := inode.GetXattr(op.Name)
+	if err = fs.checkTenant(inode, op.OpContext.Uid); err != nil {
+		return
+	}
+
+	var value []byte
+	if op.Inode == fuseops.RootInodeID && isKnob(op.Name) {
+		value, err = fs.getKnob(op.Name)
+	} else if op.Name == DU_XATTR {
+		// not under inode.mu, this can take a while
+		value, err = inode.du()
+	} else {
+		value, err = inode.GetXattr(op.Name)
+	}
 	if err != nil {
 		return
 	}
@@ -422,11 +656,16 @@ func (fs *Goofys) GetXattr(ctx context.Context,
 
 func (fs *Goofys) ListXattr(ctx context.Context,
 	op *fuseops.ListXattrOp) (err error) {
+	defer fs.mapErrno(&err)
+
 	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.RUnlock()
 
 	xattrs, err := inode.ListXattr()
+	if op.Inode == fuseops.RootInodeID {
+		xattrs = append(xattrs, knobNames()...)
+	}
 
 	ncopied := 0
 
@@ -452,10 +691,24 @@ func (fs *Goofys) ListXattr(ctx context.Context,
 
 func (fs *Goofys) RemoveXattr(ctx context.Context,
 	op *fuseops.RemoveXattrOp) (err error) {
+	defer fs.mapErrno(&err)
+
 	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.RUnlock()
 
+	if op.Inode == fuseops.RootInodeID && isKnob(op.Name) {
+		return syscall.EPERM
+	}
+
+	if err = fs.checkWritable(); err != nil {
+		return
+	}
+
+	if err = fs.checkTenant(inode, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	err = inode.RemoveXattr(op.Name)
 
 	return
@@ -463,10 +716,24 @@ func (fs *Goofys) RemoveXattr(ctx context.Context,
 
 func (fs *Goofys) SetXattr(ctx context.Context,
 	op *fuseops.SetXattrOp) (err error) {
+	defer fs.mapErrno(&err)
+
 	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.RUnlock()
 
+	if op.Inode == fuseops.RootInodeID && isKnob(op.Name) {
+		return fs.setKnob(op.OpContext.Uid, op.Name, op.Value)
+	}
+
+	if err = fs.checkWritable(); err != nil {
+		return
+	}
+
+	if err = fs.checkTenant(inode, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	err = inode.SetXattr(op.Name, op.Value, op.Flags)
 	return
 }
@@ -474,19 +741,19 @@ func (fs *Goofys) SetXattr(ctx context.Context,
 func mapHttpError(status int) error {
 	switch status {
 	case 400:
-		return fuse.EINVAL
+		return classError("invalid")
 	case 401:
-		return syscall.EACCES
+		return classError("denied")
 	case 403:
-		return syscall.EACCES
+		return classError("denied")
 	case 404:
 		return fuse.ENOENT
 	case 405:
 		return syscall.ENOTSUP
 	case 429:
-		return syscall.EAGAIN
+		return classError("throttled")
 	case 500:
-		return syscall.EAGAIN
+		return classError("server")
 	default:
 		return nil
 	}
@@ -499,6 +766,15 @@ func mapAwsError(err error) error {
 
 	if awsErr, ok := err.(awserr.Error); ok {
 		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			if kmsErr, isKMS := mapKMSError(reqErr); isKMS {
+				return kmsErr
+			}
+			if reqErr.Code() == "AccessDenied" &&
+				strings.Contains(strings.ToLower(reqErr.Message()), "object lock") {
+				s3Log.Errorf("%v: %v", reqErr.Code(), reqErr.Message())
+				return classError("locked")
+			}
+
 			// A service error occurred
 			err = mapHttpError(reqErr.StatusCode())
 			if err != nil {
@@ -512,6 +788,9 @@ func mapAwsError(err error) error {
 			case "BucketRegionError":
 				// don't need to log anything, we should detect region after
 				return err
+			case request.CanceledErrorCode:
+				// we cancelled it, ie: the op was interrupted
+				return syscall.EINTR
 			default:
 				// Generic AWS Error with Code, Message, and original error (if any)
 				s3Log.Errorf("code=%v msg=%v, err=%v\n", awsErr.Code(), awsErr.Message(), awsErr.OrigErr())
@@ -536,8 +815,8 @@ func (fs *Goofys) allocateInodeId() (id fuseops.InodeID) {
 	return
 }
 
-func expired(cache time.Time, ttl time.Duration) bool {
-	now := time.Now()
+func (fs *Goofys) expired(cache time.Time, ttl time.Duration) bool {
+	now := fs.clock.Now()
 	if cache.After(now) {
 		return false
 	}
@@ -547,6 +826,7 @@ func expired(cache time.Time, ttl time.Duration) bool {
 func (fs *Goofys) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	var inode *Inode
 	var ok bool
@@ -562,7 +842,7 @@ func (fs *Goofys) LookUpInode(
 		ok = true
 		inode.Ref()
 
-		if expired(inode.AttrTime, fs.flags.StatCacheTTL) {
+		if fs.expired(inode.AttrTime, inode.statCacheTTL()) {
 			ok = false
 			if inode.fileHandles != 0 {
 				// we have an open file handle, object
@@ -583,7 +863,7 @@ func (fs *Goofys) LookUpInode(
 	if !ok {
 		var newInode *Inode
 
-		newInode, err = parent.LookUp(op.Name)
+		newInode, err = parent.LookUp(ctx, op.Name)
 		if err == fuse.ENOENT && inode != nil && inode.isDir() {
 			// we may not be able to look up an implicit
 			// dir if all the children are removed, so we
@@ -622,15 +902,17 @@ func (fs *Goofys) LookUpInode(
 					newInode.Attributes.Mtime = inode.Attributes.Mtime
 				}
 				inode.Attributes = newInode.Attributes
+				atomic.StoreInt64(&inode.cacheTTL,
+					atomic.LoadInt64(&newInode.cacheTTL))
 			}
-			inode.AttrTime = time.Now()
+			inode.AttrTime = fs.clock.Now()
 		}
 	}
 
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
+	op.Entry.EntryExpiration = time.Now().Add(fs.TypeCacheTTL())
 
 	return
 }
@@ -680,6 +962,7 @@ func (fs *Goofys) addDotAndDotDot(dir *Inode) {
 func (fs *Goofys) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
@@ -709,6 +992,8 @@ func (fs *Goofys) ForgetInode(
 func (fs *Goofys) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) (err error) {
+	defer fs.mapErrno(&err)
+
 	fs.mu.Lock()
 
 	handleID := fs.nextHandleID
@@ -717,6 +1002,10 @@ func (fs *Goofys) OpenDir(
 	in := fs.getInodeOrDie(op.Inode)
 	fs.mu.Unlock()
 
+	if err = fs.checkTenant(in, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	// XXX/is this a dir?
 	dh := in.OpenDir()
 
@@ -741,6 +1030,7 @@ func makeDirEntry(en *DirHandleEntry) fuseutil.Dirent {
 func (fs *Goofys) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	// Find the handle.
 	fs.mu.RLock()
@@ -786,6 +1076,7 @@ func (fs *Goofys) ReadDir(
 func (fs *Goofys) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -803,10 +1094,16 @@ func (fs *Goofys) ReleaseDirHandle(
 func (fs *Goofys) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
+	defer fs.mapErrno(&err)
+
 	fs.mu.RLock()
 	in := fs.getInodeOrDie(op.Inode)
 	fs.mu.RUnlock()
 
+	if err = fs.checkTenant(in, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	fh, err := in.OpenFile()
 	if err != nil {
 		return
@@ -829,12 +1126,13 @@ func (fs *Goofys) OpenFile(
 func (fs *Goofys) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	fs.mu.RLock()
 	fh := fs.fileHandles[op.Handle]
 	fs.mu.RUnlock()
 
-	op.BytesRead, err = fh.ReadFile(op.Offset, op.Dst)
+	op.BytesRead, err = fh.ReadFile(ctx, op.Offset, op.Dst)
 
 	return
 }
@@ -842,6 +1140,7 @@ func (fs *Goofys) ReadFile(
 func (fs *Goofys) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	// intentionally ignored, so that write()/sync()/write() works
 	// see https://github.com/kahing/goofys/issues/154
@@ -851,13 +1150,18 @@ func (fs *Goofys) SyncFile(
 func (fs *Goofys) FlushFile(
 	ctx context.Context,
 	op *fuseops.FlushFileOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	fs.mu.RLock()
 	fh := fs.fileHandles[op.Handle]
 	fs.mu.RUnlock()
 
-	err = fh.FlushFile()
+	err = fh.FlushFile(ctx)
 	if err != nil {
+		if err != syscall.EINTR {
+			fs.hooks.fire(HOOK_FLUSH_FAILED, fmt.Sprintf("%v: %v", *fh.inode.FullName(), err))
+		}
+
 		// if we returned success from creat() earlier
 		// linux may think this file exists even when it doesn't,
 		// until TypeCacheTTL is over
@@ -880,6 +1184,8 @@ func (fs *Goofys) FlushFile(
 func (fs *Goofys) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) (err error) {
+	defer fs.mapErrno(&err)
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -898,11 +1204,20 @@ func (fs *Goofys) ReleaseFileHandle(
 func (fs *Goofys) CreateFile(
 	ctx context.Context,
 	op *fuseops.CreateFileOp) (err error) {
+	defer fs.mapErrno(&err)
+
+	if err = fs.checkWritable(); err != nil {
+		return
+	}
 
 	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
 
+	if err = fs.checkTenant(parent, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	inode, fh := parent.Create(op.Name)
 
 	parent.mu.Lock()
@@ -915,8 +1230,8 @@ func (fs *Goofys) CreateFile(
 
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(fs.StatCacheTTL())
+	op.Entry.EntryExpiration = time.Now().Add(fs.TypeCacheTTL())
 
 	// Allocate a handle.
 	handleID := fs.nextHandleID
@@ -934,11 +1249,20 @@ func (fs *Goofys) CreateFile(
 func (fs *Goofys) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) (err error) {
+	defer fs.mapErrno(&err)
+
+	if err = fs.checkWritable(); err != nil {
+		return
+	}
 
 	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
 
+	if err = fs.checkTenant(parent, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	// ignore op.Mode for now
 	inode, err := parent.MkDir(op.Name)
 	if err != nil {
@@ -955,8 +1279,8 @@ func (fs *Goofys) MkDir(
 
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
-	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
-	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+	op.Entry.AttributesExpiration = time.Now().Add(fs.StatCacheTTL())
+	op.Entry.EntryExpiration = time.Now().Add(fs.TypeCacheTTL())
 
 	return
 }
@@ -964,11 +1288,20 @@ func (fs *Goofys) MkDir(
 func (fs *Goofys) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) (err error) {
+	defer fs.mapErrno(&err)
+
+	if err = fs.checkWritable(); err != nil {
+		return
+	}
 
 	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
 
+	if err = fs.checkTenant(parent, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	err = parent.RmDir(op.Name)
 	parent.logFuse("<-- RmDir", op.Name, err)
 	return
@@ -977,15 +1310,24 @@ func (fs *Goofys) RmDir(
 func (fs *Goofys) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) (err error) {
+	defer fs.mapErrno(&err)
+
+	if err = fs.checkWritable(); err != nil {
+		return
+	}
 
 	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.RUnlock()
 
+	if err = fs.checkTenant(inode, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	attr, err := inode.GetAttributes()
 	if err == nil {
 		op.Attributes = *attr
-		op.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+		op.AttributesExpiration = time.Now().Add(inode.statCacheTTL())
 	}
 	return
 }
@@ -993,6 +1335,7 @@ func (fs *Goofys) SetInodeAttributes(
 func (fs *Goofys) WriteFile(
 	ctx context.Context,
 	op *fuseops.WriteFileOp) (err error) {
+	defer fs.mapErrno(&err)
 
 	fs.mu.RLock()
 
@@ -1002,6 +1345,18 @@ func (fs *Goofys) WriteFile(
 	}
 	fs.mu.RUnlock()
 
+	if err = fs.checkWritable(); err != nil {
+		// let the files that are already being written finish
+		fh.mu.Lock()
+		dirty := fh.dirty
+		fh.mu.Unlock()
+
+		if !dirty {
+			return
+		}
+		err = nil
+	}
+
 	err = fh.WriteFile(op.Offset, op.Data)
 
 	return
@@ -1010,11 +1365,20 @@ func (fs *Goofys) WriteFile(
 func (fs *Goofys) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) (err error) {
+	defer fs.mapErrno(&err)
+
+	if err = fs.checkWritable(); err != nil {
+		return
+	}
 
 	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
 
+	if err = fs.checkTenant(parent, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	err = parent.Unlink(op.Name)
 	return
 }
@@ -1024,12 +1388,24 @@ func (fs *Goofys) Unlink(
 func (fs *Goofys) Rename(
 	ctx context.Context,
 	op *fuseops.RenameOp) (err error) {
+	defer fs.mapErrno(&err)
+
+	if err = fs.checkWritable(); err != nil {
+		return
+	}
 
 	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.OldParent)
 	newParent := fs.getInodeOrDie(op.NewParent)
 	fs.mu.RUnlock()
 
+	if err = fs.checkTenant(parent, op.OpContext.Uid); err != nil {
+		return
+	}
+	if err = fs.checkTenant(newParent, op.OpContext.Uid); err != nil {
+		return
+	}
+
 	// XXX don't hold the lock the entire time
 	if op.OldParent == op.NewParent {
 		parent.mu.Lock()
@@ -32,6 +32,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -497,7 +498,7 @@ func (s *GoofysTest) TestPanicWrapper(t *C) {
 }
 
 func (s *GoofysTest) TestGetInodeAttributes(t *C) {
-	inode, err := s.getRoot(t).LookUp("file1")
+	inode, err := s.getRoot(t).LookUp(s.ctx, "file1")
 	t.Assert(err, IsNil)
 
 	attr, err := inode.GetAttributes()
@@ -561,8 +562,8 @@ func (s *GoofysTest) readDirIntoCache(t *C, inode fuseops.InodeID) {
 }
 
 func (s *GoofysTest) TestReadDirCacheLookup(t *C) {
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 
 	s.readDirIntoCache(t, fuseops.RootInodeID)
 	s.disableS3()
@@ -623,7 +624,7 @@ func (s *GoofysTest) TestReadFiles(t *C) {
 
 	for _, en := range entries {
 		if en.Type == fuseutil.DT_File {
-			in, err := parent.LookUp(en.Name)
+			in, err := parent.LookUp(s.ctx, en.Name)
 			t.Assert(err, IsNil)
 
 			fh, err := in.OpenFile()
@@ -631,7 +632,7 @@ func (s *GoofysTest) TestReadFiles(t *C) {
 
 			buf := make([]byte, 4096)
 
-			nread, err := fh.ReadFile(0, buf)
+			nread, err := fh.ReadFile(s.ctx, 0, buf)
 			if en.Name == "zero" {
 				t.Assert(nread, Equals, 0)
 			} else {
@@ -649,7 +650,7 @@ func (s *GoofysTest) TestReadOffset(t *C) {
 	root := s.getRoot(t)
 	f := "file1"
 
-	in, err := root.LookUp(f)
+	in, err := root.LookUp(s.ctx, f)
 	t.Assert(err, IsNil)
 
 	fh, err := in.OpenFile()
@@ -657,7 +658,7 @@ func (s *GoofysTest) TestReadOffset(t *C) {
 
 	buf := make([]byte, 4096)
 
-	nread, err := fh.ReadFile(1, buf)
+	nread, err := fh.ReadFile(s.ctx, 1, buf)
 	t.Assert(err, IsNil)
 	t.Assert(nread, Equals, len(f)-1)
 	t.Assert(string(buf[0:nread]), DeepEquals, f[1:])
@@ -666,19 +667,75 @@ func (s *GoofysTest) TestReadOffset(t *C) {
 
 	for i := 0; i < 3; i++ {
 		off := r.Int31n(int32(len(f)))
-		nread, err = fh.ReadFile(int64(off), buf)
+		nread, err = fh.ReadFile(s.ctx, int64(off), buf)
 		t.Assert(err, IsNil)
 		t.Assert(nread, Equals, len(f)-int(off))
 		t.Assert(string(buf[0:nread]), DeepEquals, f[off:])
 	}
 }
 
+func (s *GoofysTest) TestFooterCache(t *C) {
+	s.fs.footers = newFooterCache(10*1024*1024, s.fs.bufferPool)
+
+	data := make([]byte, 100*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	copy(data[len(data)-4:], "PAR1")
+	for _, key := range []string{"table.parquet", "fake.parquet"} {
+		_, err := s.cloud.PutBlob(&PutBlobInput{
+			Key:  key,
+			Body: bytes.NewReader(data),
+			Size: PUInt64(uint64(len(data))),
+		})
+		t.Assert(err, IsNil)
+		// fake.parquet doesn't end with the magic
+		data[len(data)-1] = 0
+	}
+
+	in, err := s.getRoot(t).LookUp(s.ctx, "fake.parquet")
+	t.Assert(err, IsNil)
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	buf := make([]byte, 8)
+	nread, err := fh.ReadFile(s.ctx, int64(len(data)-8), buf)
+	t.Assert(err, IsNil)
+	t.Assert(buf[:nread], DeepEquals, data[len(data)-8:])
+	t.Assert(fh.columnar, Equals, false)
+	fh.Release()
+	t.Assert(s.fs.footers.lru.Len(), Equals, 0)
+
+	copy(data[len(data)-4:], "PAR1")
+	in, err = s.getRoot(t).LookUp(s.ctx, "table.parquet")
+	t.Assert(err, IsNil)
+
+	misses, hits := footerMisses.Value(), footerHits.Value()
+	for i := 0; i < 2; i++ {
+		fh, err := in.OpenFile()
+		t.Assert(err, IsNil)
+
+		// the length of the footer and the magic
+		buf := make([]byte, 8)
+		nread, err := fh.ReadFile(s.ctx, int64(len(data)-8), buf)
+		t.Assert(err, IsNil)
+		t.Assert(buf[:nread], DeepEquals, data[len(data)-8:])
+
+		buf = make([]byte, 4096)
+		nread, err = fh.ReadFile(s.ctx, 4, buf)
+		t.Assert(err, IsNil)
+		t.Assert(buf[:nread], DeepEquals, data[4:4+nread])
+		fh.Release()
+	}
+	t.Assert(footerMisses.Value(), Equals, misses+1)
+	t.Assert(footerHits.Value(), Equals, hits+1)
+}
+
 func (s *GoofysTest) TestCreateFiles(t *C) {
 	fileName := "testCreateFile"
 
 	_, fh := s.getRoot(t).Create(fileName)
 
-	err := fh.FlushFile()
+	err := fh.FlushFile(s.ctx)
 	t.Assert(err, IsNil)
 
 	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: fileName})
@@ -686,19 +743,19 @@ func (s *GoofysTest) TestCreateFiles(t *C) {
 	t.Assert(resp.HeadBlobOutput.Size, DeepEquals, uint64(0))
 	defer resp.Body.Close()
 
-	_, err = s.getRoot(t).LookUp(fileName)
+	_, err = s.getRoot(t).LookUp(s.ctx, fileName)
 	t.Assert(err, IsNil)
 
 	fileName = "testCreateFile2"
 	s.testWriteFile(t, fileName, 1, 128*1024)
 
-	inode, err := s.getRoot(t).LookUp(fileName)
+	inode, err := s.getRoot(t).LookUp(s.ctx, fileName)
 	t.Assert(err, IsNil)
 
 	fh, err = inode.OpenFile()
 	t.Assert(err, IsNil)
 
-	err = fh.FlushFile()
+	err = fh.FlushFile(s.ctx)
 	t.Assert(err, IsNil)
 
 	resp, err = s.cloud.GetBlob(&GetBlobInput{Key: fileName})
@@ -728,7 +785,7 @@ type FileHandleReader struct {
 }
 
 func (r *FileHandleReader) Read(p []byte) (nread int, err error) {
-	nread, err = r.fh.ReadFile(r.offset, p)
+	nread, err = r.fh.ReadFile(context.Background(), r.offset, p)
 	r.offset += int64(nread)
 	return
 }
@@ -796,7 +853,7 @@ func (s *GoofysTest) testWriteFileAt(t *C, fileName string, offset int64, size i
 		nwritten += int64(nread)
 	}
 
-	err = fh.FlushFile()
+	err = fh.FlushFile(s.ctx)
 	t.Assert(err, IsNil)
 
 	resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: fileName})
@@ -817,6 +874,41 @@ func (s *GoofysTest) TestWriteLargeFile(t *C) {
 	s.testWriteFile(t, "testLargeFile2", 20*1024*1024, 128*1024)
 }
 
+func (s *GoofysTest) TestFlushInterrupted(t *C) {
+	if _, ok := s.cloud.(*S3Backend); !ok {
+		t.Skip("only for S3")
+	}
+
+	create := fuseops.CreateFileOp{
+		Parent: s.getRoot(t).Id,
+		Name:   "testFlushInterrupted",
+	}
+	err := s.fs.CreateFile(nil, &create)
+	t.Assert(err, IsNil)
+	fh := s.fs.fileHandles[create.Handle]
+
+	err = fh.WriteFile(0, []byte("hello"))
+	t.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+	err = fh.FlushFile(ctx)
+	t.Assert(err, Equals, syscall.EINTR)
+
+	// the data is still there for the next flush
+	err = fh.FlushFile(s.ctx)
+	t.Assert(err, IsNil)
+
+	resp, err := s.cloud.GetBlob(&GetBlobInput{Key: "testFlushInterrupted"})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf), Equals, "hello")
+
+	fh.Release()
+}
+
 func (s *GoofysTest) TestWriteReplicatorThrottle(t *C) {
 	s.fs.replicators = Ticket{Total: 1}.Init()
 	s.testWriteFile(t, "testLargeFile", 21*1024*1024, 128*1024)
@@ -877,6 +969,54 @@ func (s *GoofysTest) TestReadRandom(t *C) {
 	}
 }
 
+func (s *GoofysTest) TestReadAheadHugeFile(t *C) {
+	// files at least as large as the readahead start small
+	atomic.StoreUint32(&s.fs.maxReadahead, 2*READAHEAD_CHUNK)
+	size := int64(2 * READAHEAD_CHUNK)
+	s.testWriteFile(t, "testLargeFile", size, 128*1024)
+
+	in, err := s.LookUpInode(t, "testLargeFile")
+	t.Assert(err, IsNil)
+
+	readahead := func(fh *FileHandle) (n uint32) {
+		for _, b := range fh.buffers {
+			n += b.size
+		}
+		return
+	}
+
+	// a random read doesn't fetch more than the first chunk
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	buf := make([]byte, 4096)
+	for _, off := range []int64{30 * 1024 * 1024, 10 * 1024 * 1024} {
+		_, err = fh.ReadFile(s.ctx, off, buf)
+		t.Assert(err, IsNil)
+		t.Assert(fh.buffers, HasLen, 1)
+		t.Assert(readahead(fh), Equals, READAHEAD_FIRST_CHUNK-uint32(len(buf)))
+	}
+	fh.Release()
+
+	// and sequential reads scale up from there
+	fh, err = in.OpenFile()
+	t.Assert(err, IsNil)
+	_, err = fh.ReadFile(s.ctx, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(readahead(fh), Equals, READAHEAD_FIRST_CHUNK-uint32(len(buf)))
+
+	_, err = fh.ReadFile(s.ctx, int64(len(buf)), buf)
+	t.Assert(err, IsNil)
+	t.Assert(fh.buffers, HasLen, 2)
+	t.Assert(readahead(fh), Equals, READAHEAD_FIRST_CHUNK+READAHEAD_CHUNK-2*uint32(len(buf)))
+
+	truth := &SeqReader{int64(2 * len(buf))}
+	fr := &FileHandleReader{s.fs, fh, int64(2 * len(buf))}
+	diff, err := CompareReader(fr, io.LimitReader(truth, size-int64(2*len(buf))))
+	t.Assert(err, IsNil)
+	t.Assert(diff, Equals, -1)
+	fh.Release()
+}
+
 func (s *GoofysTest) TestMkDir(t *C) {
 	_, err := s.LookUpInode(t, "new_dir/file")
 	t.Assert(err, Equals, fuse.ENOENT)
@@ -892,7 +1032,7 @@ func (s *GoofysTest) TestMkDir(t *C) {
 	fileName := "file"
 	_, fh := inode.Create(fileName)
 
-	err = fh.FlushFile()
+	err = fh.FlushFile(s.ctx)
 	t.Assert(err, IsNil)
 
 	_, err = s.LookUpInode(t, dirName+"/"+fileName)
@@ -979,6 +1119,657 @@ func (s *GoofysTest) TestRenameToExisting(t *C) {
 	t.Assert(*file2.Name, Equals, "file2")
 }
 
+func (s *GoofysTest) TestRootKnobs(t *C) {
+	s.fs.SetStatCacheTTL(time.Minute)
+	s.fs.flags.AdminUid = 1000
+
+	value, err := s.fs.getKnob("user.goofys.stat-cache-ttl")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "1m0s")
+
+	err = s.fs.setKnob(1001, "user.goofys.stat-cache-ttl", []byte("5s"))
+	t.Assert(err, Equals, syscall.EPERM)
+
+	err = s.fs.setKnob(1000, "user.goofys.stat-cache-ttl", []byte("5s"))
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.StatCacheTTL(), Equals, 5*time.Second)
+
+	err = s.fs.setKnob(0, "user.goofys.readahead", []byte("1"))
+	t.Assert(err, Equals, fuse.EINVAL)
+
+	err = s.fs.setKnob(0, "user.goofys.readahead", []byte("41943040"))
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.maxReadahead, Equals, uint32(40*1024*1024))
+
+	value, err = s.fs.getKnob("user.goofys.bucket")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, s.fs.bucket)
+	err = s.fs.setKnob(0, "user.goofys.bucket", []byte("other"))
+	t.Assert(err, Equals, syscall.EPERM)
+
+	_, err = s.fs.getKnob("user.goofys.nope")
+	t.Assert(err, Equals, syscall.ENODATA)
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (s *GoofysTest) TestFakeClock(t *C) {
+	clock := &fakeClock{now: time.Now()}
+	s.fs.clock = clock
+	s.fs.SetStatCacheTTL(time.Minute)
+
+	file1, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.expired(file1.AttrTime, time.Minute), Equals, false)
+
+	clock.Advance(59 * time.Second)
+	t.Assert(s.fs.expired(file1.AttrTime, time.Minute), Equals, false)
+	clock.Advance(time.Second)
+	t.Assert(s.fs.expired(file1.AttrTime, time.Minute), Equals, true)
+
+	// looking it up again refreshes it at the fake time
+	file1, err = s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.expired(file1.AttrTime, time.Minute), Equals, false)
+	clock.Advance(time.Minute)
+	t.Assert(s.fs.expired(file1.AttrTime, time.Minute), Equals, true)
+}
+
+func (s *GoofysTest) TestCostBudget(t *C) {
+	if _, ok := s.cloud.(*S3Backend); !ok {
+		t.Skip("only for S3")
+	}
+
+	clock := &fakeClock{now: time.Now()}
+	s.fs.clock = clock
+
+	// a dollar a HEAD. Not counting PUTs, which includes the
+	// LIST of the multipart uploads at mount time
+	c := newCostTracker(s.fs, costPrices{Get: 1000}, 1.5)
+	c.check()
+	t.Assert(c.alerted, Equals, false)
+
+	_, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "file1"})
+	t.Assert(err, IsNil)
+	c.check()
+	t.Assert(c.alerted, Equals, false)
+
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "file1"})
+	t.Assert(err, IsNil)
+	c.check()
+	t.Assert(c.alerted, Equals, true)
+
+	// a new day, a new budget
+	clock.Advance(24 * time.Hour)
+	c.check()
+	t.Assert(c.alerted, Equals, false)
+	t.Assert(c.prices.cost(currentCostUsage().since(c.baseline)), Equals, float64(0))
+}
+
+func (s *GoofysTest) TestStatsDir(t *C) {
+	s.fs.mount(s.getRoot(t), &Mount{name: STATS_DIR, cloud: NewStatsBackend(s.fs)})
+
+	_, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, ".goofys/inodes")
+	t.Assert(err, IsNil)
+
+	fh, err := in.OpenFile()
+	t.Assert(err, IsNil)
+	defer fh.Release()
+
+	buf := make([]byte, in.Attributes.Size)
+	nread, err := fh.ReadFile(s.ctx, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(nread, Equals, len(buf))
+	t.Assert(strings.Contains(string(buf), "\n/file1 file 5 "), Equals, true)
+
+	in, err = s.LookUpInode(t, ".goofys/stats")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Not(Equals), uint64(0))
+
+	in, err = s.LookUpInode(t, ".goofys/goroutines")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Not(Equals), uint64(0))
+
+	_, err = s.LookUpInode(t, ".goofys/nope")
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestWarm(t *C) {
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+
+	s.fs.Warm(2)
+	s.disableS3()
+
+	// dir1 and its children were listed
+	lookup := fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir1",
+	}
+	err := s.fs.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+
+	err = s.fs.LookUpInode(nil, &fuseops.LookUpInodeOp{
+		Parent: lookup.Entry.Child,
+		Name:   "file3",
+	})
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestDrain(t *C) {
+	root := s.getRoot(t)
+
+	create := fuseops.CreateFileOp{
+		Parent: root.Id,
+		Name:   "drain",
+	}
+	err := s.fs.CreateFile(nil, &create)
+	t.Assert(err, IsNil)
+
+	fh := s.fs.fileHandles[create.Handle]
+	err = fh.WriteFile(0, []byte("drain"))
+	t.Assert(err, IsNil)
+
+	// no time to upload it
+	t.Assert(s.fs.Drain(0), DeepEquals, []string{"drain"})
+
+	err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{
+		Parent: root.Id,
+		Name:   "drain2",
+	})
+	t.Assert(err, Equals, syscall.EROFS)
+
+	// but what's already open can finish, and is uploaded
+	err = fh.WriteFile(5, []byte("drain"))
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.Drain(time.Minute), HasLen, 0)
+
+	resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "drain"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Size, Equals, uint64(10))
+}
+
+func (s *GoofysTest) TestDrainWrite(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	open := fuseops.OpenFileOp{Inode: in.Id}
+	err = s.fs.OpenFile(nil, &open)
+	t.Assert(err, IsNil)
+
+	s.fs.Drain(0)
+
+	// files that weren't being written can't start now, at any
+	// offset
+	for _, off := range []int64{0, 5} {
+		err = s.fs.WriteFile(nil, &fuseops.WriteFileOp{
+			Handle: open.Handle,
+			Offset: off,
+			Data:   []byte("drain"),
+		})
+		t.Assert(err, Equals, syscall.EROFS)
+	}
+
+	err = s.fs.ReleaseFileHandle(nil, &fuseops.ReleaseFileHandleOp{Handle: open.Handle})
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestDrainSetInodeAttributes(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	s.fs.Drain(0)
+
+	size := uint64(0)
+	err = s.fs.SetInodeAttributes(nil, &fuseops.SetInodeAttributesOp{
+		Inode: in.Id,
+		Size:  &size,
+	})
+	t.Assert(err, Equals, syscall.EROFS)
+}
+
+func (s *GoofysTest) TestDrainSetXattr(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	s.fs.Drain(0)
+
+	err = s.fs.SetXattr(nil, &fuseops.SetXattrOp{
+		Inode: in.Id,
+		Name:  "user.foo",
+		Value: []byte("bar"),
+	})
+	t.Assert(err, Equals, syscall.EROFS)
+
+	err = s.fs.RemoveXattr(nil, &fuseops.RemoveXattrOp{
+		Inode: in.Id,
+		Name:  "user.name",
+	})
+	t.Assert(err, Equals, syscall.EROFS)
+
+	// the knobs are not in the bucket
+	err = s.fs.SetXattr(nil, &fuseops.SetXattrOp{
+		Inode: fuseops.RootInodeID,
+		Name:  knobPrefix + "stat-cache-ttl",
+		Value: []byte("5s"),
+	})
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestFlushAll(t *C) {
+	root := s.getRoot(t)
+
+	create := fuseops.CreateFileOp{
+		Parent: root.Id,
+		Name:   "flush",
+	}
+	err := s.fs.CreateFile(nil, &create)
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.Stats().FileHandles, Equals, 1)
+
+	fh := s.fs.fileHandles[create.Handle]
+	err = fh.WriteFile(0, []byte("flush"))
+	t.Assert(err, IsNil)
+
+	err = s.fs.FlushAll(s.ctx)
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.dirtyFiles(), HasLen, 0)
+
+	resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: "flush"})
+	t.Assert(err, IsNil)
+	t.Assert(resp.Size, Equals, uint64(5))
+}
+
+func (s *GoofysTest) TestTraceReplay(t *C) {
+	var buf bytes.Buffer
+	trace := NewTraceFS(s.fs, &buf, false)
+
+	lookup := fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir1",
+	}
+	err := trace.LookUpInode(nil, &lookup)
+	t.Assert(err, IsNil)
+
+	err = trace.LookUpInode(nil, &fuseops.LookUpInodeOp{
+		Parent: lookup.Entry.Child,
+		Name:   "file3",
+	})
+	t.Assert(err, IsNil)
+
+	create := fuseops.CreateFileOp{
+		Parent: lookup.Entry.Child,
+		Name:   "traced",
+	}
+	err = trace.CreateFile(nil, &create)
+	t.Assert(err, IsNil)
+	err = trace.WriteFile(nil, &fuseops.WriteFileOp{
+		Inode:  create.Entry.Child,
+		Handle: create.Handle,
+		Data:   []byte("traced"),
+	})
+	t.Assert(err, IsNil)
+	err = trace.FlushFile(nil, &fuseops.FlushFileOp{
+		Inode:  create.Entry.Child,
+		Handle: create.Handle,
+	})
+	t.Assert(err, IsNil)
+	err = trace.ReleaseFileHandle(nil, &fuseops.ReleaseFileHandleOp{
+		Handle: create.Handle,
+	})
+	t.Assert(err, IsNil)
+
+	err = trace.LookUpInode(nil, &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "nope",
+	})
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	f, err := ioutil.TempFile("", "goofys-trace")
+	t.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	_, err = f.Write(buf.Bytes())
+	t.Assert(err, IsNil)
+	f.Close()
+
+	records, err := readTrace(f.Name())
+	t.Assert(err, IsNil)
+	t.Assert(records, HasLen, 7)
+	t.Assert(records[6].Error, Equals, fuse.ENOENT.Error())
+
+	// dir1/traced was created by the trace
+	t.Assert(existingObjects(records), DeepEquals, map[string]tracedObject{
+		"dir1":       tracedObject{dir: true, size: 4096},
+		"dir1/file3": tracedObject{size: 5},
+	})
+
+	r := newTraceReplayer(NewGoofys(context.Background(), s.fs.bucket, s.fs.flags))
+	for i := range records {
+		err = r.replay(s.ctx, &records[i])
+		if records[i].Error == "" {
+			t.Assert(err, IsNil)
+		} else {
+			t.Assert(err, NotNil)
+		}
+	}
+
+	// unknown inodes are skipped
+	err = r.replay(s.ctx, &traceRecord{Op: "GetInodeAttributes", Inode: 12345})
+	t.Assert(err, Equals, errNotTraced)
+}
+
+func (s *GoofysTest) TestChaos(t *C) {
+	lookup := fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "file1",
+	}
+
+	chaos := NewChaosFS(s.fs, 1, 0, 0)
+	err := chaos.LookUpInode(s.ctx, &lookup)
+	t.Assert(err, Equals, fuse.EIO)
+
+	chaos = NewChaosFS(s.fs, 0, 1, time.Millisecond)
+	err = chaos.LookUpInode(s.ctx, &lookup)
+	t.Assert(err, IsNil)
+
+	// forgets always go through
+	chaos = NewChaosFS(s.fs, 1, 0, 0)
+	err = chaos.ForgetInode(s.ctx, &fuseops.ForgetInodeOp{
+		Inode: lookup.Entry.Child,
+		N:     1,
+	})
+	t.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+	chaos = NewChaosFS(s.fs, 0, 1, time.Hour)
+	err = chaos.LookUpInode(ctx, &lookup)
+	t.Assert(err, Equals, syscall.EINTR)
+}
+
+func (s *GoofysTest) TestSpill(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-spill")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// one part in memory at most
+	s.fs.bufferPool = NewBufferPool(BUF_SIZE)
+	s.fs.spill = newSpillPool(dir, 100*1024*1024)
+	root := s.getRoot(t)
+	spilled := spillBuffers.Value()
+
+	var handles []*FileHandle
+	for _, name := range []string{"in_memory", "spilled"} {
+		create := fuseops.CreateFileOp{
+			Parent: root.Id,
+			Name:   name,
+		}
+		err = s.fs.CreateFile(nil, &create)
+		t.Assert(err, IsNil)
+
+		fh := s.fs.fileHandles[create.Handle]
+		err = fh.WriteFile(0, []byte(name))
+		t.Assert(err, IsNil)
+		handles = append(handles, fh)
+	}
+	t.Assert(spillBuffers.Value(), Equals, spilled+1)
+
+	for _, fh := range handles {
+		err = fh.FlushFile(s.ctx)
+		t.Assert(err, IsNil)
+
+		resp, err := s.cloud.GetBlob(&GetBlobInput{Key: *fh.inode.Name})
+		t.Assert(err, IsNil)
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Assert(err, IsNil)
+		t.Assert(string(content), Equals, *fh.inode.Name)
+	}
+}
+
+func (s *GoofysTest) TestTenants(t *C) {
+	uid := uint32(1234)
+	tenant := &Tenant{Prefix: "dir1", Uid: &uid, QuotaMB: 1}
+	s.fs.mountTenants(s.getRoot(t), s.cloud, "", []*Tenant{tenant})
+
+	file1, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(file1.InflateAttributes().Uid, Equals, s.fs.flags.Uid)
+
+	file3, err := s.LookUpInode(t, "dir1/file3")
+	t.Assert(err, IsNil)
+	t.Assert(file3.tenant(), Equals, tenant)
+	t.Assert(file3.InflateAttributes().Uid, Equals, uid)
+	t.Assert(file3.InflateAttributes().Gid, Equals, s.fs.flags.Gid)
+
+	dir1, err := s.LookUpInode(t, "dir1")
+	t.Assert(err, IsNil)
+
+	write := func(name string, size int) error {
+		_, fh := dir1.Create(name)
+		defer fh.Release()
+
+		err := fh.WriteFile(0, make([]byte, size))
+		if err != nil {
+			return err
+		}
+		return fh.FlushFile(s.ctx)
+	}
+
+	err = write("half", 512*1024)
+	t.Assert(err, IsNil)
+	t.Assert(tenant.pending, Equals, uint64(0))
+
+	err = write("more", 600*1024)
+	t.Assert(err, Equals, syscall.ENOSPC)
+	t.Assert(tenant.pending, Equals, uint64(0))
+
+	// the quota doesn't apply outside of the tenant
+	root := s.getRoot(t)
+	_, fh := root.Create("outside")
+	err = fh.WriteFile(0, make([]byte, 2*1024*1024))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.ctx)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	err = dir1.Unlink("half")
+	t.Assert(err, IsNil)
+	err = write("more2", 600*1024)
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestTenantAccess(t *C) {
+	uid := uint32(1234)
+	tenant := &Tenant{Prefix: "dir1", Uid: &uid}
+	s.fs.mountTenants(s.getRoot(t), s.cloud, "", []*Tenant{tenant})
+	s.fs.flags.AdminUid = 1000
+
+	dir1, err := s.LookUpInode(t, "dir1")
+	t.Assert(err, IsNil)
+	file3, err := s.LookUpInode(t, "dir1/file3")
+	t.Assert(err, IsNil)
+
+	for _, caller := range []uint32{0, 1000, uid} {
+		ctx := fuseops.OpContext{Uid: caller}
+		open := fuseops.OpenFileOp{Inode: file3.Id, OpContext: ctx}
+		err = s.fs.OpenFile(nil, &open)
+		t.Assert(err, IsNil)
+		s.fs.ReleaseFileHandle(nil, &fuseops.ReleaseFileHandleOp{Handle: open.Handle})
+	}
+
+	ctx := fuseops.OpContext{Uid: 4321}
+	err = s.fs.OpenFile(nil, &fuseops.OpenFileOp{Inode: file3.Id, OpContext: ctx})
+	t.Assert(err, Equals, syscall.EACCES)
+	err = s.fs.OpenDir(nil, &fuseops.OpenDirOp{Inode: dir1.Id, OpContext: ctx})
+	t.Assert(err, Equals, syscall.EACCES)
+	err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{Parent: dir1.Id, Name: "new", OpContext: ctx})
+	t.Assert(err, Equals, syscall.EACCES)
+	err = s.fs.MkDir(nil, &fuseops.MkDirOp{Parent: dir1.Id, Name: "new", OpContext: ctx})
+	t.Assert(err, Equals, syscall.EACCES)
+	err = s.fs.Unlink(nil, &fuseops.UnlinkOp{Parent: dir1.Id, Name: "file3", OpContext: ctx})
+	t.Assert(err, Equals, syscall.EACCES)
+	err = s.fs.Rename(nil, &fuseops.RenameOp{OldParent: dir1.Id, OldName: "file3",
+		NewParent: dir1.Id, NewName: "file4", OpContext: ctx})
+	t.Assert(err, Equals, syscall.EACCES)
+	err = s.fs.SetXattr(nil, &fuseops.SetXattrOp{Inode: file3.Id, Name: "user.name",
+		Value: []byte("x"), OpContext: ctx})
+	t.Assert(err, Equals, syscall.EACCES)
+
+	_, err = s.cloud.HeadBlob(&HeadBlobInput{Key: "dir1/file3"})
+	t.Assert(err, IsNil)
+
+	// everything outside of the tenant is still open
+	root := s.getRoot(t)
+	err = s.fs.CreateFile(nil, &fuseops.CreateFileOp{Parent: root.Id, Name: "new", OpContext: ctx})
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestStartupBurst(t *C) {
+	s.fs.flags.Cheap = true
+	s.fs.flags.StartupBurst = 1 * time.Second
+	s.fs.flags.StartupBurstFactor = 2
+	s.fs.scheduler = Scheduler{Requests: 10}.Init()
+
+	done := make(chan bool)
+	go func() {
+		s.fs.StartupBurst()
+		done <- true
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	t.Assert(s.fs.cheap(), Equals, false)
+	t.Assert(atomic.LoadUint32(&s.fs.maxReadahead), Equals, 2*MAX_READAHEAD)
+	t.Assert(s.fs.scheduler.MaxRequests(), Equals, uint32(20))
+
+	<-done
+	t.Assert(s.fs.cheap(), Equals, true)
+	t.Assert(atomic.LoadUint32(&s.fs.maxReadahead), Equals, MAX_READAHEAD)
+	t.Assert(s.fs.scheduler.MaxRequests(), Equals, uint32(10))
+}
+
+func (s *GoofysTest) TestInvalidateKnob(t *C) {
+	dir1, err := s.LookUpInode(t, "dir1")
+	t.Assert(err, IsNil)
+	file3, err := s.LookUpInode(t, "dir1/file3")
+	t.Assert(err, IsNil)
+	t.Assert(file3.AttrTime.IsZero(), Equals, false)
+
+	err = s.fs.setKnob(0, "user.goofys.invalidate", []byte("dir1"))
+	t.Assert(err, IsNil)
+	t.Assert(file3.AttrTime.IsZero(), Equals, true)
+	t.Assert(dir1.dir.DirTime.IsZero(), Equals, true)
+
+	// nothing cached is fine
+	err = s.fs.setKnob(0, "user.goofys.invalidate", []byte("/nope/nope"))
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestInvalidateKey(t *C) {
+	dir1, err := s.LookUpInode(t, "dir1")
+	t.Assert(err, IsNil)
+	s.readDirIntoCache(t, dir1.Id)
+	file3, err := s.LookUpInode(t, "dir1/file3")
+	t.Assert(err, IsNil)
+	dir4, err := s.LookUpInode(t, "dir4")
+	t.Assert(err, IsNil)
+	s.readDirIntoCache(t, dir4.Id)
+	file5, err := s.LookUpInode(t, "dir4/file5")
+	t.Assert(err, IsNil)
+
+	s.fs.invalidateKey("dir1/file3")
+	t.Assert(file3.AttrTime.IsZero(), Equals, true)
+	t.Assert(dir1.dir.DirTime.IsZero(), Equals, true)
+	// siblings are left alone
+	t.Assert(file5.AttrTime.IsZero(), Equals, false)
+	t.Assert(dir4.dir.DirTime.IsZero(), Equals, false)
+
+	// a new key drops the listing of the closest dir we know
+	s.fs.invalidateKey("dir4/new/file")
+	t.Assert(dir4.dir.DirTime.IsZero(), Equals, true)
+	t.Assert(file5.AttrTime.IsZero(), Equals, false)
+}
+
+func (s *GoofysTest) TestShardedBackend(t *C) {
+	if _, ok := s.cloud.(*S3Backend); !ok {
+		t.Skip("only for S3")
+	}
+
+	cloud := NewShardedBackend(s.cloud, []string{"shard0/", "shard1/", "shard2/"})
+	keys := []string{"sharded/a", "sharded/b", "sharded/c/1", "sharded/c/2", "sharded/d", "sharded/e/1"}
+	for _, key := range keys {
+		_, err := cloud.PutBlob(&PutBlobInput{
+			Key:  key,
+			Body: bytes.NewReader([]byte(key)),
+			Size: PUInt64(uint64(len(key))),
+		})
+		t.Assert(err, IsNil)
+
+		resp, err := s.cloud.HeadBlob(&HeadBlobInput{Key: cloud.shard(key) + key})
+		t.Assert(err, IsNil)
+		t.Assert(resp.Size, Equals, uint64(len(key)))
+
+		resp, err = cloud.HeadBlob(&HeadBlobInput{Key: key})
+		t.Assert(err, IsNil)
+		t.Assert(*resp.Key, Equals, key)
+	}
+
+	var names []string
+	var token *string
+	for {
+		resp, err := cloud.ListBlobs(&ListBlobsInput{
+			Prefix:            PString("sharded/"),
+			Delimiter:         PString("/"),
+			MaxKeys:           PUInt32(2),
+			ContinuationToken: token,
+		})
+		t.Assert(err, IsNil)
+		t.Assert(len(resp.Items)+len(resp.Prefixes) <= 2, Equals, true)
+		for _, i := range resp.Items {
+			names = append(names, *i.Key)
+		}
+		for _, p := range resp.Prefixes {
+			names = append(names, *p.Prefix)
+		}
+		if !resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+	sort.Strings(names)
+	t.Assert(names, DeepEquals, []string{"sharded/a", "sharded/b", "sharded/c/", "sharded/d", "sharded/e/"})
+}
+
+func (s *GoofysTest) TestCheckPermissions(t *C) {
+	for _, c := range CheckPermissions(s.cloud, "") {
+		t.Assert(c.Err, IsNil, Commentf("%v", c))
+	}
+
+	res, err := s.cloud.ListBlobs(&ListBlobsInput{
+		Prefix: PString(".goofys-probe-"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(len(res.Items), Equals, 0)
+}
+
 func (s *GoofysTest) TestBackendListPrefix(t *C) {
 	res, err := s.cloud.ListBlobs(&ListBlobsInput{
 		Prefix:    PString("random"),
@@ -1032,7 +1823,7 @@ func (s *GoofysTest) TestBackendListPrefix(t *C) {
 }
 
 func (s *GoofysTest) TestRenameDir(t *C) {
-	s.fs.flags.StatCacheTTL = 0
+	s.fs.SetStatCacheTTL(0)
 
 	root := s.getRoot(t)
 
@@ -1092,6 +1883,32 @@ func (s *GoofysTest) TestRenameDir(t *C) {
 	t.Assert(err, Equals, fuse.ENOENT)
 }
 
+func (s *GoofysTest) TestRenameDirPublished(t *C) {
+	root := s.getRoot(t)
+
+	staging, err := root.MkDir("staging")
+	t.Assert(err, IsNil)
+	for _, name := range []string{"part-0", "_SUCCESS", "part-1"} {
+		_, fh := staging.Create(name)
+		err := fh.FlushFile(s.ctx)
+		t.Assert(err, IsNil)
+		fh.Release()
+	}
+
+	err = root.Rename("staging", root, "published")
+	t.Assert(err, IsNil)
+
+	files, err := listRemote(s.cloud, "staging/")
+	t.Assert(err, IsNil)
+	t.Assert(files, HasLen, 0)
+
+	files, err = listRemote(s.cloud, "published/")
+	t.Assert(err, IsNil)
+	t.Assert(files, HasLen, 3)
+	_, ok := files["_SUCCESS"]
+	t.Assert(ok, Equals, true)
+}
+
 func (s *GoofysTest) TestRename(t *C) {
 	root := s.getRoot(t)
 
@@ -1129,7 +1946,7 @@ func (s *GoofysTest) TestRename(t *C) {
 	if s.azurite {
 		// Azurite returns 400 when copy source doesn't exist
 		// https://github.com/Azure/Azurite/issues/219
-		t.Assert(err, Equals, fuse.EINVAL)
+		t.Assert(isErrorClass(err, "invalid"), Equals, true)
 	} else {
 		t.Assert(err, Equals, fuse.ENOENT)
 	}
@@ -1138,7 +1955,7 @@ func (s *GoofysTest) TestRename(t *C) {
 		if !hasEnv("GCS") {
 			// not really rename but can be used by rename
 			from, to = s.fs.bucket+"/file2", "new_file"
-			err = s3.copyObjectMultipart(int64(len("file2")), from, to, "", nil, nil, nil)
+			err = s3.copyObjectMultipart(int64(len("file2")), from, to, "", nil, nil, nil, nil, 0)
 			t.Assert(err, IsNil)
 		}
 	}
@@ -1304,7 +2121,7 @@ func (s *GoofysTest) TestFuse(t *C) {
 }
 
 func (s *GoofysTest) TestFuseWithTTL(t *C) {
-	s.fs.flags.StatCacheTTL = 60 * 1000 * 1000 * 1000
+	s.fs.SetStatCacheTTL(60 * 1000 * 1000 * 1000)
 	mountPoint := "/tmp/mnt" + s.fs.bucket
 
 	s.runFuseTest(t, mountPoint, true, "../test/fuse-test.sh", mountPoint)
@@ -1350,36 +2167,36 @@ func (s *GoofysTest) testExplicitDir(t *C) {
 }
 
 func (s *GoofysTest) TestBenchLs(t *C) {
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+	s.fs.SetStatCacheTTL(1 * time.Minute)
 	mountPoint := "/tmp/mnt" + s.fs.bucket
 	s.runFuseTest(t, mountPoint, false, "../bench/bench.sh", "cat", mountPoint, "ls")
 }
 
 func (s *GoofysTest) TestBenchCreate(t *C) {
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+	s.fs.SetStatCacheTTL(1 * time.Minute)
 	mountPoint := "/tmp/mnt" + s.fs.bucket
 	s.runFuseTest(t, mountPoint, false, "../bench/bench.sh", "cat", mountPoint, "create")
 }
 
 func (s *GoofysTest) TestBenchCreateParallel(t *C) {
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+	s.fs.SetStatCacheTTL(1 * time.Minute)
 	mountPoint := "/tmp/mnt" + s.fs.bucket
 	s.runFuseTest(t, mountPoint, false, "../bench/bench.sh", "cat", mountPoint, "create_parallel")
 }
 
 func (s *GoofysTest) TestBenchIO(t *C) {
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+	s.fs.SetStatCacheTTL(1 * time.Minute)
 	mountPoint := "/tmp/mnt" + s.fs.bucket
 	s.runFuseTest(t, mountPoint, false, "../bench/bench.sh", "cat", mountPoint, "io")
 }
 
 func (s *GoofysTest) TestBenchFindTree(t *C) {
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+	s.fs.SetStatCacheTTL(1 * time.Minute)
 	mountPoint := "/tmp/mnt" + s.fs.bucket
 
 	s.runFuseTest(t, mountPoint, false, "../bench/bench.sh", "cat", mountPoint, "find")
@@ -1427,7 +2244,7 @@ func (s *GoofysTest) TestIssue64(t *C) {
 }
 
 func (s *GoofysTest) TestIssue69Fuse(t *C) {
-	s.fs.flags.StatCacheTTL = 0
+	s.fs.SetStatCacheTTL(0)
 
 	mountPoint := "/tmp/mnt" + s.fs.bucket
 
@@ -1527,7 +2344,7 @@ func (s *GoofysTest) TestFuseWithPrefix(t *C) {
 
 func (s *GoofysTest) TestRenameCache(t *C) {
 	root := s.getRoot(t)
-	s.fs.flags.StatCacheTTL = 60 * 1000 * 1000 * 1000
+	s.fs.SetStatCacheTTL(60 * 1000 * 1000 * 1000)
 
 	lookupOp1 := fuseops.LookUpInodeOp{
 		Parent: root.Id,
@@ -1598,8 +2415,8 @@ func (s *GoofysTest) disableS3() {
 
 func (s *GoofysTest) TestWriteAnonymous(t *C) {
 	s.anonymous(t)
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 
 	fileName := "test"
 
@@ -1632,8 +2449,8 @@ func (s *GoofysTest) TestWriteAnonymous(t *C) {
 
 func (s *GoofysTest) TestWriteAnonymousFuse(t *C) {
 	s.anonymous(t)
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 
 	mountPoint := "/tmp/mnt" + s.fs.bucket
 
@@ -1850,13 +2667,83 @@ func (s *GoofysTest) TestXAttrGet(t *C) {
 	}
 }
 
+func (s *GoofysTest) TestXAttrACL(t *C) {
+	if _, ok := s.cloud.(*S3Backend); !ok {
+		t.Skip("only for S3")
+	}
+
+	file1, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	// not listed, only fetched on demand
+	names, err := file1.ListXattr()
+	t.Assert(err, IsNil)
+	for _, n := range names {
+		t.Assert(n, Not(Equals), ACL_XATTR)
+	}
+
+	err = file1.SetXattr(ACL_XATTR, []byte("public-read"), 0)
+	t.Assert(err, IsNil)
+
+	value, err := file1.GetXattr(ACL_XATTR)
+	t.Assert(err, IsNil)
+	t.Assert(strings.Contains(string(value),
+		"uri=http://acs.amazonaws.com/groups/global/AllUsers:READ"), Equals, true)
+
+	err = file1.SetXattr(ACL_XATTR, []byte("private"), 0)
+	t.Assert(err, IsNil)
+
+	value, err = file1.GetXattr(ACL_XATTR)
+	t.Assert(err, IsNil)
+	t.Assert(strings.Contains(string(value), "AllUsers"), Equals, false)
+}
+
+func (s *GoofysTest) TestDuXattr(t *C) {
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+
+	root := s.getRoot(t)
+	value, err := root.du()
+	t.Assert(err, IsNil)
+	// file contents are their keys
+	t.Assert(string(value), Equals, "45 6")
+
+	dir2, err := s.LookUpInode(t, "dir2")
+	t.Assert(err, IsNil)
+	value, err = dir2.du()
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "15 1")
+
+	emptyDir, err := s.LookUpInode(t, "empty_dir")
+	t.Assert(err, IsNil)
+	value, err = emptyDir.du()
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "0 0")
+
+	file1, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	_, err = file1.du()
+	t.Assert(err, Equals, syscall.ENODATA)
+
+	// changes behind our back are only seen once the cache expires
+	// or is invalidated
+	s.setupBlobs(t, map[string]io.ReadSeeker{"dir2/file6": nil})
+	value, err = dir2.du()
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "15 1")
+
+	dir2.invalidate()
+	value, err = dir2.du()
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "25 2")
+}
+
 func (s *GoofysTest) TestXAttrGetCached(t *C) {
 	if _, ok := s.cloud.(*ADLv1); ok {
 		t.Skip("ADLv1 doesn't support metadata")
 	}
 
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 	s.readDirIntoCache(t, fuseops.RootInodeID)
 	s.disableS3()
 
@@ -2099,8 +2986,8 @@ func (s *GoofysTest) TestReadDirSlurpSubtree(t *C) {
 	if _, ok := s.cloud.(*S3Backend); !ok {
 		t.Skip("only for S3")
 	}
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+	s.fs.SetStatCacheTTL(1 * time.Minute)
 
 	s.getRoot(t).dir.seqOpenDirScore = 2
 	in, err := s.LookUpInode(t, "dir2")
@@ -2121,8 +3008,8 @@ func (s *GoofysTest) TestReadDirSlurpSubtree(t *C) {
 }
 
 func (s *GoofysTest) TestReadDirCached(t *C) {
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 
 	s.getRoot(t).dir.seqOpenDirScore = 2
 	s.readDirIntoCache(t, fuseops.RootInodeID)
@@ -2289,8 +3176,8 @@ func (s *GoofysTest) TestRead403(t *C) {
 		t.Skip("only for S3")
 	}
 
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 
 	// cache the inode first so we don't get 403 when we lookup
 	in, err := s.LookUpInode(t, "file1")
@@ -2307,19 +3194,19 @@ func (s *GoofysTest) TestRead403(t *C) {
 
 	buf := make([]byte, 5)
 
-	_, err = fh.ReadFile(0, buf)
-	t.Assert(err, Equals, syscall.EACCES)
+	_, err = fh.ReadFile(s.ctx, 0, buf)
+	t.Assert(isErrorClass(err, "denied"), Equals, true)
 
 	// now that the S3 GET has failed, try again, see
 	// https://github.com/kahing/goofys/pull/243
-	_, err = fh.ReadFile(0, buf)
-	t.Assert(err, Equals, syscall.EACCES)
+	_, err = fh.ReadFile(s.ctx, 0, buf)
+	t.Assert(isErrorClass(err, "denied"), Equals, true)
 }
 
 func (s *GoofysTest) TestRmdirWithDiropen(t *C) {
 	mountPoint := "/tmp/mnt" + s.fs.bucket
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 
 	s.mount(t, mountPoint)
 	defer s.umount(t, mountPoint)
@@ -2391,8 +3278,8 @@ func (s *GoofysTest) TestRmdirWithDiropen(t *C) {
 }
 
 func (s *GoofysTest) TestDirMTime(t *C) {
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetStatCacheTTL(1 * time.Minute)
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 	// enable cheap to ensure GET dir/ will come back before LIST dir/
 	s.fs.flags.Cheap = true
 
@@ -2425,7 +3312,7 @@ func (s *GoofysTest) TestDirMTime(t *C) {
 	t.Assert(m1, Equals, m2)
 
 	// we never added the inode so this will do the lookup again
-	dir2, err = dir1.LookUp("dir2")
+	dir2, err = dir1.LookUp(s.ctx, "dir2")
 	t.Assert(err, IsNil)
 
 	// the new time comes from S3 which only has seconds
@@ -2466,7 +3353,7 @@ func (s *GoofysTest) TestDirMTime(t *C) {
 
 	s.readDirIntoCache(t, dir2.Id)
 
-	newfile, err := dir2.LookUp("newfile")
+	newfile, err := dir2.LookUp(s.ctx, "newfile")
 	t.Assert(err, IsNil)
 
 	attr2New, _ := dir2.GetAttributes()
@@ -2534,8 +3421,8 @@ func (s *GoofysTest) TestSlurpFileAndDir(t *C) {
 		t.Assert(err, IsNil)
 	}
 
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+	s.fs.SetStatCacheTTL(1 * time.Minute)
 
 	in, err := s.LookUpInode(t, prefix[0:len(prefix)-1])
 	t.Assert(err, IsNil)
@@ -2702,11 +3589,11 @@ func (s *GoofysTest) TestVFS(t *C) {
 	t.Assert(rootPath, Equals, "cloud2Prefix")
 
 	// the mount would shadow dir4/file5
-	_, err = in.LookUp("file5")
+	_, err = in.LookUp(s.ctx, "file5")
 	t.Assert(err, Equals, fuse.ENOENT)
 
 	_, fh := in.Create("testfile")
-	err = fh.FlushFile()
+	err = fh.FlushFile(s.ctx)
 	t.Assert(err, IsNil)
 
 	resp, err := cloud2.GetBlob(&GetBlobInput{Key: "cloud2Prefix/testfile"})
@@ -2741,7 +3628,7 @@ func (s *GoofysTest) TestVFS(t *C) {
 	// create another file inside subdir to make sure that our
 	// mount check is correct for dir inside the root
 	_, fh = subdir.Create("testfile2")
-	err = fh.FlushFile()
+	err = fh.FlushFile(s.ctx)
 	t.Assert(err, IsNil)
 
 	resp, err = cloud2.GetBlob(&GetBlobInput{Key: "cloud2Prefix/subdir/testfile2"})
@@ -2770,8 +3657,8 @@ func (s *GoofysTest) TestVFS(t *C) {
 }
 
 func (s *GoofysTest) TestMountsList(t *C) {
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
-	s.fs.flags.StatCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
+	s.fs.SetStatCacheTTL(1 * time.Minute)
 
 	bucket := "goofys-test-" + RandStringBytesMaskImprSrc(16)
 	cloud := s.newBackend(t, bucket, true)
@@ -2780,7 +3667,7 @@ func (s *GoofysTest) TestMountsList(t *C) {
 	rootCloud := root.dir.cloud
 
 	s.fs.MountAll([]*Mount{
-		&Mount{"dir4/cloud1", cloud, "", false},
+		&Mount{"dir4/cloud1", cloud, "", nil, false},
 	})
 
 	in, err := s.LookUpInode(t, "dir4")
@@ -2801,8 +3688,8 @@ func (s *GoofysTest) TestMountsList(t *C) {
 	t.Assert(int(c1.Id), Equals, 3)
 
 	// pretend we've passed the normal cache ttl
-	s.fs.flags.TypeCacheTTL = 0
-	s.fs.flags.StatCacheTTL = 0
+	s.fs.SetTypeCacheTTL(0)
+	s.fs.SetStatCacheTTL(0)
 
 	// listing root again should not overwrite the mounts
 	root.dir.cloud = rootCloud
@@ -2826,7 +3713,7 @@ func (s *GoofysTest) TestMountsNewDir(t *C) {
 	t.Assert(err, Equals, fuse.ENOENT)
 
 	s.fs.MountAll([]*Mount{
-		&Mount{"dir5/cloud1", cloud, "", false},
+		&Mount{"dir5/cloud1", cloud, "", nil, false},
 	})
 
 	in, err := s.LookUpInode(t, "dir5")
@@ -2849,7 +3736,7 @@ func (s *GoofysTest) TestMountsNewMounts(t *C) {
 	t.Assert(err, IsNil)
 
 	s.fs.MountAll([]*Mount{
-		&Mount{"dir4/cloud1", cloud, "", false},
+		&Mount{"dir4/cloud1", cloud, "", nil, false},
 	})
 
 	s.readDirIntoCache(t, in.Id)
@@ -2863,8 +3750,8 @@ func (s *GoofysTest) TestMountsNewMounts(t *C) {
 	t.Assert(err, Equals, fuse.ENOENT)
 
 	s.fs.MountAll([]*Mount{
-		&Mount{"dir4/cloud1", cloud, "", false},
-		&Mount{"dir4/cloud2", cloud, "cloudprefix", false},
+		&Mount{"dir4/cloud1", cloud, "", nil, false},
+		&Mount{"dir4/cloud2", cloud, "cloudprefix", nil, false},
 	})
 
 	c2, err := s.LookUpInode(t, "dir4/cloud2")
@@ -2896,11 +3783,11 @@ func (s *GoofysTest) TestMountsError(t *C) {
 	s.fs.MountAll([]*Mount{
 		&Mount{"dir4/newerror", StorageBackendInitError{
 			fmt.Errorf("foo"),
-		}, "errprefix1", false},
+		}, "errprefix1", nil, false},
 		&Mount{"dir4/initerror", &StorageBackendInitWrapper{
 			StorageBackend: cloud,
 			initKey:        "foobar",
-		}, "errprefix2", false},
+		}, "errprefix2", nil, false},
 	})
 
 	errfile, err := s.LookUpInode(t, "dir4/newerror/"+INIT_ERR_BLOB)
@@ -2919,13 +3806,13 @@ func (s *GoofysTest) TestMountsError(t *C) {
 }
 
 func (s *GoofysTest) TestMountsMultiLevel(t *C) {
-	s.fs.flags.TypeCacheTTL = 1 * time.Minute
+	s.fs.SetTypeCacheTTL(1 * time.Minute)
 
 	bucket := "goofys-test-" + RandStringBytesMaskImprSrc(16)
 	cloud := s.newBackend(t, bucket, true)
 
 	s.fs.MountAll([]*Mount{
-		&Mount{"dir4/sub/dir", cloud, "", false},
+		&Mount{"dir4/sub/dir", cloud, "", nil, false},
 	})
 
 	sub, err := s.LookUpInode(t, "dir4/sub")
@@ -2939,8 +3826,8 @@ func (s *GoofysTest) TestMountsNested(t *C) {
 	bucket := "goofys-test-" + RandStringBytesMaskImprSrc(16)
 	cloud := s.newBackend(t, bucket, true)
 	s.testMountsNested(t, cloud, []*Mount{
-		&Mount{"dir5/in/a/dir", cloud, "a/dir/", false},
-		&Mount{"dir5/in/", cloud, "b/", false},
+		&Mount{"dir5/in/a/dir", cloud, "a/dir/", nil, false},
+		&Mount{"dir5/in/", cloud, "b/", nil, false},
 	})
 }
 
@@ -2949,8 +3836,8 @@ func (s *GoofysTest) TestMountsNestedReversed(t *C) {
 	bucket := "goofys-test-" + RandStringBytesMaskImprSrc(16)
 	cloud := s.newBackend(t, bucket, true)
 	s.testMountsNested(t, cloud, []*Mount{
-		&Mount{"dir5/in/", cloud, "b/", false},
-		&Mount{"dir5/in/a/dir", cloud, "a/dir/", false},
+		&Mount{"dir5/in/", cloud, "b/", nil, false},
+		&Mount{"dir5/in/a/dir", cloud, "a/dir/", nil, false},
 	})
 }
 
@@ -2988,7 +3875,7 @@ func (s *GoofysTest) testMountsNested(t *C, cloud StorageBackend,
 	t.Assert(dir_dir.dir.cloud == cloud, Equals, true)
 
 	_, fh := dir_in.Create("testfile")
-	err = fh.FlushFile()
+	err = fh.FlushFile(s.ctx)
 	t.Assert(err, IsNil)
 
 	resp, err := cloud.GetBlob(&GetBlobInput{Key: "b/testfile"})
@@ -2996,7 +3883,7 @@ func (s *GoofysTest) testMountsNested(t *C, cloud StorageBackend,
 	defer resp.Body.Close()
 
 	_, fh = dir_dir.Create("testfile")
-	err = fh.FlushFile()
+	err = fh.FlushFile(s.ctx)
 	t.Assert(err, IsNil)
 
 	resp, err = cloud.GetBlob(&GetBlobInput{Key: "a/dir/testfile"})
@@ -15,12 +15,14 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -60,6 +62,16 @@ type Inode struct {
 	userMetadata map[string][]byte
 	s3Metadata   map[string][]byte
 
+	// from the object's Cache-Control/Expires, overrides
+	// StatCacheTTL if not negative. Accessed atomically, stats.go
+	// reads it without inode.mu
+	cacheTTL int64 // time.Duration
+
+	// S3 Object Lock retention and legal hold, the object can't
+	// be overwritten or deleted while either is in effect
+	retainUntil time.Time
+	legalHold   bool
+
 	// the refcnt is an exception, it's protected by the global lock
 	// Goofys.mu
 	refcnt uint64
@@ -73,10 +85,11 @@ func NewInode(fs *Goofys, parent *Inode, name *string) (inode *Inode) {
 	inode = &Inode{
 		Name:       name,
 		fs:         fs,
-		AttrTime:   time.Now(),
+		AttrTime:   fs.clock.Now(),
 		Parent:     parent,
 		s3Metadata: make(map[string][]byte),
 		refcnt:     1,
+		cacheTTL:   -1,
 	}
 
 	return
@@ -104,7 +117,7 @@ func (inode *Inode) SetFromBlobItem(item *BlobItemOutput) {
 	} else {
 		delete(inode.s3Metadata, "storage-class")
 	}
-	now := time.Now()
+	now := inode.fs.clock.Now()
 	// don't want to update time if this inode is setup to never expire
 	if inode.AttrTime.Before(now) {
 		inode.AttrTime = now
@@ -127,13 +140,13 @@ func (inode *Inode) cloud() (cloud StorageBackend, path string) {
 			cloud = p.dir.cloud
 			// the error backend produces a mount.err file
 			// at the root and is not aware of prefix
-			_, isErr := cloud.(StorageBackendInitError)
+			_, isErr := unwrapBackend(cloud).(StorageBackendInitError)
 			if !isErr {
 				// we call init here instead of
 				// relying on the wrapper to call init
 				// because we want to return the right
 				// prefix
-				if c, ok := cloud.(*StorageBackendInitWrapper); ok {
+				if c, ok := unwrapBackend(cloud).(*StorageBackendInitWrapper); ok {
 					err := c.Init("")
 					isErr = err != nil
 				}
@@ -190,16 +203,32 @@ func (inode *Inode) InflateAttributes() (attr fuseops.InodeAttributes) {
 		Gid:    inode.fs.flags.Gid,
 	}
 
+	if t := inode.tenant(); t != nil {
+		if t.Uid != nil {
+			attr.Uid = *t.Uid
+		}
+		if t.Gid != nil {
+			attr.Gid = *t.Gid
+		}
+	}
+
 	if inode.dir != nil {
 		attr.Nlink = 2
 		attr.Mode = inode.fs.flags.DirMode | os.ModeDir
 	} else {
 		attr.Nlink = 1
 		attr.Mode = inode.fs.flags.FileMode
+		if inode.objectLocked() {
+			attr.Mode &^= 0222
+		}
 	}
 	return
 }
 
+func (inode *Inode) objectLocked() bool {
+	return inode.legalHold || inode.retainUntil.After(inode.fs.clock.Now())
+}
+
 func (inode *Inode) logFuse(op string, args ...interface{}) {
 	if fuseLog.Level >= logrus.DebugLevel {
 		fuseLog.Debugln(op, inode.Id, *inode.FullName(), args)
@@ -357,10 +386,10 @@ func (parent *Inode) insertChildUnlocked(inode *Inode) {
 	}
 }
 
-func (parent *Inode) LookUp(name string) (inode *Inode, err error) {
+func (parent *Inode) LookUp(ctx context.Context, name string) (inode *Inode, err error) {
 	parent.logFuse("Inode.LookUp", name)
 
-	inode, err = parent.LookUpInodeMaybeDir(name, parent.getChildName(name))
+	inode, err = parent.LookUpInodeMaybeDir(ctx, name, parent.getChildName(name))
 	if err != nil {
 		return nil, err
 	}
@@ -406,6 +435,23 @@ func (parent *Inode) Unlink(name string) (err error) {
 	cloud, key := parent.cloud()
 	key = appendChildName(key, name)
 
+	parent.mu.Lock()
+	inode := parent.findChildUnlocked(name, false)
+	parent.mu.Unlock()
+
+	var size uint64
+	if inode != nil {
+		if inode.objectLocked() {
+			inode.errFuse("Unlink: object is locked until", inode.retainUntil,
+				"legal hold", inode.legalHold)
+			return syscall.EPERM
+		}
+
+		inode.mu.Lock()
+		size = inode.Attributes.Size
+		inode.mu.Unlock()
+	}
+
 	_, err = cloud.DeleteBlob(&DeleteBlobInput{
 		Key: key,
 	})
@@ -416,11 +462,12 @@ func (parent *Inode) Unlink(name string) (err error) {
 	if err != nil {
 		return
 	}
+	parent.tenant().removed(size)
 
 	parent.mu.Lock()
 	defer parent.mu.Unlock()
 
-	inode := parent.findChildUnlocked(name, false)
+	inode = parent.findChildUnlocked(name, false)
 	if inode != nil {
 		parent.removeChildUnlocked(inode)
 		inode.Parent = nil
@@ -602,6 +649,40 @@ func (inode *Inode) fillXattrFromHead(resp *HeadBlobOutput) {
 		}
 		inode.userMetadata[k] = []byte(value)
 	}
+
+	if inode.fs.flags.UseCacheControl {
+		if ttl, ok := cacheControlTTL(resp.CacheControl, resp.Expires, inode.fs.clock.Now()); ok {
+			atomic.StoreInt64(&inode.cacheTTL, int64(ttl))
+		}
+	}
+
+	if resp.ObjectLockMode != nil {
+		inode.s3Metadata["object-lock-mode"] = []byte(*resp.ObjectLockMode)
+	} else {
+		delete(inode.s3Metadata, "object-lock-mode")
+	}
+	if resp.ObjectLockRetainUntilDate != nil {
+		inode.retainUntil = *resp.ObjectLockRetainUntilDate
+		inode.s3Metadata["object-lock-retain-until-date"] =
+			[]byte(inode.retainUntil.UTC().Format(time.RFC3339))
+	} else {
+		inode.retainUntil = time.Time{}
+		delete(inode.s3Metadata, "object-lock-retain-until-date")
+	}
+	if resp.ObjectLockLegalHoldStatus != nil {
+		inode.legalHold = *resp.ObjectLockLegalHoldStatus == "ON"
+		inode.s3Metadata["object-lock-legal-hold"] = []byte(*resp.ObjectLockLegalHoldStatus)
+	} else {
+		inode.legalHold = false
+		delete(inode.s3Metadata, "object-lock-legal-hold")
+	}
+}
+
+func (inode *Inode) statCacheTTL() time.Duration {
+	if ttl := atomic.LoadInt64(&inode.cacheTTL); ttl >= 0 {
+		return time.Duration(ttl)
+	}
+	return inode.fs.StatCacheTTL()
 }
 
 // LOCKS_REQUIRED(inode.mu)
@@ -695,6 +776,10 @@ func (inode *Inode) SetXattr(name string, value []byte, flags uint32) error {
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
+	if name == ACL_XATTR {
+		return inode.setACL(value)
+	}
+
 	meta, name, err := inode.getXattrMap(name, true)
 	if err != nil {
 		return err
@@ -744,6 +829,10 @@ func (inode *Inode) GetXattr(name string) ([]byte, error) {
 	inode.mu.Lock()
 	defer inode.mu.Unlock()
 
+	if name == ACL_XATTR {
+		return inode.getACL()
+	}
+
 	meta, name, err := inode.getXattrMap(name, false)
 	if err != nil {
 		return nil, err
@@ -813,6 +902,13 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 		return
 	}
 
+	// rename deletes the source object
+	if inode := parent.findChildUnlocked(from, false); inode != nil && inode.objectLocked() {
+		inode.errFuse("Rename: object is locked until", inode.retainUntil,
+			"legal hold", inode.legalHold)
+		return syscall.EPERM
+	}
+
 	fromFullName := appendChildName(fromPath, from)
 	fs := parent.fs
 
@@ -883,9 +979,11 @@ func (parent *Inode) renameObject(fs *Goofys, size *uint64, fromFullName string,
 	}
 
 	_, err = cloud.CopyBlob(&CopyBlobInput{
-		Source:      fromFullName,
-		Destination: toFullName,
-		Size:        size,
+		Source:       fromFullName,
+		Destination:  toFullName,
+		Size:         size,
+		StorageClass: parent.tenant().storageClass(),
+		Tags:         parent.tenant().tags(),
 	})
 	if err != nil {
 		return
@@ -1021,7 +1119,7 @@ func (parent *Inode) readDirFromCache(offset fuseops.DirOffset) (en *DirHandleEn
 	if parent.dir == nil {
 		panic(*parent.FullName())
 	}
-	if !expired(parent.dir.DirTime, parent.fs.flags.TypeCacheTTL) {
+	if !parent.fs.expired(parent.dir.DirTime, parent.fs.TypeCacheTTL()) {
 		ok = true
 
 		if int(offset) >= len(parent.dir.Children) {
@@ -1044,10 +1142,10 @@ func (parent *Inode) readDirFromCache(offset fuseops.DirOffset) (en *DirHandleEn
 	return
 }
 
-func (parent *Inode) LookUpInodeNotDir(name string, c chan HeadBlobOutput, errc chan error) {
+func (parent *Inode) LookUpInodeNotDir(ctx context.Context, name string, c chan HeadBlobOutput, errc chan error) {
 	cloud, key := parent.cloud()
 	key = appendChildName(key, name)
-	params := &HeadBlobInput{Key: key}
+	params := &HeadBlobInput{Key: key, Context: ctx}
 	resp, err := cloud.HeadBlob(params)
 	if err != nil {
 		errc <- mapAwsError(err)
@@ -1058,7 +1156,7 @@ func (parent *Inode) LookUpInodeNotDir(name string, c chan HeadBlobOutput, errc
 	c <- *resp
 }
 
-func (parent *Inode) LookUpInodeDir(name string, c chan ListBlobsOutput, errc chan error) {
+func (parent *Inode) LookUpInodeDir(ctx context.Context, name string, c chan ListBlobsOutput, errc chan error) {
 	cloud, key := parent.cloud()
 	key = appendChildName(key, name) + "/"
 
@@ -1066,6 +1164,7 @@ func (parent *Inode) LookUpInodeDir(name string, c chan ListBlobsOutput, errc ch
 		Delimiter: aws.String("/"),
 		MaxKeys:   PUInt32(1),
 		Prefix:    &key,
+		Context:   ctx,
 	}
 
 	resp, err := cloud.ListBlobs(params)
@@ -1079,7 +1178,12 @@ func (parent *Inode) LookUpInodeDir(name string, c chan ListBlobsOutput, errc ch
 }
 
 // returned inode has nil Id
-func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *Inode, err error) {
+func (parent *Inode) LookUpInodeMaybeDir(ctx context.Context, name string, fullName string) (inode *Inode, err error) {
+	// we return as soon as we have an answer, don't leave the
+	// other requests running
+	ctx, cancel := context.WithCancel(contextOrTODO(ctx))
+	defer cancel()
+
 	errObjectChan := make(chan error, 1)
 	objectChan := make(chan HeadBlobOutput, 2)
 	errDirBlobChan := make(chan error, 1)
@@ -1094,13 +1198,16 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 		panic("s3 disabled")
 	}
 
-	go parent.LookUpInodeNotDir(name, objectChan, errObjectChan)
-	if !cloud.Capabilities().DirBlob && !parent.fs.flags.Cheap {
-		go parent.LookUpInodeNotDir(name+"/", objectChan, errDirBlobChan)
+	// the same for the whole lookup even if the startup burst ends
+	cheap := parent.fs.cheap()
+
+	go parent.LookUpInodeNotDir(ctx, name, objectChan, errObjectChan)
+	if !cloud.Capabilities().DirBlob && !cheap {
+		go parent.LookUpInodeNotDir(ctx, name+"/", objectChan, errDirBlobChan)
 		if !parent.fs.flags.ExplicitDir {
 			errDirChan = make(chan error, 1)
 			dirChan = make(chan ListBlobsOutput, 1)
-			go parent.LookUpInodeDir(name, dirChan, errDirChan)
+			go parent.LookUpInodeDir(ctx, name, dirChan, errDirChan)
 		}
 	}
 
@@ -1151,7 +1258,7 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 				}
 				// if cheap is not on, the dir blob
 				// could exist but this returned first
-				if inode.fs.flags.Cheap {
+				if cheap {
 					inode.ImplicitDir = true
 				}
 				return
@@ -1175,17 +1282,17 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 
 		switch checking {
 		case 2:
-			if parent.fs.flags.Cheap {
-				go parent.LookUpInodeNotDir(name+"/", objectChan, errDirBlobChan)
+			if cheap {
+				go parent.LookUpInodeNotDir(ctx, name+"/", objectChan, errDirBlobChan)
 			}
 		case 1:
 			if parent.fs.flags.ExplicitDir {
 				checkErr[2] = fuse.ENOENT
 				goto doneCase
-			} else if parent.fs.flags.Cheap {
+			} else if cheap {
 				errDirChan = make(chan error, 1)
 				dirChan = make(chan ListBlobsOutput, 1)
-				go parent.LookUpInodeDir(name, dirChan, errDirChan)
+				go parent.LookUpInodeDir(ctx, name, dirChan, errDirChan)
 			}
 			break
 		doneCase:
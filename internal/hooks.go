@@ -0,0 +1,227 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/kahing/goofys/api/common"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hooks tell operators about what happens to the mount, by running
+// --hook-exec with the event in the environment and/or POSTing it as
+// JSON to --hook-webhook, so they don't need to scrape the logs.
+
+const (
+	HOOK_MOUNT_READY               = "mount-ready"
+	HOOK_CREDENTIAL_REFRESH_FAILED = "credential-refresh-failed"
+	HOOK_DEGRADED_MODE_ENTERED     = "degraded-mode-entered"
+	HOOK_FLUSH_FAILED              = "flush-failed"
+	HOOK_BUDGET_EXCEEDED           = "budget-exceeded"
+	HOOK_UNMOUNTED                 = "unmounted"
+)
+
+var hookEvents = []string{HOOK_MOUNT_READY, HOOK_CREDENTIAL_REFRESH_FAILED,
+	HOOK_DEGRADED_MODE_ENTERED, HOOK_FLUSH_FAILED, HOOK_BUDGET_EXCEEDED, HOOK_UNMOUNTED}
+
+// the same event is not sent more often than this, so a failing
+// bucket doesn't run a command for every write
+const HOOK_MIN_INTERVAL = time.Minute
+
+const HOOK_TIMEOUT = 30 * time.Second
+
+type hookSet struct {
+	exec       string
+	webhook    string
+	events     map[string]bool
+	bucket     string
+	mountPoint string
+
+	mu   sync.Mutex
+	last map[string]time.Time
+	wg   sync.WaitGroup
+}
+
+// parseHookEvents parses --hook-events, which is a comma separated
+// list of events, or "all"
+func parseHookEvents(s string) (map[string]bool, error) {
+	events := make(map[string]bool)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "all" {
+			for _, e := range hookEvents {
+				events[e] = true
+			}
+			continue
+		}
+
+		known := false
+		for _, k := range hookEvents {
+			if e == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event %v, expected one of %v or all",
+				e, strings.Join(hookEvents, ", "))
+		}
+		events[e] = true
+	}
+	return events, nil
+}
+
+func newHookSet(flags *FlagStorage, bucket string) (*hookSet, error) {
+	events, err := parseHookEvents(flags.HookEvents)
+	if err != nil {
+		return nil, err
+	}
+	return &hookSet{
+		exec:       flags.HookExec,
+		webhook:    flags.HookWebhook,
+		events:     events,
+		bucket:     bucket,
+		mountPoint: flags.MountPoint,
+		last:       make(map[string]time.Time),
+	}, nil
+}
+
+// watch has the backends behind cloud send their events, like
+// failing to refresh the credentials, to h
+func (h *hookSet) watch(cloud StorageBackend) {
+	switch c := unwrapBackend(cloud).(type) {
+	case *StorageBackendInitWrapper:
+		c.hooks = h
+		h.watch(c.StorageBackend)
+	case *S3Backend:
+		c.hooks = h
+	case *GCS3:
+		c.hooks = h
+	case *AZBlob:
+		c.hooks = h
+	}
+}
+
+// fire runs the hooks for event in the background, detail says what
+// happened. h may be nil if there are no hooks
+func (h *hookSet) fire(event string, detail string) {
+	if h == nil || !h.events[event] {
+		return
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	if last, ok := h.last[event]; ok && now.Sub(last) < HOOK_MIN_INTERVAL {
+		h.mu.Unlock()
+		log.Debugf("hook %v: %v, skipped, sent at %v", event, detail, last)
+		return
+	}
+	h.last[event] = now
+	h.mu.Unlock()
+
+	log.Infof("hook %v: %v", event, detail)
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.run(event, detail, now)
+	}()
+}
+
+// wait waits up to timeout for the hooks that are running to finish
+func (h *hookSet) wait(timeout time.Duration) {
+	if h == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warnf("Gave up waiting for the hooks after %v", timeout)
+	}
+}
+
+// FireHook runs the hooks of this mount for event, for the events
+// that happen outside of it, like being mounted
+func (fs *Goofys) FireHook(event string, detail string) {
+	fs.hooks.fire(event, detail)
+}
+
+// WaitHooks waits up to timeout for the hooks that are running to
+// finish, ie: before exiting
+func (fs *Goofys) WaitHooks(timeout time.Duration) {
+	fs.hooks.wait(timeout)
+}
+
+func (h *hookSet) run(event string, detail string, now time.Time) {
+	if h.exec != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), HOOK_TIMEOUT)
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.exec)
+		cmd.Env = append(os.Environ(),
+			"GOOFYS_EVENT="+event,
+			"GOOFYS_DETAIL="+detail,
+			"GOOFYS_BUCKET="+h.bucket,
+			"GOOFYS_MOUNTPOINT="+h.mountPoint)
+		out, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			log.Errorf("hook %v: %v failed: %v %v", event, h.exec, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	if h.webhook != "" {
+		err := h.post(event, detail, now)
+		if err != nil {
+			log.Errorf("hook %v: POST %v failed: %v", event, h.webhook, err)
+		}
+	}
+}
+
+func (h *hookSet) post(event string, detail string, now time.Time) error {
+	body, err := json.Marshal(map[string]string{
+		"event":      event,
+		"detail":     detail,
+		"bucket":     h.bucket,
+		"mountpoint": h.mountPoint,
+		"time":       now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: HOOK_TIMEOUT}
+	resp, err := client.Post(h.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// SSE_C_KEY_ID_METADATA is set on the objects written with an SSE-C
+// key from the keyring, so whoever reads them later knows which key to
+// ask for. S3 wants the key to HEAD them too, so this helps tools that
+// have a few keys to try, and shows up as a user.* xattr.
+const SSE_C_KEY_ID_METADATA = "goofys-sse-c-key-id"
+
+// sseCFromKeyring returns the SSE-C key stored in the keyring
+// under description. The payload is either the 32 byte key itself or
+// its base64 encoding, so both `keyctl padd` and `keyctl add` work.
+func sseCFromKeyring(description string) (string, error) {
+	payload, err := keyringKey(description)
+	if err != nil {
+		return "", fmt.Errorf("unable to get key %v from the keyring: %v", description, err)
+	}
+
+	if len(payload) == 32 {
+		return string(payload), nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(payload)))
+	if err != nil || len(key) != 32 {
+		return "", fmt.Errorf("key %v is not a 256-bit key", description)
+	}
+	return string(key), nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const KEYCTL_READ = 11
+
+// keyringKey returns the payload of the user key named description,
+// asking request-key(8) to instantiate it if it's not in any of our
+// keyrings
+func keyringKey(description string) ([]byte, error) {
+	keyType, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return nil, err
+	}
+	desc, err := syscall.BytePtrFromString(description)
+	if err != nil {
+		return nil, err
+	}
+	// without callout info there's no upcall
+	callout, err := syscall.BytePtrFromString("goofys")
+	if err != nil {
+		return nil, err
+	}
+
+	id, _, errno := syscall.Syscall6(syscall.SYS_REQUEST_KEY,
+		uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(desc)),
+		uintptr(unsafe.Pointer(callout)), 0, 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	buf := make([]byte, 4096)
+	n, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, KEYCTL_READ, id,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	if int(n) > len(buf) {
+		return nil, syscall.E2BIG
+	}
+	return buf[:n], nil
+}
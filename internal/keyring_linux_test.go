@@ -0,0 +1,88 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/kahing/goofys/api/common"
+
+	"bytes"
+	"encoding/base64"
+	"syscall"
+	"unsafe"
+
+	. "gopkg.in/check.v1"
+)
+
+const KEY_SPEC_PROCESS_KEYRING = -2
+
+func addKey(description string, payload []byte) error {
+	keyType, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return err
+	}
+	desc, err := syscall.BytePtrFromString(description)
+	if err != nil {
+		return err
+	}
+
+	ringId := KEY_SPEC_PROCESS_KEYRING
+	_, _, errno := syscall.Syscall6(syscall.SYS_ADD_KEY,
+		uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(desc)),
+		uintptr(unsafe.Pointer(&payload[0])), uintptr(len(payload)),
+		uintptr(ringId), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (s *UtilsTest) TestSseCFromKeyring(t *C) {
+	prefix := "goofys-test-" + RandStringBytesMaskImprSrc(8) + "-"
+	key := bytes.Repeat([]byte{'k'}, 32)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	err := addKey(prefix+"raw", key)
+	if err != nil {
+		t.Skip("no kernel keyring: " + err.Error())
+	}
+	t.Assert(addKey(prefix+"base64", []byte(encoded+"\n")), IsNil)
+	t.Assert(addKey(prefix+"short", key[:16]), IsNil)
+
+	for _, desc := range []string{"raw", "base64"} {
+		sseC, err := sseCFromKeyring(prefix + desc)
+		t.Assert(err, IsNil)
+		t.Assert(sseC, Equals, string(key))
+	}
+
+	// the key is only kept by the backend
+	config := &S3Config{
+		Region:    "us-east-1",
+		AccessKey: "foo",
+		SecretKey: "bar",
+		SseCKeyId: prefix + "raw",
+	}
+	s3, err := NewS3("bucket", &FlagStorage{}, config)
+	t.Assert(err, IsNil)
+	t.Assert(s3.sseC, Equals, string(key))
+	t.Assert(s3.sseCDigest, Not(Equals), "")
+	t.Assert(config.SseC, Equals, "")
+	t.Assert(config.SseCDigest, Equals, "")
+
+	_, err = sseCFromKeyring(prefix + "short")
+	t.Assert(err, ErrorMatches, "key .* is not a 256-bit key")
+
+	_, err = sseCFromKeyring(prefix + "missing")
+	t.Assert(err, ErrorMatches, "unable to get key .* from the keyring: .*")
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// S3 passes KMS failures through as generic 400/403s, which would
+// look like a missing s3 permission. Tell them apart so they can be
+// debugged as the key problems that they are.
+
+var (
+	kmsAccessDenied = NewCounter("kms.access_denied")
+	kmsKeyDisabled  = NewCounter("kms.key_disabled")
+	kmsThrottled    = NewCounter("kms.throttled")
+)
+
+func mapKMSError(reqErr awserr.RequestFailure) (err error, isKMS bool) {
+	code := reqErr.Code()
+	msg := reqErr.Message()
+
+	if strings.HasPrefix(code, "KMS.") {
+		code = code[4:]
+	} else if code == "AccessDenied" && strings.Contains(msg, "kms:") {
+		// "... is not authorized to perform: kms:Decrypt ..."
+		code = "AccessDeniedException"
+	} else {
+		return nil, false
+	}
+
+	switch code {
+	case "AccessDeniedException":
+		kmsAccessDenied.Inc()
+		err = classError("kms-denied")
+	case "DisabledException", "KMSInvalidStateException", "NotFoundException",
+		"InvalidKeyUsageException", "KeyUnavailableException":
+		kmsKeyDisabled.Inc()
+		err = classError("kms-disabled")
+	case "ThrottlingException", "LimitExceededException":
+		kmsThrottled.Inc()
+		err = classError("kms-throttled")
+	default:
+		kmsAccessDenied.Inc()
+		err = classError("kms-denied")
+	}
+
+	s3Log.Errorf("KMS error code=%v msg=%v request=%v: check the key policy and "+
+		"the key state, not the bucket policy", reqErr.Code(), msg, reqErr.RequestID())
+	return err, true
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// runtime knobs are exposed as xattrs of the mount root, ie:
+//
+//	setfattr -n user.goofys.stat-cache-ttl -v 5m /mnt
+//
+// user. is the only namespace that linux lets unprivileged users
+// set, and the root is never backed by an object so there's no
+// conflict with user metadata
+const knobPrefix = "user.goofys."
+
+type knob struct {
+	get func(fs *Goofys) string
+	set func(fs *Goofys, value string) error
+	// the value is a path in the mount, see --trace-anonymize
+	path bool
+}
+
+// the cache TTLs start out as --stat-cache-ttl and --type-cache-ttl
+// and are only accessed atomically after that
+func (fs *Goofys) StatCacheTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&fs.statCacheTTL))
+}
+
+func (fs *Goofys) SetStatCacheTTL(d time.Duration) {
+	atomic.StoreInt64(&fs.statCacheTTL, int64(d))
+}
+
+func (fs *Goofys) TypeCacheTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&fs.typeCacheTTL))
+}
+
+func (fs *Goofys) SetTypeCacheTTL(d time.Duration) {
+	atomic.StoreInt64(&fs.typeCacheTTL, int64(d))
+}
+
+func durationKnob(get func(fs *Goofys) time.Duration,
+	set func(fs *Goofys, d time.Duration)) knob {
+
+	return knob{
+		get: func(fs *Goofys) string {
+			return get(fs).String()
+		},
+		set: func(fs *Goofys, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fuse.EINVAL
+			}
+			set(fs, d)
+			return nil
+		},
+	}
+}
+
+var knobs = map[string]knob{
+	"stat-cache-ttl": durationKnob((*Goofys).StatCacheTTL, (*Goofys).SetStatCacheTTL),
+	"type-cache-ttl": durationKnob((*Goofys).TypeCacheTTL, (*Goofys).SetTypeCacheTTL),
+	"readahead": knob{
+		get: func(fs *Goofys) string {
+			return strconv.FormatUint(uint64(atomic.LoadUint32(&fs.maxReadahead)), 10)
+		},
+		set: func(fs *Goofys, value string) error {
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || n < uint64(READAHEAD_CHUNK) {
+				return fuse.EINVAL
+			}
+			atomic.StoreUint32(&fs.maxReadahead, uint32(n))
+			return nil
+		},
+	},
+	// read only, bucket[:prefix] of the mount for goofys copy
+	"bucket": knob{
+		get: func(fs *Goofys) string {
+			fs.mu.RLock()
+			root := fs.inodes[fuseops.RootInodeID]
+			fs.mu.RUnlock()
+
+			if root.dir.mountPrefix == "" {
+				return fs.bucket
+			}
+			return fs.bucket + ":" + root.dir.mountPrefix
+		},
+		set: func(fs *Goofys, value string) error {
+			return syscall.EPERM
+		},
+	},
+	// write only, takes a path relative to the mount root
+	"invalidate": knob{
+		get: func(fs *Goofys) string {
+			return ""
+		},
+		set: func(fs *Goofys, value string) error {
+			return fs.InvalidatePath(value)
+		},
+		path: true,
+	},
+}
+
+func isKnob(name string) bool {
+	return strings.HasPrefix(name, knobPrefix)
+}
+
+func knobNames() (names []string) {
+	for k, _ := range knobs {
+		names = append(names, knobPrefix+k)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (fs *Goofys) getKnob(name string) ([]byte, error) {
+	k, ok := knobs[strings.TrimPrefix(name, knobPrefix)]
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+	return []byte(k.get(fs)), nil
+}
+
+func (fs *Goofys) setKnob(uid uint32, name string, value []byte) error {
+	if uid != 0 && uid != fs.flags.AdminUid {
+		return syscall.EPERM
+	}
+
+	k, ok := knobs[strings.TrimPrefix(name, knobPrefix)]
+	if !ok {
+		return syscall.ENODATA
+	}
+
+	err := k.set(fs, strings.TrimSpace(string(value)))
+	if err == nil {
+		log.Infof("%v set to %v by uid %v", name, k.get(fs), uid)
+	}
+	return err
+}
+
+// InvalidatePath forgets what we know about path and everything
+// below it, so they are looked up again on next access. Used when
+// objects are changed behind our back, ie: by goofys bulk
+func (fs *Goofys) InvalidatePath(path string) error {
+	fs.mu.RLock()
+	inode := fs.inodes[fuseops.RootInodeID]
+	fs.mu.RUnlock()
+
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		inode = inode.findChild(name)
+		if inode == nil {
+			// nothing cached
+			return nil
+		}
+	}
+
+	inode.invalidate()
+	return nil
+}
+
+func (inode *Inode) invalidate() {
+	inode.mu.Lock()
+	if inode.AttrTime != TIME_MAX {
+		inode.AttrTime = time.Time{}
+	}
+	var children []*Inode
+	if inode.dir != nil {
+		inode.dir.DirTime = time.Time{}
+		inode.dir.du = nil
+		children = append(children, inode.dir.Children...)
+	}
+	inode.mu.Unlock()
+
+	for _, child := range children {
+		if *child.Name != "." && *child.Name != ".." {
+			child.invalidate()
+		}
+	}
+}
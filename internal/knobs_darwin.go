@@ -0,0 +1,36 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// setMountKnob sets a runtime knob of a running mount, the same as
+// xattr -w user.goofys.NAME VALUE MOUNTPOINT. syscall doesn't
+// provide setxattr on darwin
+func setMountKnob(mountPoint string, name string, value string) error {
+	return exec.Command("xattr", "-w", knobPrefix+name, value, mountPoint).Run()
+}
+
+// getMountKnob reads a runtime knob of a running mount
+func getMountKnob(mountPoint string, name string) (string, error) {
+	out, err := exec.Command("xattr", "-p", knobPrefix+name, mountPoint).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
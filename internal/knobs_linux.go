@@ -0,0 +1,35 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"syscall"
+)
+
+// setMountKnob sets a runtime knob of a running mount, the same as
+// setfattr -n user.goofys.NAME -v VALUE MOUNTPOINT
+func setMountKnob(mountPoint string, name string, value string) error {
+	return syscall.Setxattr(mountPoint, knobPrefix+name, []byte(value), 0)
+}
+
+// getMountKnob reads a runtime knob of a running mount
+func getMountKnob(mountPoint string, name string) (string, error) {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(mountPoint, knobPrefix+name, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/urfave/cli"
+)
+
+type LifecycleTransition struct {
+	Days         int64
+	StorageClass string
+}
+
+// LifecycleConfig describes the lifecycle rule goofys manages for a
+// mount prefix
+type LifecycleConfig struct {
+	ExpireDays      int64
+	Transitions     []LifecycleTransition
+	AbortUploadDays int64
+}
+
+func (l *LifecycleConfig) empty() bool {
+	return l.ExpireDays == 0 && len(l.Transitions) == 0 && l.AbortUploadDays == 0
+}
+
+// parseTransition parses DAYS:STORAGE_CLASS
+func parseTransition(s string) (t LifecycleTransition, err error) {
+	colon := strings.Index(s, ":")
+	if colon == -1 {
+		err = fmt.Errorf("invalid transition %v, expected DAYS:STORAGE_CLASS", s)
+		return
+	}
+
+	t.Days, err = strconv.ParseInt(s[:colon], 10, 64)
+	if err != nil || t.Days < 0 {
+		err = fmt.Errorf("invalid transition %v, expected DAYS:STORAGE_CLASS", s)
+		return
+	}
+	t.StorageClass = strings.ToUpper(s[colon+1:])
+	return
+}
+
+func lifecycleRuleID(prefix string) string {
+	return "goofys-" + prefix
+}
+
+func (l *LifecycleConfig) rule(prefix string) *s3.LifecycleRule {
+	rule := &s3.LifecycleRule{
+		ID:     PString(lifecycleRuleID(prefix)),
+		Status: PString(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{
+			Prefix: PString(prefix),
+		},
+	}
+
+	if l.ExpireDays != 0 {
+		rule.Expiration = &s3.LifecycleExpiration{
+			Days: &l.ExpireDays,
+		}
+	}
+	for i := range l.Transitions {
+		rule.Transitions = append(rule.Transitions, &s3.Transition{
+			Days:         &l.Transitions[i].Days,
+			StorageClass: &l.Transitions[i].StorageClass,
+		})
+	}
+	if l.AbortUploadDays != 0 {
+		rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: &l.AbortUploadDays,
+		}
+	}
+
+	return rule
+}
+
+// ApplyLifecycle installs the rule for prefix, replacing the one we
+// installed before if any. Rules that belong to others are left
+// alone. An empty config removes our rule. With --shard-prefixes
+// the prefix exists once in every shard, so each gets its own rule.
+func ApplyLifecycle(cloud StorageBackend, prefix string, config *LifecycleConfig) error {
+	prefixes := storedPrefixes(cloud, prefix)
+	s := s3Backend(cloud)
+	if s == nil {
+		return fmt.Errorf("lifecycle rules are only supported on S3")
+	}
+
+	ours := make(map[string]bool)
+	for _, p := range prefixes {
+		ours[lifecycleRuleID(p)] = true
+	}
+
+	var rules []*s3.LifecycleRule
+
+	resp, err := s.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: &s.bucket,
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NoSuchLifecycleConfiguration" {
+			return mapAwsError(err)
+		}
+	} else {
+		for _, r := range resp.Rules {
+			if r.ID == nil || !ours[*r.ID] {
+				rules = append(rules, r)
+			}
+		}
+	}
+
+	if !config.empty() {
+		for _, p := range prefixes {
+			rules = append(rules, config.rule(p))
+		}
+	}
+
+	if len(rules) == 0 {
+		_, err = s.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{
+			Bucket: &s.bucket,
+		})
+	} else {
+		_, err = s.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+			Bucket: &s.bucket,
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+				Rules: rules,
+			},
+		})
+	}
+	return mapAwsError(err)
+}
+
+func lifecycleApply(c *cli.Context) error {
+	bucket, err := commandArg(c, "bucket[:prefix]")
+	if err != nil {
+		return err
+	}
+
+	config := &LifecycleConfig{
+		ExpireDays:      int64(c.Int("expire-days")),
+		AbortUploadDays: int64(c.Int("abort-upload-days")),
+	}
+	for _, s := range c.StringSlice("transition") {
+		t, err := parseTransition(s)
+		if err != nil {
+			return err
+		}
+		config.Transitions = append(config.Transitions, t)
+	}
+
+	cloud, prefix, _, err := commandBackend(c, bucket)
+	if err != nil {
+		return err
+	}
+
+	err = ApplyLifecycle(cloud, prefix, config)
+	if err != nil {
+		return fmt.Errorf("Unable to apply lifecycle rule to %v: %v", bucket, err)
+	}
+
+	if config.empty() {
+		log.Infof("Removed lifecycle rule from %v", bucket)
+	} else {
+		log.Infof("Applied lifecycle rule to %v", bucket)
+	}
+	return nil
+}
+
+var lifecycleCommand = cli.Command{
+	Name:  "lifecycle",
+	Usage: "Manage the lifecycle rule of a mount prefix",
+	Subcommands: []cli.Command{
+		{
+			Name:      "apply",
+			Usage:     "Install or update the lifecycle rule scoped to the prefix, or remove it if no option is given",
+			ArgsUsage: "bucket[:prefix]",
+			Action:    commandAction(lifecycleApply),
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "expire-days",
+					Usage: "Delete objects this many days after they are created",
+				},
+				cli.StringSliceFlag{
+					Name:  "transition",
+					Usage: "DAYS:STORAGE_CLASS, move objects to STORAGE_CLASS this many days after they are created. Can be repeated",
+				},
+				cli.IntFlag{
+					Name:  "abort-upload-days",
+					Usage: "Abort incomplete multipart uploads this many days after they are started",
+				},
+			},
+		},
+	},
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a named, monotonically increasing metric. All counters
+// are logged on SIGUSR1.
+type Counter struct {
+	Name string
+	n    uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+var counters = struct {
+	mu sync.Mutex
+	m  map[string]*Counter
+}{m: make(map[string]*Counter)}
+
+// NewCounter returns the counter with this name, creating it if it
+// doesn't exist yet
+func NewCounter(name string) *Counter {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+
+	c, ok := counters.m[name]
+	if !ok {
+		c = &Counter{Name: name}
+		counters.m[name] = c
+	}
+	return c
+}
+
+// Counters returns all the counters sorted by name
+func Counters() (ret []*Counter) {
+	counters.mu.Lock()
+	for _, c := range counters.m {
+		ret = append(ret, c)
+	}
+	counters.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// --minio-notify listens to MinIO's bucket notifications, a
+// streaming extension of GET bucket that MinIO serves without any
+// target configured, and forgets what we have cached about the keys
+// that changed under the mount.
+
+var minioEvents = NewCounter("notify.events")
+
+type minioRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+type minioNotification struct {
+	Records []minioRecord
+}
+
+func (fs *Goofys) listenMinio(cloud StorageBackend, prefix string) {
+	s := s3Backend(cloud)
+	for {
+		err := fs.listenMinioOnce(s, shardedBackend(cloud), prefix)
+		if fs.ctx.Err() != nil {
+			// unmounted
+			return
+		}
+		log.Warnf("MinIO notifications of %v stopped: %v", s.bucket, err)
+		// we may have missed events, start over
+		fs.InvalidatePath("")
+
+		select {
+		case <-fs.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (fs *Goofys) listenMinioOnce(s *S3Backend, sharded *ShardedBackend, prefix string) error {
+	query := url.Values{}
+	if sharded == nil {
+		// the keys in the shards start with the shard instead
+		query.Set("prefix", prefix)
+	}
+	query["events"] = []string{"s3:ObjectCreated:*", "s3:ObjectRemoved:*"}
+
+	endpoint := strings.TrimRight(aws.StringValue(s.S3.Config.Endpoint), "/")
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	req, err := http.NewRequest("GET",
+		fmt.Sprintf("%v/%v?%v", endpoint, s.bucket, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(fs.ctx)
+
+	_, err = v4.NewSigner(s.S3.Config.Credentials).Sign(req, nil, "s3",
+		aws.StringValue(s.S3.Config.Region), time.Now())
+	if err != nil {
+		return err
+	}
+
+	// the response never ends, so no --http-timeout
+	client := &http.Client{Transport: s.S3.Config.HTTPClient.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v", resp.Status)
+	}
+	log.Infof("Listening to MinIO notifications of %v:%v", s.bucket, prefix)
+
+	// one notification per line and blank lines to keep alive,
+	// which the decoder skips. A notification with many records
+	// can be longer than a bufio.Scanner line
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var n minioNotification
+		err = dec.Decode(&n)
+		if err == io.EOF {
+			return fmt.Errorf("connection closed")
+		} else if err != nil {
+			return err
+		}
+
+		for _, r := range n.Records {
+			key, err := url.QueryUnescape(r.S3.Object.Key)
+			if err != nil {
+				continue
+			}
+			if sharded != nil {
+				var ok bool
+				key, ok = sharded.unkey(key)
+				if !ok {
+					continue
+				}
+			}
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			minioEvents.Inc()
+			fuseLog.Debugf("%v %v", r.EventName, key)
+			fs.invalidateKey(key[len(prefix):])
+		}
+	}
+}
+
+// invalidateKey forgets what we know about path, which was created,
+// changed or removed by someone else. Unlike InvalidatePath only the
+// listing of its parent is dropped, not of its siblings
+func (fs *Goofys) invalidateKey(path string) {
+	fs.mu.RLock()
+	dir := fs.inodes[fuseops.RootInodeID]
+	fs.mu.RUnlock()
+
+	names := strings.Split(strings.Trim(path, "/"), "/")
+	var inode *Inode
+
+	for i, name := range names {
+		dir.mu.Lock()
+		dir.dir.du = nil
+		dir.mu.Unlock()
+
+		child := dir.findChild(name)
+		if child == nil {
+			break
+		}
+		if i == len(names)-1 {
+			inode = child
+		} else if child.isDir() {
+			dir = child
+		} else {
+			break
+		}
+	}
+
+	if inode != nil {
+		inode.invalidate()
+	}
+
+	dir.mu.Lock()
+	dir.dir.DirTime = time.Time{}
+	dir.mu.Unlock()
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jacobsa/fuse"
+)
+
+type PermissionCheck struct {
+	Op     string
+	Action string // the IAM action for S3
+	Err    error
+}
+
+func (p PermissionCheck) Missing() bool {
+	return isErrorClass(p.Err, "denied")
+}
+
+func (p PermissionCheck) String() string {
+	if p.Err == nil {
+		return fmt.Sprintf("%v (%v): ok", p.Op, p.Action)
+	} else if p.Missing() {
+		return fmt.Sprintf("%v (%v): permission denied", p.Op, p.Action)
+	} else {
+		return fmt.Sprintf("%v (%v): %v", p.Op, p.Action, p.Err)
+	}
+}
+
+// CheckPermissions does what a mount would do to a scratch object
+// under prefix and reports the outcome of every operation, so
+// missing permissions are found all at once instead of one EACCES at
+// a time. The scratch object is removed afterward if possible.
+func CheckPermissions(cloud StorageBackend, prefix string) (checks []PermissionCheck) {
+	key := prefix + ".goofys-probe-" + RandStringBytesMaskImprSrc(16)
+	body := []byte("goofys")
+
+	check := func(op, action string, err error) error {
+		err = mapAwsError(err)
+		checks = append(checks, PermissionCheck{op, action, err})
+		return err
+	}
+
+	_, err := cloud.ListBlobs(&ListBlobsInput{
+		Prefix:  &prefix,
+		MaxKeys: PUInt32(1),
+	})
+	check("list", "s3:ListBucket", err)
+
+	_, err = cloud.PutBlob(&PutBlobInput{
+		Key:  key,
+		Body: bytes.NewReader(body),
+		Size: PUInt64(uint64(len(body))),
+	})
+	putErr := check("put", "s3:PutObject", err)
+
+	resp, err := cloud.GetBlob(&GetBlobInput{Key: key})
+	if err == nil {
+		resp.Body.Close()
+	} else if putErr != nil && mapAwsError(err) == fuse.ENOENT {
+		// we couldn't create the object, but we were allowed
+		// to look for it
+		err = nil
+	}
+	check("get", "s3:GetObject", err)
+
+	_, err = cloud.DeleteBlob(&DeleteBlobInput{Key: key})
+	if mapAwsError(err) == fuse.ENOENT {
+		err = nil
+	}
+	check("delete", "s3:DeleteObject", err)
+
+	mpu, err := cloud.MultipartBlobBegin(&MultipartBlobBeginInput{Key: key})
+	if check("multipart begin", "s3:PutObject", err) != nil {
+		return
+	}
+
+	_, err = cloud.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit:     mpu,
+		PartNumber: 1,
+		Body:       bytes.NewReader(body),
+		Size:       uint64(len(body)),
+		Last:       true,
+	})
+	check("multipart upload", "s3:PutObject", err)
+
+	_, err = cloud.MultipartBlobAbort(mpu)
+	check("multipart abort", "s3:AbortMultipartUpload", err)
+
+	return
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// S3 has no atomic rename, so a directory is published by writing
+// one of these after everything else is in place. Consumers wait for
+// the marker instead of the directory
+const PUBLISH_MANIFEST = ".goofys-published"
+
+var publishMarkers = []string{PUBLISH_MANIFEST, "_SUCCESS"}
+
+// isPublishMarker reports whether name, which is relative to the
+// prefix being published, marks the whole prefix as complete. Markers
+// further down, like those of the partitions of a Spark job, are
+// copied like any other object
+func isPublishMarker(name string) bool {
+	for _, m := range publishMarkers {
+		if name == m {
+			return true
+		}
+	}
+	return false
+}
+
+type publishManifest struct {
+	Source    string            `json:"source"`
+	Published time.Time         `json:"published"`
+	Objects   []publishedObject `json:"objects"`
+}
+
+type publishedObject struct {
+	Key  string `json:"key"`
+	Size uint64 `json:"size"`
+	ETag string `json:"etag,omitempty"`
+}
+
+var publishCommand = cli.Command{
+	Name:      "publish",
+	Usage:     "Copy a staging prefix to its final place and write " + PUBLISH_MANIFEST + " once it's complete",
+	ArgsUsage: "bucket:staging-prefix prefix",
+	Action:    commandAction(publishAction),
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "delete-source",
+			Usage: "Delete the staging prefix after publishing",
+		},
+		cli.IntFlag{
+			Name:  "parallel",
+			Value: 16,
+			Usage: "Number of objects to copy at the same time",
+		},
+	},
+}
+
+func publishAction(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return fmt.Errorf("publish takes exactly two arguments: bucket:staging-prefix prefix")
+	}
+	bucket := c.Args()[0]
+
+	cloud, src, _, err := commandBackend(c, bucket)
+	if err != nil {
+		return err
+	}
+	if src == "" {
+		return fmt.Errorf("%v has no staging prefix", bucket)
+	}
+	dst := cleanPrefix(c.Args()[1])
+	if dst == "" {
+		return fmt.Errorf("Refusing to publish to the root of %v", bucket)
+	}
+	if strings.HasPrefix(dst, src) || strings.HasPrefix(src, dst) {
+		return fmt.Errorf("%v and %v overlap", src, dst)
+	}
+
+	srcFiles, err := listRemote(cloud, src)
+	if err != nil {
+		return fmt.Errorf("Unable to list %v: %v", src, err)
+	}
+	if len(srcFiles) == 0 {
+		return fmt.Errorf("Nothing to publish in %v", src)
+	}
+	dstFiles, err := listRemote(cloud, dst)
+	if err != nil {
+		return fmt.Errorf("Unable to list %v: %v", dst, err)
+	}
+
+	// unpublish the old version first so nobody reads it while it's
+	// being replaced
+	var markers []string
+	for name := range dstFiles {
+		if isPublishMarker(name) {
+			markers = append(markers, dst+name)
+		}
+	}
+	if len(markers) != 0 {
+		_, err = cloud.DeleteBlobs(&DeleteBlobsInput{Items: markers})
+		if err != nil {
+			return fmt.Errorf("Unable to unpublish %v: %v", dst, err)
+		}
+	}
+
+	manifest := publishManifest{
+		Source:    src,
+		Published: time.Now().UTC(),
+	}
+	var tasks []syncTask
+	var srcMarkers, srcKeys []string
+	for name, f := range srcFiles {
+		if isPublishMarker(name) {
+			srcMarkers = append(srcMarkers, src+name)
+			continue
+		}
+		srcKeys = append(srcKeys, src+name)
+
+		from, to, size := src+name, dst+name, f.size
+		manifest.Objects = append(manifest.Objects, publishedObject{
+			Key:  name,
+			Size: f.size,
+			ETag: f.etag,
+		})
+		tasks = append(tasks, syncTask{"copy", name, func() error {
+			_, err := cloud.CopyBlob(&CopyBlobInput{
+				Source:      from,
+				Destination: to,
+				Size:        &size,
+			})
+			return err
+		}})
+	}
+	for name := range dstFiles {
+		if _, ok := srcFiles[name]; ok || isPublishMarker(name) {
+			continue
+		}
+		key := dst + name
+		tasks = append(tasks, syncTask{"delete", name, func() error {
+			_, err := cloud.DeleteBlob(&DeleteBlobInput{Key: key})
+			return err
+		}})
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].name < tasks[j].name
+	})
+	sort.Slice(manifest.Objects, func(i, j int) bool {
+		return manifest.Objects[i].Key < manifest.Objects[j].Key
+	})
+
+	err = runSyncTasks(tasks, c.Int("parallel"))
+	if err != nil {
+		return err
+	}
+
+	body, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	size := uint64(len(body))
+	_, err = cloud.PutBlob(&PutBlobInput{
+		Key:         dst + PUBLISH_MANIFEST,
+		Body:        bytes.NewReader(body),
+		Size:        &size,
+		ContentType: PString("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to publish %v: %v", dst, err)
+	}
+	log.Infof("published %v objects from %v to %v", len(manifest.Objects), src, dst)
+
+	if c.Bool("delete-source") {
+		for _, keys := range [][]string{srcMarkers, srcKeys} {
+			for len(keys) != 0 {
+				n := len(keys)
+				if n > 1000 {
+					n = 1000
+				}
+				_, err = cloud.DeleteBlobs(&DeleteBlobsInput{Items: keys[:n]})
+				if err != nil {
+					return fmt.Errorf("Unable to delete %v: %v", src, err)
+				}
+				keys = keys[n:]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,482 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/urfave/cli"
+)
+
+var replayCommand = cli.Command{
+	Name:  "replay",
+	Usage: "Run the ops recorded by --trace against a bucket, without mounting it",
+	ArgsUsage: "trace bucket[:prefix]\n\n" +
+		"   Ops run one at a time in the order they completed, the concurrency\n" +
+		"   of the original mount is not reproduced. Ops on inodes the trace\n" +
+		"   didn't see being looked up are skipped",
+	Action: commandAction(replayAction),
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name: "populate",
+			Usage: "First create the files and directories the trace looked up " +
+				"but didn't create, with the same sizes and random content",
+		},
+		cli.BoolFlag{
+			Name:  "timing",
+			Usage: "Wait between ops as long as the original mount did",
+		},
+		cli.IntFlag{
+			Name:  "parallel",
+			Value: 16,
+			Usage: "Number of files to create at the same time with --populate",
+		},
+	},
+}
+
+var errNotTraced = fmt.Errorf("not seen in the trace")
+
+func readTrace(path string) (records []traceRecord, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var r traceRecord
+		err = dec.Decode(&r)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			// the mount may have died while writing the
+			// last one
+			log.Warnf("Stopped reading %v after %v ops: %v", path, len(records), err)
+			return records, nil
+		}
+		records = append(records, r)
+	}
+}
+
+// traceTree follows the names of the traced inodes through renames
+// and deletes
+type traceTree struct {
+	parent   map[uint64]uint64
+	name     map[uint64]string
+	children map[uint64]map[string]uint64
+}
+
+func newTraceTree() *traceTree {
+	return &traceTree{
+		parent:   make(map[uint64]uint64),
+		name:     make(map[uint64]string),
+		children: make(map[uint64]map[string]uint64),
+	}
+}
+
+func (t *traceTree) link(parent uint64, name string, child uint64) {
+	if t.children[parent] == nil {
+		t.children[parent] = make(map[string]uint64)
+	}
+	t.children[parent][name] = child
+	t.parent[child] = parent
+	t.name[child] = name
+}
+
+func (t *traceTree) unlink(parent uint64, name string) (child uint64) {
+	child = t.children[parent][name]
+	delete(t.children[parent], name)
+	return
+}
+
+func (t *traceTree) path(id uint64) (string, bool) {
+	if id == uint64(fuseops.RootInodeID) {
+		return "", true
+	}
+	name, ok := t.name[id]
+	if !ok {
+		return "", false
+	}
+	parent, ok := t.path(t.parent[id])
+	if !ok {
+		return "", false
+	}
+	if parent == "" {
+		return name, true
+	}
+	return parent + "/" + name, true
+}
+
+type tracedObject struct {
+	dir  bool
+	size uint64
+}
+
+// existingObjects returns what must be in the bucket before the
+// trace started for it to replay the same way: what was successfully
+// looked up before the trace created it, if it ever did
+func existingObjects(records []traceRecord) map[string]tracedObject {
+	tree := newTraceTree()
+	created := make(map[string]bool)
+	objects := make(map[string]tracedObject)
+
+	for _, r := range records {
+		if r.Error != "" {
+			continue
+		}
+
+		switch r.Op {
+		case "LookUpInode":
+			tree.link(r.Parent, r.Name, r.Child)
+			path, ok := tree.path(r.Child)
+			if !ok || created[path] || path == STATS_DIR ||
+				strings.HasPrefix(path, STATS_DIR+"/") {
+				continue
+			}
+			if _, ok := objects[path]; !ok {
+				objects[path] = tracedObject{r.ChildDir, r.ChildSize}
+			}
+		case "MkDir", "MkNode", "CreateFile", "CreateSymlink", "CreateLink":
+			tree.link(r.Parent, r.Name, r.Child)
+			if path, ok := tree.path(r.Child); ok {
+				created[path] = true
+			}
+		case "Rename":
+			child := tree.unlink(r.Parent, r.Name)
+			if child != 0 {
+				tree.link(r.NewParent, r.NewName, child)
+				if path, ok := tree.path(child); ok {
+					created[path] = true
+				}
+			}
+		case "Unlink", "RmDir":
+			tree.unlink(r.Parent, r.Name)
+		}
+	}
+	return objects
+}
+
+func populate(cloud StorageBackend, prefix string, objects map[string]tracedObject, parallel int) error {
+	data := make(benchData, 1024*1024)
+	rand.Read(data)
+
+	var tasks []syncTask
+	for path, o := range objects {
+		key := prefix + path
+		o := o
+		if o.dir {
+			tasks = append(tasks, syncTask{"mkdir", path, func() error {
+				size := uint64(0)
+				_, err := cloud.PutBlob(&PutBlobInput{
+					Key:     key + "/",
+					Body:    bytes.NewReader(nil),
+					Size:    &size,
+					DirBlob: true,
+				})
+				return err
+			}})
+		} else {
+			tasks = append(tasks, syncTask{"create", path, func() error {
+				return uploadBlob(cloud, key, data, o.size, nil)
+			}})
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].name < tasks[j].name
+	})
+	return runSyncTasks(tasks, parallel)
+}
+
+type traceReplayer struct {
+	fs      *Goofys
+	data    benchData
+	inodes  map[uint64]fuseops.InodeID
+	handles map[uint64]fuseops.HandleID
+}
+
+func newTraceReplayer(fs *Goofys) *traceReplayer {
+	r := &traceReplayer{
+		fs:      fs,
+		data:    make(benchData, 1024*1024),
+		inodes:  make(map[uint64]fuseops.InodeID),
+		handles: make(map[uint64]fuseops.HandleID),
+	}
+	rand.Read(r.data)
+	r.inodes[uint64(fuseops.RootInodeID)] = fuseops.RootInodeID
+	return r
+}
+
+func (r *traceReplayer) inode(id uint64) fuseops.InodeID {
+	if id, ok := r.inodes[id]; ok {
+		return id
+	}
+	panic(errNotTraced)
+}
+
+func (r *traceReplayer) handle(id uint64) fuseops.HandleID {
+	if id, ok := r.handles[id]; ok {
+		return id
+	}
+	panic(errNotTraced)
+}
+
+func (r *traceReplayer) child(rec *traceRecord, e *fuseops.ChildInodeEntry) {
+	if rec.Child != 0 {
+		r.inodes[rec.Child] = e.Child
+	}
+}
+
+func (r *traceReplayer) buf(size uint64) []byte {
+	buf := make([]byte, size)
+	r.data.ReadAt(buf, 0)
+	return buf
+}
+
+// replay runs one op. The ids in the trace are mapped to the ones
+// this mount gave out, ops with ids that can't be mapped return
+// errNotTraced
+func (r *traceReplayer) replay(ctx context.Context, rec *traceRecord) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if e != errNotTraced {
+				panic(e)
+			}
+			err = errNotTraced
+		}
+	}()
+
+	fs := r.fs
+	switch rec.Op {
+	case "StatFS":
+		err = fs.StatFS(ctx, &fuseops.StatFSOp{})
+	case "LookUpInode":
+		op := fuseops.LookUpInodeOp{Parent: r.inode(rec.Parent), Name: rec.Name}
+		err = fs.LookUpInode(ctx, &op)
+		r.child(rec, &op.Entry)
+	case "GetInodeAttributes":
+		err = fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: r.inode(rec.Inode)})
+	case "SetInodeAttributes":
+		op := fuseops.SetInodeAttributesOp{
+			Inode: r.inode(rec.Inode),
+			Size:  rec.SetSize,
+			Mtime: rec.SetMtime,
+		}
+		if rec.SetMode != nil {
+			mode := os.FileMode(*rec.SetMode)
+			op.Mode = &mode
+		}
+		err = fs.SetInodeAttributes(ctx, &op)
+	case "ForgetInode":
+		err = fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: r.inode(rec.Inode), N: rec.N})
+	case "MkDir":
+		op := fuseops.MkDirOp{Parent: r.inode(rec.Parent), Name: rec.Name, Mode: os.FileMode(rec.Mode)}
+		err = fs.MkDir(ctx, &op)
+		r.child(rec, &op.Entry)
+	case "MkNode":
+		op := fuseops.MkNodeOp{Parent: r.inode(rec.Parent), Name: rec.Name, Mode: os.FileMode(rec.Mode)}
+		err = fs.MkNode(ctx, &op)
+		r.child(rec, &op.Entry)
+	case "CreateFile":
+		op := fuseops.CreateFileOp{Parent: r.inode(rec.Parent), Name: rec.Name, Mode: os.FileMode(rec.Mode)}
+		err = fs.CreateFile(ctx, &op)
+		r.child(rec, &op.Entry)
+		if rec.NewHandle != 0 {
+			r.handles[rec.NewHandle] = op.Handle
+		}
+	case "CreateLink":
+		op := fuseops.CreateLinkOp{Parent: r.inode(rec.Parent), Name: rec.Name, Target: r.inode(rec.Inode)}
+		err = fs.CreateLink(ctx, &op)
+		r.child(rec, &op.Entry)
+	case "CreateSymlink":
+		op := fuseops.CreateSymlinkOp{Parent: r.inode(rec.Parent), Name: rec.Name, Target: rec.Target}
+		err = fs.CreateSymlink(ctx, &op)
+		r.child(rec, &op.Entry)
+	case "Rename":
+		err = fs.Rename(ctx, &fuseops.RenameOp{
+			OldParent: r.inode(rec.Parent),
+			OldName:   rec.Name,
+			NewParent: r.inode(rec.NewParent),
+			NewName:   rec.NewName,
+		})
+	case "RmDir":
+		err = fs.RmDir(ctx, &fuseops.RmDirOp{Parent: r.inode(rec.Parent), Name: rec.Name})
+	case "Unlink":
+		err = fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: r.inode(rec.Parent), Name: rec.Name})
+	case "OpenDir":
+		op := fuseops.OpenDirOp{Inode: r.inode(rec.Inode)}
+		err = fs.OpenDir(ctx, &op)
+		if rec.NewHandle != 0 {
+			r.handles[rec.NewHandle] = op.Handle
+		}
+	case "ReadDir":
+		err = fs.ReadDir(ctx, &fuseops.ReadDirOp{
+			Inode:  r.inode(rec.Inode),
+			Handle: r.handle(rec.Handle),
+			Offset: fuseops.DirOffset(rec.Offset),
+			Dst:    make([]byte, rec.Size),
+		})
+	case "ReleaseDirHandle":
+		err = fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{Handle: r.handle(rec.Handle)})
+	case "OpenFile":
+		op := fuseops.OpenFileOp{Inode: r.inode(rec.Inode)}
+		err = fs.OpenFile(ctx, &op)
+		if rec.NewHandle != 0 {
+			r.handles[rec.NewHandle] = op.Handle
+		}
+	case "ReadFile":
+		err = fs.ReadFile(ctx, &fuseops.ReadFileOp{
+			Inode:  r.inode(rec.Inode),
+			Handle: r.handle(rec.Handle),
+			Offset: int64(rec.Offset),
+			Dst:    make([]byte, rec.Size),
+		})
+	case "WriteFile":
+		err = fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:  r.inode(rec.Inode),
+			Handle: r.handle(rec.Handle),
+			Offset: int64(rec.Offset),
+			Data:   r.buf(rec.Size),
+		})
+	case "SyncFile":
+		err = fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: r.inode(rec.Inode), Handle: r.handle(rec.Handle)})
+	case "FlushFile":
+		err = fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: r.inode(rec.Inode), Handle: r.handle(rec.Handle)})
+	case "ReleaseFileHandle":
+		err = fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: r.handle(rec.Handle)})
+	case "ReadSymlink":
+		err = fs.ReadSymlink(ctx, &fuseops.ReadSymlinkOp{Inode: r.inode(rec.Inode)})
+	case "RemoveXattr":
+		err = fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: r.inode(rec.Inode), Name: rec.Name})
+	case "GetXattr":
+		err = fs.GetXattr(ctx, &fuseops.GetXattrOp{
+			Inode: r.inode(rec.Inode),
+			Name:  rec.Name,
+			Dst:   make([]byte, rec.Size),
+		})
+	case "ListXattr":
+		err = fs.ListXattr(ctx, &fuseops.ListXattrOp{Inode: r.inode(rec.Inode), Dst: make([]byte, rec.Size)})
+	case "SetXattr":
+		value := []byte(rec.Value)
+		if !isKnob(rec.Name) {
+			value = r.buf(rec.Size)
+		}
+		err = fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: r.inode(rec.Inode), Name: rec.Name, Value: value})
+	default:
+		err = fmt.Errorf("unknown op %v", rec.Op)
+	}
+	return
+}
+
+type replayStats struct {
+	count     int
+	skipped   int
+	different int
+	recorded  time.Duration
+	replayed  time.Duration
+}
+
+func replayAction(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return fmt.Errorf("%v takes exactly two arguments: trace bucket[:prefix]", c.Command.Name)
+	}
+	trace, bucket := c.Args()[0], c.Args()[1]
+
+	records, err := readTrace(trace)
+	if err != nil {
+		return fmt.Errorf("Unable to read %v: %v", trace, err)
+	}
+
+	cloud, prefix, flags, err := commandBackend(c, bucket)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("populate") {
+		err = populate(cloud, prefix, existingObjects(records), c.Int("parallel"))
+		if err != nil {
+			return err
+		}
+	}
+
+	fs := NewGoofys(context.Background(), bucket, flags)
+	if fs == nil {
+		return fmt.Errorf("Unable to setup %v", bucket)
+	}
+
+	r := newTraceReplayer(fs)
+	stats := make(map[string]*replayStats)
+	timing := c.Bool("timing")
+	start := time.Now()
+
+	for i := range records {
+		rec := &records[i]
+		if timing {
+			time.Sleep(time.Until(start.Add(time.Duration(rec.Start * float64(time.Second)))))
+		}
+
+		opStart := time.Now()
+		err := r.replay(context.Background(), rec)
+		elapsed := time.Since(opStart)
+
+		s := stats[rec.Op]
+		if s == nil {
+			s = &replayStats{}
+			stats[rec.Op] = s
+		}
+		s.count++
+		if err == errNotTraced {
+			s.skipped++
+			continue
+		}
+		s.recorded += time.Duration(rec.Duration * float64(time.Second))
+		s.replayed += elapsed
+
+		errString := ""
+		if err != nil {
+			errString = err.Error()
+		}
+		if errString != rec.Error {
+			s.different++
+			log.Debugf("%v %v: %v instead of %v", rec.Op, rec.Name, err, rec.Error)
+		}
+	}
+
+	var ops []string
+	for op, _ := range stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OP\tCOUNT\tSKIPPED\tDIFFERENT\tRECORDED\tREPLAYED")
+	for _, op := range ops {
+		s := stats[op]
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", op, s.count, s.skipped, s.different,
+			s.recorded.Truncate(time.Microsecond), s.replayed.Truncate(time.Microsecond))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,366 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduler shares a budget of concurrent requests and bandwidth
+// between classes of requests (usually one per mount) according to
+// their weights. When the budget is exhausted the class that has
+// received the least service relative to its weight goes next, so a
+// busy class can't starve the others.
+type Scheduler struct {
+	Requests  uint32 // 0 means unlimited
+	Bandwidth uint64 // bytes per second, 0 means unlimited
+
+	outstanding uint32
+	tokens      float64
+	lastRefill  time.Time
+	refilling   bool
+
+	classes []*SchedulerClass
+
+	mu   sync.Mutex
+	cond *sync.Cond
+}
+
+type SchedulerClass struct {
+	sched  *Scheduler
+	weight uint32
+
+	// service received so far divided by weight
+	vtime   float64
+	waiting uint32
+}
+
+// every MB transferred costs as much as a request
+const schedulerByteCost = 1024 * 1024
+
+func (s Scheduler) Init() *Scheduler {
+	s.cond = sync.NewCond(&s.mu)
+	s.tokens = float64(s.Bandwidth)
+	s.lastRefill = time.Now()
+	return &s
+}
+
+func (s *Scheduler) NewClass(weight uint32) *SchedulerClass {
+	if weight == 0 {
+		weight = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &SchedulerClass{sched: s, weight: weight}
+	s.classes = append(s.classes, c)
+	return c
+}
+
+func (s *Scheduler) MaxRequests() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Requests
+}
+
+// SetMaxRequests changes the limit of concurrent requests, 0 means
+// unlimited
+func (s *Scheduler) SetMaxRequests(n uint32) {
+	s.mu.Lock()
+	s.Requests = n
+	s.mu.Unlock()
+
+	s.cond.Broadcast()
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Scheduler) minVtime(except *SchedulerClass) (min float64, found bool) {
+	for _, c := range s.classes {
+		if c != except && c.waiting != 0 && (!found || c.vtime < min) {
+			min = c.vtime
+			found = true
+		}
+	}
+	return
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Scheduler) refill() {
+	if s.Bandwidth == 0 {
+		return
+	}
+
+	now := time.Now()
+	s.tokens += now.Sub(s.lastRefill).Seconds() * float64(s.Bandwidth)
+	// allow at most one second worth of burst
+	if s.tokens > float64(s.Bandwidth) {
+		s.tokens = float64(s.Bandwidth)
+	}
+	s.lastRefill = now
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Scheduler) available() bool {
+	if s.Requests != 0 && s.outstanding >= s.Requests {
+		return false
+	}
+	return s.hasTokens()
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *Scheduler) hasTokens() bool {
+	s.refill()
+	if s.Bandwidth != 0 && s.tokens <= 0 {
+		// nobody will wake us up when there are tokens
+		// again, so do it ourselves
+		if !s.refilling {
+			s.refilling = true
+			wait := time.Duration(-s.tokens / float64(s.Bandwidth) * float64(time.Second))
+			time.AfterFunc(wait+time.Millisecond, func() {
+				s.mu.Lock()
+				s.refilling = false
+				s.mu.Unlock()
+				s.cond.Broadcast()
+			})
+		}
+		return false
+	}
+
+	return true
+}
+
+// Take blocks until this class may send a request that will transfer
+// about the given number of bytes
+func (c *SchedulerClass) Take(bytes uint64) {
+	s := c.sched
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.waiting++
+	if c.waiting == 1 {
+		// a class that was idle doesn't get to make up for
+		// the time it didn't use
+		if min, ok := s.minVtime(c); ok && c.vtime < min {
+			c.vtime = min
+		}
+	}
+
+	for {
+		if min, ok := s.minVtime(c); (!ok || c.vtime <= min) && s.available() {
+			break
+		}
+		s.cond.Wait()
+	}
+
+	c.waiting--
+	s.outstanding++
+	c.vtime += (1 + float64(bytes)/schedulerByteCost) / float64(c.weight)
+	if s.Bandwidth != 0 {
+		s.tokens -= float64(bytes)
+	}
+
+	// someone else may be next now that our vtime went up
+	s.cond.Broadcast()
+}
+
+// Charge accounts for bytes that are transferred after Take, ie: as
+// a response is read, and blocks until the bandwidth they used up is
+// available again
+func (c *SchedulerClass) Charge(bytes uint64) {
+	if bytes == 0 {
+		return
+	}
+	s := c.sched
+
+	s.mu.Lock()
+	c.vtime += float64(bytes) / schedulerByteCost / float64(c.weight)
+	if s.Bandwidth != 0 {
+		s.tokens -= float64(bytes)
+		for !s.hasTokens() {
+			s.cond.Wait()
+		}
+	}
+	s.mu.Unlock()
+
+	// someone else may be next now that our vtime went up
+	s.cond.Broadcast()
+}
+
+func (c *SchedulerClass) Return() {
+	s := c.sched
+
+	s.mu.Lock()
+	s.outstanding--
+	s.mu.Unlock()
+
+	s.cond.Broadcast()
+}
+
+// ScheduledBackend makes every request to the backend go through the
+// scheduler first
+type ScheduledBackend struct {
+	StorageBackend
+	class *SchedulerClass
+}
+
+func NewScheduledBackend(cloud StorageBackend, class *SchedulerClass) *ScheduledBackend {
+	return &ScheduledBackend{
+		StorageBackend: cloud,
+		class:          class,
+	}
+}
+
+// unwrapBackend returns the backend behind the scheduler and the
+// shards, for callers that need to know what kind of backend they are
+// talking to
+func unwrapBackend(cloud StorageBackend) StorageBackend {
+	for {
+		switch s := cloud.(type) {
+		case *ScheduledBackend:
+			cloud = s.StorageBackend
+		case *ShardedBackend:
+			cloud = s.StorageBackend
+		default:
+			return cloud
+		}
+	}
+}
+
+func (s *ScheduledBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.HeadBlob(param)
+}
+
+func (s *ScheduledBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.ListBlobs(param)
+}
+
+func (s *ScheduledBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.DeleteBlob(param)
+}
+
+func (s *ScheduledBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.DeleteBlobs(param)
+}
+
+func (s *ScheduledBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.RenameBlob(param)
+}
+
+func (s *ScheduledBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.CopyBlob(param)
+}
+
+// scheduledBody charges the bytes as they are read. The request slot
+// is returned as soon as the response arrives, because a stream may
+// be left open for as long as the file is
+type scheduledBody struct {
+	io.ReadCloser
+	class *SchedulerClass
+}
+
+func (b *scheduledBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.class.Charge(uint64(n))
+	return
+}
+
+func (s *ScheduledBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	s.class.Take(0)
+	resp, err := s.StorageBackend.GetBlob(param)
+	s.class.Return()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &scheduledBody{
+		ReadCloser: resp.Body,
+		class:      s.class,
+	}
+	return resp, nil
+}
+
+func (s *ScheduledBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	var size uint64
+	if param.Size != nil {
+		size = *param.Size
+	}
+	s.class.Take(size)
+	defer s.class.Return()
+	return s.StorageBackend.PutBlob(param)
+}
+
+func (s *ScheduledBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.MultipartBlobBegin(param)
+}
+
+func (s *ScheduledBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	s.class.Take(param.Size)
+	defer s.class.Return()
+	return s.StorageBackend.MultipartBlobAdd(param)
+}
+
+func (s *ScheduledBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.MultipartBlobAbort(param)
+}
+
+func (s *ScheduledBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	s.class.Take(0)
+	defer s.class.Return()
+	return s.StorageBackend.MultipartBlobCommit(param)
+}
+
+// parseMountWeights parses PATH=WEIGHT,... into the scheduler weight of
+// each mount, with "/" being the root mount
+func parseMountWeights(s string) (map[string]uint32, error) {
+	weights := make(map[string]uint32)
+	for _, w := range strings.Split(s, ",") {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		eq := strings.LastIndexByte(w, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("expected PATH=WEIGHT: %v", w)
+		}
+		weight, err := strconv.ParseUint(w[eq+1:], 10, 32)
+		if err != nil || weight == 0 {
+			return nil, fmt.Errorf("invalid weight: %v", w)
+		}
+		weights[strings.Trim(w[:eq], "/")] = uint32(weight)
+	}
+	return weights, nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "gopkg.in/check.v1"
+
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type SchedulerTest struct {
+}
+
+var _ = Suite(&SchedulerTest{})
+
+func waitForWaiters(s *Scheduler, c *SchedulerClass, n uint32) {
+	for {
+		s.mu.Lock()
+		waiting := c.waiting
+		s.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *SchedulerTest) TestSchedulerWeights(t *C) {
+	sched := Scheduler{Requests: 1}.Init()
+	bulk := sched.NewClass(1)
+	interactive := sched.NewClass(3)
+
+	// hold the only slot until everyone is queued up
+	bulk.Take(0)
+
+	var mu sync.Mutex
+	var order []*SchedulerClass
+	var wg sync.WaitGroup
+
+	for _, c := range []*SchedulerClass{bulk, interactive} {
+		for i := 0; i < 40; i++ {
+			wg.Add(1)
+			go func(c *SchedulerClass) {
+				c.Take(0)
+				mu.Lock()
+				order = append(order, c)
+				mu.Unlock()
+				c.Return()
+				wg.Done()
+			}(c)
+		}
+	}
+
+	waitForWaiters(sched, bulk, 40)
+	waitForWaiters(sched, interactive, 40)
+	bulk.Return()
+	wg.Wait()
+
+	t.Assert(len(order), Equals, 80)
+
+	numInteractive := 0
+	for _, c := range order[:20] {
+		if c == interactive {
+			numInteractive++
+		}
+	}
+	t.Assert(numInteractive >= 13 && numInteractive <= 17, Equals, true,
+		Commentf("%v of the first 20 requests are interactive", numInteractive))
+}
+
+func (s *SchedulerTest) TestSchedulerIdleClass(t *C) {
+	sched := Scheduler{Requests: 1}.Init()
+	busy := sched.NewClass(1)
+	idle := sched.NewClass(1)
+
+	for i := 0; i < 10; i++ {
+		busy.Take(0)
+		busy.Return()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	busy.Take(0)
+	go func() {
+		busy.Take(0)
+		busy.Return()
+		wg.Done()
+	}()
+	waitForWaiters(sched, busy, 1)
+
+	go func() {
+		idle.Take(0)
+		idle.Return()
+		wg.Done()
+	}()
+	waitForWaiters(sched, idle, 1)
+
+	// idle doesn't get credit for the time it wasn't running,
+	// otherwise it would lock busy out for the next 11 requests
+	sched.mu.Lock()
+	t.Assert(idle.vtime, Equals, busy.vtime)
+	sched.mu.Unlock()
+
+	busy.Return()
+	wg.Wait()
+}
+
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+type getBlobBackend struct {
+	StorageBackend
+	data string
+}
+
+func (b *getBlobBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	if b.data == "" {
+		return nil, syscall.ENOENT
+	}
+	return &GetBlobOutput{Body: &closeCounter{Reader: strings.NewReader(b.data)}}, nil
+}
+
+func (b *getBlobBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	return &HeadBlobOutput{}, nil
+}
+
+func (s *SchedulerTest) TestScheduledGetBlob(t *C) {
+	sched := Scheduler{Requests: 1}.Init()
+	cloud := NewScheduledBackend(&getBlobBackend{data: "hello"}, sched.NewClass(1))
+
+	// two open files that are partly read don't hold on to the
+	// only request slot
+	var bodies []io.ReadCloser
+	for i := 0; i < 2; i++ {
+		resp, err := cloud.GetBlob(&GetBlobInput{Key: "foo"})
+		t.Assert(err, IsNil)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(resp.Body, buf)
+		t.Assert(err, IsNil)
+		t.Assert(string(buf), Equals, "he")
+		bodies = append(bodies, resp.Body)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := cloud.HeadBlob(&HeadBlobInput{Key: "bar"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("HeadBlob is blocked by the open streams")
+	}
+
+	for _, b := range bodies {
+		buf, err := ioutil.ReadAll(b)
+		t.Assert(err, IsNil)
+		t.Assert(string(buf), Equals, "llo")
+		b.Close()
+		t.Assert(b.(*scheduledBody).ReadCloser.(*closeCounter).closed, Equals, 1)
+	}
+
+	// errors don't leave a body to close
+	cloud = NewScheduledBackend(&getBlobBackend{}, sched.NewClass(1))
+	_, err := cloud.GetBlob(&GetBlobInput{Key: "foo"})
+	t.Assert(err, Equals, syscall.ENOENT)
+	sched.mu.Lock()
+	t.Assert(sched.outstanding, Equals, uint32(0))
+	sched.mu.Unlock()
+}
+
+func (s *SchedulerTest) TestScheduledGetBlobBandwidth(t *C) {
+	sched := Scheduler{Bandwidth: 100}.Init()
+	class := sched.NewClass(1)
+	cloud := NewScheduledBackend(&getBlobBackend{data: strings.Repeat("x", 150)}, class)
+
+	// a stream doesn't say how much it will read, so the
+	// bandwidth is charged as it's read: 100 bytes of burst and
+	// then 50 more at 100 bytes/s
+	now := time.Now()
+	resp, err := cloud.GetBlob(&GetBlobInput{Key: "foo"})
+	t.Assert(err, IsNil)
+	buf, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(buf, HasLen, 150)
+	t.Assert(time.Since(now) >= 400*time.Millisecond, Equals, true)
+
+	sched.mu.Lock()
+	t.Assert(class.vtime > 1, Equals, true)
+	sched.mu.Unlock()
+}
+
+func (s *SchedulerTest) TestParseMountWeights(t *C) {
+	weights, err := parseMountWeights("/=2, ingest=1,/dashboards/=4")
+	t.Assert(err, IsNil)
+	t.Assert(weights, DeepEquals, map[string]uint32{
+		"":           2,
+		"ingest":     1,
+		"dashboards": 4,
+	})
+
+	_, err = parseMountWeights("ingest")
+	t.Assert(err, NotNil)
+	_, err = parseMountWeights("ingest=0")
+	t.Assert(err, NotNil)
+	_, err = parseMountWeights("ingest=-1")
+	t.Assert(err, NotNil)
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// --scoped-session swaps the credentials of the mount for temporary
+// ones that can only reach the mounted prefix, and unmounts before
+// they expire. Hand a job or a contractor such a mount instead of
+// the credentials it was made with.
+
+// how long before the credentials expire we flush and unmount
+const SCOPED_SESSION_MARGIN = 1 * time.Minute
+
+type policyStatement struct {
+	Effect    string
+	Action    []string
+	Resource  []string
+	Condition map[string]map[string][]string `json:",omitempty"`
+}
+
+type policyDocument struct {
+	Version   string
+	Statement []policyStatement
+}
+
+// scopedPolicy is the session policy that limits the credentials to
+// what a mount of bucket:prefix needs, with the prefix in each shard
+// if there are --shard-prefixes. A session policy can only take away,
+// so the kms actions are as allowed as they were before.
+func scopedPolicy(bucket string, prefixes []string) string {
+	list := policyStatement{
+		Effect:   "Allow",
+		Action:   []string{"s3:ListBucket", "s3:ListBucketMultipartUploads"},
+		Resource: []string{"arn:aws:s3:::" + bucket},
+	}
+	var listed, objects []string
+	for _, p := range prefixes {
+		if p == "" {
+			// the whole bucket
+			listed = nil
+			objects = []string{"arn:aws:s3:::" + bucket + "/*"}
+			break
+		}
+		listed = append(listed, p+"*")
+		objects = append(objects, "arn:aws:s3:::"+bucket+"/"+p+"*")
+	}
+	if len(listed) != 0 {
+		list.Condition = map[string]map[string][]string{
+			"StringLike": {"s3:prefix": listed},
+		}
+	}
+
+	policy := policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			list,
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:GetBucketLocation"},
+				Resource: []string{"arn:aws:s3:::" + bucket},
+			},
+			{
+				Effect: "Allow",
+				Action: []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject",
+					"s3:GetObjectAcl", "s3:PutObjectAcl", "s3:RestoreObject",
+					"s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"},
+				Resource: objects,
+			},
+			{
+				Effect:   "Allow",
+				Action:   []string{"kms:Decrypt", "kms:GenerateDataKey"},
+				Resource: []string{"*"},
+			},
+		},
+	}
+
+	buf, err := json.Marshal(policy)
+	if err != nil {
+		panic(err)
+	}
+	return string(buf)
+}
+
+// scopeSession replaces the credentials of cloud with ones that are
+// limited to prefix and last for ttl. They come from assuming role if
+// given, or from GetFederationToken which needs IAM user credentials.
+func scopeSession(cloud StorageBackend, prefix string, ttl time.Duration, role string) (expires time.Time, err error) {
+	s := s3Backend(cloud)
+	if s == nil || !s.aws {
+		return expires, fmt.Errorf("scoped sessions are only supported on AWS S3")
+	}
+
+	// --endpoint is for S3 only
+	stsClient := sts.New(s.config.Session, s.awsConfig.Copy().WithEndpoint(""))
+	policy := scopedPolicy(s.bucket, storedPrefixes(cloud, prefix))
+	seconds := int64(ttl / time.Second)
+
+	var creds *sts.Credentials
+	if role != "" {
+		resp, err := stsClient.AssumeRole(&sts.AssumeRoleInput{
+			RoleArn:         &role,
+			RoleSessionName: aws.String(fmt.Sprintf("goofys-scoped-%v", time.Now().Unix())),
+			Policy:          &policy,
+			DurationSeconds: &seconds,
+		})
+		if err != nil {
+			return expires, err
+		}
+		creds = resp.Credentials
+	} else {
+		resp, err := stsClient.GetFederationToken(&sts.GetFederationTokenInput{
+			Name:            aws.String("goofys-scoped"),
+			Policy:          &policy,
+			DurationSeconds: &seconds,
+		})
+		if err != nil {
+			return expires, err
+		}
+		creds = resp.Credentials
+	}
+
+	s.awsConfig.Credentials = credentials.NewStaticCredentials(*creds.AccessKeyId,
+		*creds.SecretAccessKey, *creds.SessionToken)
+	s.newS3()
+
+	log.Infof("Scoped credentials for %v:%v expire at %v", s.bucket, prefix, *creds.Expiration)
+	return *creds.Expiration, nil
+}
+
+// expireSession flushes and unmounts shortly before the scoped
+// credentials expire
+func (fs *Goofys) expireSession(expires time.Time) {
+	deadline := expires.Add(-SCOPED_SESSION_MARGIN)
+	select {
+	case <-fs.ctx.Done():
+	case <-time.After(time.Until(deadline)):
+	}
+	if fs.ctx.Err() != nil {
+		// unmounted already
+		return
+	}
+
+	log.Infof("Scoped credentials are about to expire, unmounting %v", fs.flags.MountPoint)
+
+	// refuse new writes so the flush leaves nothing dirty behind
+	for _, f := range fs.Drain(time.Until(expires)) {
+		log.Errorf("%v was not persisted before the credentials expired", f)
+	}
+
+	// the mount stays busy for as long as something has it open,
+	// which can be a while
+	wait := 100 * time.Millisecond
+	var logged time.Time
+	for fs.ctx.Err() == nil {
+		err := TryUnmount(fs.flags.MountPoint)
+		if err == nil {
+			return
+		}
+		if time.Since(logged) >= time.Minute {
+			log.Errorf("Unable to unmount %v: %v", fs.flags.MountPoint, err)
+			logged = time.Now()
+		}
+
+		select {
+		case <-fs.ctx.Done():
+			// someone else unmounted us, what's mounted
+			// there now isn't ours
+			return
+		case <-time.After(wait):
+		}
+		if wait < 30*time.Second {
+			wait *= 2
+		}
+	}
+}
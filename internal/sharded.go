@@ -0,0 +1,348 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+)
+
+// ShardedBackend spreads the objects over several key prefixes,
+// because S3 limits the request rate per prefix. An object is stored
+// under the shard its key hashes to and listings merge all the shards
+// back together, so the mount doesn't see the shards at all.
+type ShardedBackend struct {
+	StorageBackend
+	shards []string
+}
+
+func NewShardedBackend(cloud StorageBackend, shards []string) *ShardedBackend {
+	return &ShardedBackend{
+		StorageBackend: cloud,
+		shards:         shards,
+	}
+}
+
+// parseShardPrefixes parses --shard-prefixes, which is a comma
+// separated list of prefixes
+func parseShardPrefixes(s string) (shards []string, err error) {
+	for _, p := range strings.Split(s, ",") {
+		p = strings.Trim(strings.TrimSpace(p), "/")
+		if p == "" {
+			return nil, fmt.Errorf("empty shard prefix")
+		}
+		p += "/"
+		for _, other := range shards {
+			if strings.HasPrefix(p, other) || strings.HasPrefix(other, p) {
+				return nil, fmt.Errorf("%v and %v overlap", other, p)
+			}
+		}
+		shards = append(shards, p)
+	}
+	if len(shards) < 2 {
+		return nil, fmt.Errorf("need at least 2 shards")
+	}
+	return
+}
+
+func (s *ShardedBackend) shard(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *ShardedBackend) key(key string) string {
+	return s.shard(key) + key
+}
+
+// unkey is the opposite of key, false if key isn't in a shard
+func (s *ShardedBackend) unkey(key string) (string, bool) {
+	for _, shard := range s.shards {
+		if strings.HasPrefix(key, shard) {
+			return key[len(shard):], true
+		}
+	}
+	return "", false
+}
+
+// shardedBackend returns the ShardedBackend behind cloud, or nil
+// without --shard-prefixes
+func shardedBackend(cloud StorageBackend) *ShardedBackend {
+	if s, ok := cloud.(*ScheduledBackend); ok {
+		cloud = s.StorageBackend
+	}
+	sharded, _ := cloud.(*ShardedBackend)
+	return sharded
+}
+
+// storedPrefixes returns where the objects under prefix are stored,
+// which is once in every shard with --shard-prefixes
+func storedPrefixes(cloud StorageBackend, prefix string) []string {
+	sharded := shardedBackend(cloud)
+	if sharded == nil {
+		return []string{prefix}
+	}
+
+	var prefixes []string
+	for _, shard := range sharded.shards {
+		prefixes = append(prefixes, shard+prefix)
+	}
+	return prefixes
+}
+
+func (s *ShardedBackend) Init(key string) error {
+	return s.StorageBackend.Init(s.key(key))
+}
+
+func (s *ShardedBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	p := *param
+	p.Key = s.key(param.Key)
+	resp, err := s.StorageBackend.HeadBlob(&p)
+	if err != nil {
+		return nil, err
+	}
+	resp.Key = &param.Key
+	return resp, nil
+}
+
+// ListBlobs lists every shard and returns the entries up to where the
+// shard with the fewest entries stopped. The continuation token is
+// that last entry, along with which shards have nothing left; each
+// shard then resumes after the last entry with StartAfter, so this
+// doesn't work on Azure, which doesn't support StartAfter.
+func (s *ShardedBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var prefix string
+	if param.Prefix != nil {
+		prefix = *param.Prefix
+	}
+
+	done := make([]bool, len(s.shards))
+	var after string
+	if param.ContinuationToken != nil {
+		var err error
+		done, after, err = s.parseToken(*param.ContinuationToken)
+		if err != nil {
+			return nil, err
+		}
+	} else if param.StartAfter != nil {
+		after = *param.StartAfter
+	}
+
+	// a page that resumes after a common prefix starts with that
+	// prefix again, at least 2 keys per page makes sure we move on
+	maxKeys := param.MaxKeys
+	if maxKeys != nil && *maxKeys < 2 {
+		maxKeys = PUInt32(2)
+	}
+
+	pages := make([]*ListBlobsOutput, len(s.shards))
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		if done[i] {
+			continue
+		}
+		p := ListBlobsInput{
+			Prefix:    PString(shard + prefix),
+			Delimiter: param.Delimiter,
+			MaxKeys:   maxKeys,
+			Context:   param.Context,
+		}
+		if after != "" {
+			p.StartAfter = PString(shard + after)
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pages[i], errs[i] = s.StorageBackend.ListBlobs(&p)
+		}(i)
+	}
+	wg.Wait()
+
+	items := make(map[string]BlobItemOutput)
+	prefixes := make(map[string]bool)
+	last := make([]string, len(s.shards))
+	var frontier *string
+	for i, page := range pages {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if page == nil {
+			continue
+		}
+
+		for _, item := range page.Items {
+			name := (*item.Key)[len(s.shards[i]):]
+			item.Key = &name
+			items[name] = item
+			if name > last[i] {
+				last[i] = name
+			}
+		}
+		for _, p := range page.Prefixes {
+			name := (*p.Prefix)[len(s.shards[i]):]
+			prefixes[name] = true
+			if name > last[i] {
+				last[i] = name
+			}
+		}
+		// the other shards may have more entries before where
+		// this one stopped
+		if page.IsTruncated && (frontier == nil || last[i] < *frontier) {
+			frontier = &last[i]
+		}
+	}
+
+	var names []string
+	for name := range items {
+		names = append(names, name)
+	}
+	for name := range prefixes {
+		if _, ok := items[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	truncated := false
+	resp := &ListBlobsOutput{
+		ContinuationToken: param.ContinuationToken,
+	}
+	for _, name := range names {
+		if param.ContinuationToken != nil && name <= after {
+			continue
+		}
+		if frontier != nil && name > *frontier ||
+			param.MaxKeys != nil && uint32(len(resp.Items)+len(resp.Prefixes)) == *param.MaxKeys {
+			truncated = true
+			break
+		}
+
+		name := name
+		if item, ok := items[name]; ok {
+			resp.Items = append(resp.Items, item)
+		} else {
+			resp.Prefixes = append(resp.Prefixes, BlobPrefixOutput{Prefix: &name})
+		}
+		after = name
+	}
+	if frontier != nil {
+		truncated = true
+	}
+
+	if truncated {
+		for i, page := range pages {
+			if page != nil && !page.IsTruncated && last[i] <= after {
+				done[i] = true
+			}
+		}
+		resp.IsTruncated = true
+		resp.NextContinuationToken = PString(s.token(done, after))
+	}
+	return resp, nil
+}
+
+func (s *ShardedBackend) token(done []bool, after string) string {
+	var flags []byte
+	for _, d := range done {
+		if d {
+			flags = append(flags, '1')
+		} else {
+			flags = append(flags, '0')
+		}
+	}
+	return string(flags) + ":" + after
+}
+
+func (s *ShardedBackend) parseToken(token string) (done []bool, after string, err error) {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 || len(parts[0]) != len(s.shards) {
+		return nil, "", fuse.EINVAL
+	}
+	for _, c := range parts[0] {
+		done = append(done, c == '1')
+	}
+	return done, parts[1], nil
+}
+
+func (s *ShardedBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	return s.StorageBackend.DeleteBlob(&DeleteBlobInput{Key: s.key(param.Key)})
+}
+
+func (s *ShardedBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	keys := make([]string, len(param.Items))
+	for i, key := range param.Items {
+		keys[i] = s.key(key)
+	}
+	return s.StorageBackend.DeleteBlobs(&DeleteBlobsInput{Items: keys})
+}
+
+func (s *ShardedBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	return s.StorageBackend.RenameBlob(&RenameBlobInput{
+		Source:      s.key(param.Source),
+		Destination: s.key(param.Destination),
+	})
+}
+
+func (s *ShardedBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	p := *param
+	p.Source = s.key(param.Source)
+	p.Destination = s.key(param.Destination)
+	return s.StorageBackend.CopyBlob(&p)
+}
+
+func (s *ShardedBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	p := *param
+	p.Key = s.key(param.Key)
+	resp, err := s.StorageBackend.GetBlob(&p)
+	if err != nil {
+		return nil, err
+	}
+	resp.Key = &param.Key
+	return resp, nil
+}
+
+func (s *ShardedBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	p := *param
+	p.Key = s.key(param.Key)
+	return s.StorageBackend.PutBlob(&p)
+}
+
+// the upload keeps the key in the shard, the other multipart calls
+// only pass it back
+func (s *ShardedBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	p := *param
+	p.Key = s.key(param.Key)
+	return s.StorageBackend.MultipartBlobBegin(&p)
+}
+
+func (s *ShardedBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	for _, shard := range s.shards {
+		_, err := s.StorageBackend.MultipartExpire(&MultipartExpireInput{
+			Prefix: shard + param.Prefix,
+			Age:    param.Age,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &MultipartExpireOutput{}, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// writeBuffer holds a part of a file being written until it's
+// uploaded, in memory (MBuf) or on disk (spillBuffer)
+type writeBuffer interface {
+	io.ReadSeeker
+	Write(p []byte) (n int, err error)
+	Full() bool
+	Len() int
+	Free()
+	Freed() bool
+}
+
+var (
+	spillBuffers = NewCounter("spill.buffers")
+	spillBytes   = NewCounter("spill.bytes")
+)
+
+// spillPool hands out write buffers in temporary files under dir, up
+// to max bytes in total. Writers use them when the memory buffers run
+// out, instead of waiting for uploads to finish.
+type spillPool struct {
+	dir string
+	max uint64
+
+	mu   sync.Mutex
+	used uint64
+}
+
+func newSpillPool(dir string, max uint64) *spillPool {
+	return &spillPool{dir: dir, max: max}
+}
+
+// request returns nil if the budget is exhausted or the file can't
+// be created, the caller then falls back to waiting for memory
+func (p *spillPool) request(size uint64) *spillBuffer {
+	p.mu.Lock()
+	if p.used+size > p.max {
+		p.mu.Unlock()
+		return nil
+	}
+	p.used += size
+	p.mu.Unlock()
+
+	f, err := ioutil.TempFile(p.dir, ".goofys-spill")
+	if err != nil {
+		log.Errorf("Unable to spill to %v: %v", p.dir, err)
+		p.release(size)
+		return nil
+	}
+	// so nothing is left behind if we die
+	os.Remove(f.Name())
+
+	spillBuffers.Inc()
+	return &spillBuffer{pool: p, f: f, cap: int64(size)}
+}
+
+func (p *spillPool) release(size uint64) {
+	p.mu.Lock()
+	p.used -= size
+	p.mu.Unlock()
+}
+
+type spillBuffer struct {
+	pool *spillPool
+	f    *os.File
+	cap  int64
+	rp   int64
+	wp   int64
+}
+
+func (b *spillBuffer) Write(p []byte) (n int, err error) {
+	if int64(len(p)) > b.cap-b.wp {
+		p = p[:b.cap-b.wp]
+	}
+	n, err = b.f.WriteAt(p, b.wp)
+	b.wp += int64(n)
+	spillBytes.Add(uint64(n))
+	if err != nil {
+		log.Errorf("Unable to spill to %v: %v", b.pool.dir, err)
+		err = syscall.EIO
+	}
+	return
+}
+
+func (b *spillBuffer) Full() bool {
+	return b.f == nil || b.wp == b.cap
+}
+
+// Len returns what's left to read, like MBuf
+func (b *spillBuffer) Len() int {
+	return int(b.wp - b.rp)
+}
+
+func (b *spillBuffer) Read(p []byte) (n int, err error) {
+	if b.rp == b.wp {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.wp-b.rp {
+		p = p[:b.wp-b.rp]
+	}
+	n, err = b.f.ReadAt(p, b.rp)
+	b.rp += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return
+}
+
+// Seek only seeks the reader, within what was written
+func (b *spillBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.rp
+	case io.SeekEnd:
+		offset += b.wp
+	}
+	if offset < 0 || offset > b.wp {
+		return b.rp, syscall.EINVAL
+	}
+	b.rp = offset
+	return offset, nil
+}
+
+func (b *spillBuffer) Free() {
+	if b.f != nil {
+		b.f.Close()
+		b.f = nil
+		b.pool.release(uint64(b.cap))
+	}
+}
+
+func (b *spillBuffer) Freed() bool {
+	return b.f == nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// a standby re-lists at most this often to keep its caches warm
+const STANDBY_MIN_WARM_INTERVAL = time.Minute
+
+// Warm fills the inode cache by listing the directories up to depth
+// levels below the root, so lookups don't have to go to the cloud
+// right after we are mounted
+func (fs *Goofys) Warm(depth int) {
+	fs.mu.RLock()
+	root := fs.inodes[fuseops.RootInodeID]
+	fs.mu.RUnlock()
+
+	fs.warmDir(root, depth)
+}
+
+func (fs *Goofys) warmDir(dir *Inode, depth int) {
+	if depth <= 0 {
+		return
+	}
+
+	dh := dir.OpenDir()
+	defer dh.CloseDir()
+
+	var subdirs []*Inode
+
+	dh.mu.Lock()
+	for i := fuseops.DirOffset(0); ; i++ {
+		e, err := dh.ReadDir(i)
+		if err != nil {
+			log.Warnf("Unable to warm %v: %v", *dir.FullName(), err)
+			break
+		}
+		if e == nil {
+			break
+		}
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+
+		fs.mu.RLock()
+		child := fs.inodes[e.Inode]
+		fs.mu.RUnlock()
+
+		if child != nil && child.isDir() {
+			subdirs = append(subdirs, child)
+		}
+	}
+	dh.mu.Unlock()
+
+	for _, d := range subdirs {
+		fs.warmDir(d, depth-1)
+	}
+}
+
+// Standby keeps our caches warm until nothing live is mounted on
+// mountPoint, so we can take over from a primary that died. A mount
+// that's left behind by a dead daemon is unmounted.
+func (fs *Goofys) Standby(mountPoint string) error {
+	depth := fs.flags.StandbyWarmDepth
+	interval := fs.StatCacheTTL()
+	if interval < STANDBY_MIN_WARM_INTERVAL {
+		interval = STANDBY_MIN_WARM_INTERVAL
+	}
+
+	log.Infof("Standing by for %v", mountPoint)
+	fs.Warm(depth)
+	lastWarm := fs.clock.Now()
+
+	for {
+		free, err := mountPointFree(mountPoint)
+		if err != nil {
+			return err
+		}
+		if free {
+			log.Infof("%v is free, taking over", mountPoint)
+			return nil
+		}
+
+		if fs.expired(lastWarm, interval) {
+			fs.Warm(depth)
+			lastWarm = fs.clock.Now()
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// mountPointFree returns true if nothing is mounted on mountPoint
+func mountPointFree(mountPoint string) (bool, error) {
+	var st, parent syscall.Stat_t
+
+	err := syscall.Stat(mountPoint, &st)
+	if err == syscall.ENOTCONN {
+		// the fuse daemon is gone
+		log.Infof("%v is a dead mount, unmounting", mountPoint)
+		err = forceUnmount(mountPoint)
+		if err != nil {
+			log.Errorf("Unable to unmount %v: %v", mountPoint, err)
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	err = syscall.Stat(filepath.Dir(mountPoint), &parent)
+	if err != nil {
+		return false, err
+	}
+	return st.Dev == parent.Dev, nil
+}
@@ -0,0 +1,25 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"os/exec"
+)
+
+// forceUnmount detaches mountPoint even if it's still in use, which
+// a mount whose daemon died usually is
+func forceUnmount(mountPoint string) error {
+	return exec.Command("umount", "-f", mountPoint).Run()
+}
@@ -0,0 +1,298 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StatsBackend serves the read only files under the virtual
+// STATS_DIR, generated from the state of the mount. Like
+// StorageBackendInitError it's mounted as a backend, so the rest of
+// goofys treats them as any other object.
+type StatsBackend struct {
+	fs *Goofys
+
+	// the content is generated when the file is looked up or
+	// listed and read from here, so reads agree with the size
+	// the kernel has
+	mu        sync.Mutex
+	snapshots map[string][]byte
+}
+
+const STATS_DIR = ".goofys"
+
+var statsFiles = map[string]func(fs *Goofys) []byte{
+	"stats":      (*Goofys).statsFile,
+	"inodes":     (*Goofys).inodesFile,
+	"goroutines": (*Goofys).goroutinesFile,
+}
+
+func NewStatsBackend(fs *Goofys) *StatsBackend {
+	return &StatsBackend{
+		fs:        fs,
+		snapshots: make(map[string][]byte),
+	}
+}
+
+// MountStats is a snapshot of the state of a mount. Counters are
+// shared by all the mounts in the process
+type MountStats struct {
+	Inodes      int
+	Forgot      uint32
+	DirHandles  int
+	FileHandles int
+	Counters    map[string]uint64
+}
+
+func (fs *Goofys) Stats() MountStats {
+	fs.mu.RLock()
+	stats := MountStats{
+		Inodes:      len(fs.inodes),
+		Forgot:      fs.forgotCnt,
+		DirHandles:  len(fs.dirHandles),
+		FileHandles: len(fs.fileHandles),
+		Counters:    make(map[string]uint64),
+	}
+	fs.mu.RUnlock()
+
+	for _, c := range Counters() {
+		stats.Counters[c.Name] = c.Value()
+	}
+	return stats
+}
+
+func (fs *Goofys) statsFile() []byte {
+	var buf bytes.Buffer
+
+	stats := fs.Stats()
+	fmt.Fprintf(&buf, "inodes %v\n", stats.Inodes)
+	fmt.Fprintf(&buf, "forgot %v\n", stats.Forgot)
+	fmt.Fprintf(&buf, "dir_handles %v\n", stats.DirHandles)
+	fmt.Fprintf(&buf, "file_handles %v\n", stats.FileHandles)
+
+	for _, c := range Counters() {
+		fmt.Fprintf(&buf, "%v %v\n", c.Name, stats.Counters[c.Name])
+	}
+	return buf.Bytes()
+}
+
+// inodesFile has one line per cached inode:
+// PATH TYPE SIZE AGE STATE HANDLES
+// AGE is how long ago the attributes were fetched, - if they never
+// expire. STATE is fresh or expired, and dirty if the size is not
+// known because the file is being written
+func (fs *Goofys) inodesFile() []byte {
+	fs.mu.RLock()
+	inodes := make([]*Inode, 0, len(fs.inodes))
+	for _, inode := range fs.inodes {
+		inodes = append(inodes, inode)
+	}
+	fs.mu.RUnlock()
+
+	now := fs.clock.Now()
+	var lines []string
+
+	// not taking inode.mu, this may be called with it held, ie:
+	// by getxattr on one of our files. A slightly stale line is
+	// fine here
+	for _, inode := range inodes {
+		typ := "file"
+		ttl := inode.statCacheTTL()
+		if inode.isDir() {
+			typ = "dir"
+			ttl = fs.TypeCacheTTL()
+		}
+
+		age := "-"
+		if inode.AttrTime != TIME_MAX {
+			age = now.Sub(inode.AttrTime).Truncate(time.Second).String()
+		}
+
+		state := "fresh"
+		if fs.expired(inode.AttrTime, ttl) {
+			state = "expired"
+		}
+		if !inode.isDir() && inode.KnownSize == nil {
+			state = "dirty"
+		}
+
+		lines = append(lines, fmt.Sprintf("/%v %v %v %v %v %v\n",
+			*inode.FullName(), typ, inode.Attributes.Size, age, state,
+			inode.fileHandles))
+	}
+
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, ""))
+}
+
+// goroutinesFile has the stack of every goroutine, like the dump a
+// SIGQUIT prints except the process keeps running
+func (fs *Goofys) goroutinesFile() []byte {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 2)
+	return buf.Bytes()
+}
+
+func (s *StatsBackend) snapshot(key string) ([]byte, bool) {
+	gen, ok := statsFiles[key]
+	if !ok {
+		return nil, false
+	}
+
+	content := gen(s.fs)
+
+	s.mu.Lock()
+	s.snapshots[key] = content
+	s.mu.Unlock()
+	return content, true
+}
+
+func (s *StatsBackend) Init(key string) error {
+	return nil
+}
+
+func (s *StatsBackend) Capabilities() *Capabilities {
+	return &Capabilities{
+		Name:    "stats",
+		DirBlob: true,
+	}
+}
+
+func (s *StatsBackend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	content, ok := s.snapshot(param.Key)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	return &HeadBlobOutput{
+		BlobItemOutput: BlobItemOutput{
+			Key:          &param.Key,
+			Size:         uint64(len(content)),
+			LastModified: PTime(time.Now()),
+		},
+	}, nil
+}
+
+func (s *StatsBackend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var items []BlobItemOutput
+	for name, _ := range statsFiles {
+		if param.Prefix != nil && !strings.HasPrefix(name, *param.Prefix) {
+			continue
+		}
+
+		content, _ := s.snapshot(name)
+		key := name
+		items = append(items, BlobItemOutput{
+			Key:          &key,
+			Size:         uint64(len(content)),
+			LastModified: PTime(time.Now()),
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return *items[i].Key < *items[j].Key
+	})
+
+	return &ListBlobsOutput{Items: items}, nil
+}
+
+func (s *StatsBackend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	s.mu.Lock()
+	content, ok := s.snapshots[param.Key]
+	s.mu.Unlock()
+
+	if !ok {
+		content, ok = s.snapshot(param.Key)
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+	}
+
+	end := uint64(len(content))
+	if param.Count != 0 && param.Start+param.Count < end {
+		end = param.Start + param.Count
+	}
+	if param.Start > end {
+		return nil, syscall.EINVAL
+	}
+	content = content[param.Start:end]
+
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:          &param.Key,
+				Size:         uint64(len(content)),
+				LastModified: PTime(time.Now()),
+			},
+		},
+		Body: ioutil.NopCloser(bytes.NewReader(content)),
+	}, nil
+}
+
+func (s *StatsBackend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (s *StatsBackend) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	return nil, syscall.EROFS
+}
+
+func (s *StatsBackend) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	return nil, syscall.EROFS
+}
@@ -0,0 +1,448 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "github.com/kahing/goofys/api/common"
+
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// files at least this large are uploaded in parts
+const SYNC_MULTIPART_SIZE = 64 * 1024 * 1024
+
+var syncCommand = cli.Command{
+	Name:      "sync",
+	Usage:     "Copy the files that differ between a local directory and a bucket prefix",
+	ArgsUsage: "LOCAL bucket[:prefix]",
+	Action:    commandAction(syncAction),
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "download",
+			Usage: "Copy from the bucket to LOCAL instead of the other way around",
+		},
+		cli.BoolFlag{
+			Name:  "checksum",
+			Usage: "Compare MD5 with the ETag instead of the modification time, where the ETag is an MD5",
+		},
+		cli.BoolFlag{
+			Name:  "delete",
+			Usage: "Delete the files in the destination that are not in the source",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only print what would be done",
+		},
+		cli.IntFlag{
+			Name:  "parallel",
+			Value: 16,
+			Usage: "Number of files to transfer at the same time",
+		},
+	},
+}
+
+type syncFile struct {
+	size  uint64
+	mtime time.Time
+	etag  string
+}
+
+func listLocal(root string) (files map[string]syncFile, err error) {
+	files = make(map[string]syncFile)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = syncFile{
+			size:  uint64(info.Size()),
+			mtime: info.ModTime(),
+		}
+		return nil
+	})
+	return
+}
+
+func listRemote(cloud StorageBackend, prefix string) (files map[string]syncFile, err error) {
+	files = make(map[string]syncFile)
+	var token *string
+
+	for {
+		resp, err := cloud.ListBlobs(&ListBlobsInput{
+			Prefix:            &prefix,
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range resp.Items {
+			if strings.HasSuffix(*item.Key, "/") {
+				// dir blob
+				continue
+			}
+			f := syncFile{size: item.Size}
+			if item.LastModified != nil {
+				f.mtime = *item.LastModified
+			}
+			if item.ETag != nil {
+				f.etag = strings.Trim(*item.ETag, "\"")
+			}
+			files[(*item.Key)[len(prefix):]] = f
+		}
+
+		if !resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+	return
+}
+
+// syncLocalPath returns where the remote file name goes under local.
+// Keys are arbitrary strings, so the ones that would land outside of
+// local are refused.
+func syncLocalPath(local string, name string) (string, bool) {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	for _, p := range strings.Split(name, "/") {
+		if p == ".." {
+			return "", false
+		}
+	}
+
+	path := filepath.Join(local, filepath.FromSlash(name))
+	rel, err := filepath.Rel(local, path)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path, true
+}
+
+// dropUnsafeRemote removes the remote files that can't be synced to
+// local, see syncLocalPath
+func dropUnsafeRemote(local string, prefix string, files map[string]syncFile) {
+	for name := range files {
+		if _, ok := syncLocalPath(local, name); !ok {
+			log.Warnf("Skipping %v: not a path under %v", prefix+name, local)
+			delete(files, name)
+		}
+	}
+}
+
+// isMD5 returns true if etag is the MD5 of the object. It isn't for
+// multipart uploads (MD5-PARTS) and for some server side encryption
+func isMD5(etag string) bool {
+	if len(etag) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(etag)
+	return err == nil
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncDiffers is rsync's quick check: a file is copied if its size
+// differs, or if the source is newer (upload) or the modification
+// time doesn't match the object (download, we set the mtime when we
+// download). With checksum the content is compared instead of the
+// time when the ETag allows.
+func syncDiffers(local syncFile, localPath string, remote syncFile, download bool, checksum bool) (bool, error) {
+	if local.size != remote.size {
+		return true, nil
+	}
+
+	if checksum && isMD5(remote.etag) {
+		sum, err := fileMD5(localPath)
+		if err != nil {
+			return false, err
+		}
+		return sum != remote.etag, nil
+	}
+
+	if download {
+		return !local.mtime.Truncate(time.Second).Equal(remote.mtime.Truncate(time.Second)), nil
+	} else {
+		return local.mtime.After(remote.mtime), nil
+	}
+}
+
+func uploadFile(cloud StorageBackend, key string, path string, size uint64, flags *FlagStorage) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return uploadBlob(cloud, key, f, size, flags.GetMimeType(key))
+}
+
+// uploadBlob uploads size bytes of body, in parts if it's large
+func uploadBlob(cloud StorageBackend, key string, body io.ReaderAt, size uint64, contentType *string) error {
+	if size < SYNC_MULTIPART_SIZE {
+		_, err := cloud.PutBlob(&PutBlobInput{
+			Key:         key,
+			Body:        io.NewSectionReader(body, 0, int64(size)),
+			Size:        &size,
+			ContentType: contentType,
+		})
+		return err
+	}
+
+	// 10000 parts at most
+	partSize := MaxUInt64(SYNC_MULTIPART_SIZE, (size+9999)/10000)
+
+	mpu, err := cloud.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:         key,
+		ContentType: contentType,
+	})
+	if err != nil {
+		return err
+	}
+
+	for off, part := uint64(0), uint32(1); off < size; off, part = off+partSize, part+1 {
+		n := MinUInt64(partSize, size-off)
+		_, err = cloud.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit:     mpu,
+			PartNumber: part,
+			Body:       io.NewSectionReader(body, int64(off), int64(n)),
+			Size:       n,
+			Last:       off+n == size,
+		})
+		if err != nil {
+			cloud.MultipartBlobAbort(mpu)
+			return err
+		}
+	}
+
+	_, err = cloud.MultipartBlobCommit(mpu)
+	return err
+}
+
+func downloadFile(cloud StorageBackend, key string, path string) error {
+	resp, err := cloud.GetBlob(&GetBlobInput{Key: key})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// so a partial download never replaces the file
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".goofys-sync-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, resp.Body)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if resp.LastModified != nil {
+		err = os.Chtimes(path, *resp.LastModified, *resp.LastModified)
+	}
+	return err
+}
+
+type syncTask struct {
+	op   string
+	name string
+	fn   func() error
+}
+
+func syncAction(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return fmt.Errorf("sync takes exactly two arguments: LOCAL bucket[:prefix]")
+	}
+	local, bucket := c.Args()[0], c.Args()[1]
+
+	download := c.Bool("download")
+	checksum := c.Bool("checksum")
+	dryRun := c.Bool("dry-run")
+
+	cloud, prefix, flags, err := commandBackend(c, bucket)
+	if err != nil {
+		return err
+	}
+
+	localFiles, err := listLocal(local)
+	if err != nil {
+		if !(download && os.IsNotExist(err)) {
+			return fmt.Errorf("Unable to list %v: %v", local, err)
+		}
+	}
+	remoteFiles, err := listRemote(cloud, prefix)
+	if err != nil {
+		return fmt.Errorf("Unable to list %v: %v", bucket, err)
+	}
+	dropUnsafeRemote(local, prefix, remoteFiles)
+
+	src, dst := localFiles, remoteFiles
+	if download {
+		src, dst = remoteFiles, localFiles
+	}
+
+	var tasks []syncTask
+	for name, s := range src {
+		name := name
+		key := prefix + name
+		path, _ := syncLocalPath(local, name)
+
+		if d, ok := dst[name]; ok {
+			l, r := s, d
+			if download {
+				l, r = d, s
+			}
+			differs, err := syncDiffers(l, path, r, download, checksum)
+			if err != nil {
+				return err
+			}
+			if !differs {
+				continue
+			}
+		}
+
+		if download {
+			tasks = append(tasks, syncTask{"download", name, func() error {
+				return downloadFile(cloud, key, path)
+			}})
+		} else {
+			size := s.size
+			tasks = append(tasks, syncTask{"upload", name, func() error {
+				return uploadFile(cloud, key, path, size, flags)
+			}})
+		}
+	}
+
+	if c.Bool("delete") {
+		for name := range dst {
+			if _, ok := src[name]; ok {
+				continue
+			}
+			key := prefix + name
+			path, _ := syncLocalPath(local, name)
+
+			if download {
+				tasks = append(tasks, syncTask{"delete", name, func() error {
+					return os.Remove(path)
+				}})
+			} else {
+				tasks = append(tasks, syncTask{"delete", name, func() error {
+					_, err := cloud.DeleteBlob(&DeleteBlobInput{Key: key})
+					return err
+				}})
+			}
+		}
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].name < tasks[j].name
+	})
+
+	if dryRun {
+		for _, t := range tasks {
+			fmt.Printf("%v %v\n", t.op, t.name)
+		}
+		return nil
+	}
+
+	return runSyncTasks(tasks, c.Int("parallel"))
+}
+
+func runSyncTasks(tasks []syncTask, parallel int) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed int
+	ch := make(chan syncTask)
+
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				err := t.fn()
+				if err != nil {
+					log.Errorf("%v %v: %v", t.op, t.name, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				} else {
+					log.Infof("%v %v", t.op, t.name)
+				}
+			}
+		}()
+	}
+
+	for _, t := range tasks {
+		ch <- t
+	}
+	close(ch)
+	wg.Wait()
+
+	if failed != 0 {
+		return fmt.Errorf("%v of %v files failed to sync", failed, len(tasks))
+	}
+	log.Infof("%v files synced", len(tasks))
+	return nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A tenant is a prefix of the bucket that is mounted at the same path
+// under the mount, with its own owner, quota, storage class and
+// tags. Tenants are declared in the --tenants file:
+//
+//	{"tenants": [
+//	  {"prefix": "apps/a", "uid": 1000, "gid": 1000, "quota_mb": 10240,
+//	   "storage_class": "STANDARD_IA", "tags": {"team": "a"}}
+//	]}
+//
+// Like across any other mount, renames in and out of a tenant fail.
+// A tenant with a uid can only be opened, listed or changed by that
+// uid (or root and --admin-uid), see checkTenant.
+type Tenant struct {
+	Prefix       string            `json:"prefix"`
+	Uid          *uint32           `json:"uid"`
+	Gid          *uint32           `json:"gid"`
+	QuotaMB      uint64            `json:"quota_mb"`
+	StorageClass string            `json:"storage_class"`
+	Tags         map[string]string `json:"tags"`
+
+	fs     *Goofys
+	cloud  StorageBackend
+	prefix string
+
+	mu sync.Mutex
+	// bytes under the prefix, listed at usedTime plus what was
+	// committed and removed since, and bytes written by the open
+	// handles that are not flushed yet
+	used       uint64
+	usedTime   time.Time
+	refreshing bool
+	pending    uint64
+}
+
+type tenantsFile struct {
+	Tenants []*Tenant `json:"tenants"`
+}
+
+func loadTenants(path string) ([]*Tenant, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tenantsFile
+	err = json.Unmarshal(buf, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for i, t := range file.Tenants {
+		t.Prefix = strings.Trim(t.Prefix, "/")
+		if t.Prefix == "" {
+			return nil, fmt.Errorf("tenant %v: prefix is required", i)
+		}
+		if seen[t.Prefix] {
+			return nil, fmt.Errorf("tenant %v: duplicate prefix %v", i, t.Prefix)
+		}
+		seen[t.Prefix] = true
+	}
+
+	// a tenant can't be nested in another one
+	for p := range seen {
+		for q := range seen {
+			if strings.HasPrefix(p, q+"/") {
+				return nil, fmt.Errorf("tenant %v is under tenant %v", p, q)
+			}
+		}
+	}
+
+	return file.Tenants, nil
+}
+
+// mountTenants mounts every tenant at its prefix, sharing cloud with
+// the root which is mounted at prefix
+func (fs *Goofys) mountTenants(root *Inode, cloud StorageBackend, prefix string, tenants []*Tenant) {
+	for _, t := range tenants {
+		t.fs = fs
+		t.cloud = cloud
+		t.prefix = prefix + t.Prefix + "/"
+
+		if (t.StorageClass != "" || len(t.Tags) != 0) && s3Backend(cloud) == nil {
+			log.Warnf("tenant %v: storage class and tags are only supported on S3", t.Prefix)
+		}
+
+		fs.mount(root, &Mount{
+			name:   t.Prefix,
+			cloud:  cloud,
+			prefix: t.prefix,
+			tenant: t,
+		})
+	}
+}
+
+// tenant returns the tenant this inode belongs to, if any
+func (inode *Inode) tenant() *Tenant {
+	dir := inode
+	if inode.dir == nil {
+		dir = inode.Parent
+	}
+
+	for p := dir; p != nil; p = p.Parent {
+		if p.dir.tenant != nil {
+			return p.dir.tenant
+		}
+	}
+	return nil
+}
+
+// checkTenant returns EACCES if uid may not get into the tenant
+// inode belongs to. A tenant with a uid is only open to that uid, to
+// root and to --admin-uid, whatever the mode bits say
+func (fs *Goofys) checkTenant(inode *Inode, uid uint32) error {
+	t := inode.tenant()
+	if t == nil || t.Uid == nil || uid == *t.Uid || uid == 0 || uid == fs.flags.AdminUid {
+		return nil
+	}
+	return syscall.EACCES
+}
+
+func (t *Tenant) storageClass() *string {
+	if t == nil || t.StorageClass == "" {
+		return nil
+	}
+	return &t.StorageClass
+}
+
+func (t *Tenant) tags() map[string]string {
+	if t == nil {
+		return nil
+	}
+	return t.Tags
+}
+
+// reserve accounts for size more bytes to be written, or returns
+// ENOSPC if that would put the tenant over its quota
+func (t *Tenant) reserve(size uint64, ttl time.Duration) error {
+	if t == nil || t.QuotaMB == 0 {
+		return nil
+	}
+
+	err := t.refresh(ttl)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.used+t.pending+size > t.QuotaMB*1024*1024 {
+		log.Warnf("tenant %v is over its quota of %vMB", t.Prefix, t.QuotaMB)
+		return syscall.ENOSPC
+	}
+	t.pending += size
+	return nil
+}
+
+// refresh lists the prefix again once the usage is older than ttl,
+// to pick up what others changed. Listing a big prefix takes a while,
+// so it's done by one writer at a time without holding t.mu, and the
+// others go by the usage we have
+func (t *Tenant) refresh(ttl time.Duration) error {
+	t.mu.Lock()
+	if t.refreshing || !t.fs.expired(t.usedTime, ttl) {
+		t.mu.Unlock()
+		return nil
+	}
+	t.refreshing = true
+	t.mu.Unlock()
+
+	du, err := duPrefix(t.fs.clock, t.cloud, t.prefix)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.refreshing = false
+	if err != nil {
+		return err
+	}
+	t.used = du.bytes
+	t.usedTime = du.time
+	return nil
+}
+
+// release returns bytes that were reserved, and counts them as used
+// if they were committed
+func (t *Tenant) release(size uint64, committed bool) {
+	if t == nil || t.QuotaMB == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending -= size
+	if committed {
+		t.used += size
+	}
+}
+
+// removed is for when an object of size bytes was deleted
+func (t *Tenant) removed(size uint64) {
+	if t == nil || t.QuotaMB == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if size > t.used {
+		t.used = 0
+	} else {
+		t.used -= size
+	}
+}
+
+// encodeTags formats tags the way x-amz-tagging expects
+func encodeTags(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return PString(values.Encode())
+}
@@ -0,0 +1,397 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// TraceFS records the ops that go through it as one JSON object per
+// line, in the order they complete, so an op always comes after the
+// ones it depends on. The data that is read or written is not
+// recorded, only its size. goofys replay runs a trace again.
+type TraceFS struct {
+	Fs fuseutil.FileSystem
+
+	// replace file names with a hash of them
+	anonymize bool
+
+	mu    sync.Mutex
+	w     io.Writer
+	enc   *json.Encoder
+	start time.Time
+}
+
+type traceRecord struct {
+	// seconds since the trace started
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+	Op       string  `json:"op"`
+
+	Inode     uint64 `json:"inode,omitempty"`
+	Parent    uint64 `json:"parent,omitempty"`
+	Name      string `json:"name,omitempty"`
+	NewParent uint64 `json:"new_parent,omitempty"`
+	NewName   string `json:"new_name,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Handle    uint64 `json:"handle,omitempty"`
+	Offset    uint64 `json:"offset,omitempty"`
+	// bytes requested by reads, written by writes
+	Size uint64 `json:"size,omitempty"`
+	Mode uint32 `json:"mode,omitempty"`
+	N    uint64 `json:"n,omitempty"`
+	// only for knobs, other xattrs may be sensitive
+	Value string `json:"value,omitempty"`
+
+	SetSize  *uint64    `json:"set_size,omitempty"`
+	SetMode  *uint32    `json:"set_mode,omitempty"`
+	SetMtime *time.Time `json:"set_mtime,omitempty"`
+
+	// what the op returned
+	Child     uint64 `json:"child,omitempty"`
+	ChildDir  bool   `json:"child_dir,omitempty"`
+	ChildSize uint64 `json:"child_size,omitempty"`
+	NewHandle uint64 `json:"new_handle,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func NewTraceFS(fs fuseutil.FileSystem, w io.Writer, anonymize bool) *TraceFS {
+	return &TraceFS{
+		Fs:        fs,
+		anonymize: anonymize,
+		w:         w,
+		enc:       json.NewEncoder(w),
+		start:     time.Now(),
+	}
+}
+
+func (t *TraceFS) name(name string) string {
+	if t.anonymize && name != "" {
+		return redactedName(name)
+	}
+	return name
+}
+
+func (t *TraceFS) path(path string) string {
+	if !t.anonymize {
+		return path
+	}
+	names := strings.Split(path, "/")
+	for i, n := range names {
+		names[i] = t.name(n)
+	}
+	return strings.Join(names, "/")
+}
+
+func (t *TraceFS) begin(op string) *traceRecord {
+	return &traceRecord{
+		Start: time.Since(t.start).Seconds(),
+		Op:    op,
+	}
+}
+
+func (t *TraceFS) end(r *traceRecord, err error) {
+	r.Duration = time.Since(t.start).Seconds() - r.Start
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.enc.Encode(r)
+	if err != nil {
+		log.Errorf("Unable to write trace: %v", err)
+	}
+}
+
+func (r *traceRecord) entry(e *fuseops.ChildInodeEntry) {
+	r.Child = uint64(e.Child)
+	r.ChildDir = e.Attributes.Mode.IsDir()
+	r.ChildSize = e.Attributes.Size
+}
+
+func (t *TraceFS) StatFS(ctx context.Context, op *fuseops.StatFSOp) (err error) {
+	r := t.begin("StatFS")
+	err = t.Fs.StatFS(ctx, op)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) (err error) {
+	r := t.begin("LookUpInode")
+	err = t.Fs.LookUpInode(ctx, op)
+	r.Parent, r.Name = uint64(op.Parent), t.name(op.Name)
+	if err == nil {
+		r.entry(&op.Entry)
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) (err error) {
+	r := t.begin("GetInodeAttributes")
+	err = t.Fs.GetInodeAttributes(ctx, op)
+	r.Inode = uint64(op.Inode)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) (err error) {
+	r := t.begin("SetInodeAttributes")
+	err = t.Fs.SetInodeAttributes(ctx, op)
+	r.Inode = uint64(op.Inode)
+	r.SetSize = op.Size
+	if op.Mode != nil {
+		mode := uint32(*op.Mode)
+		r.SetMode = &mode
+	}
+	r.SetMtime = op.Mtime
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) (err error) {
+	r := t.begin("ForgetInode")
+	err = t.Fs.ForgetInode(ctx, op)
+	r.Inode, r.N = uint64(op.Inode), op.N
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) MkDir(ctx context.Context, op *fuseops.MkDirOp) (err error) {
+	r := t.begin("MkDir")
+	err = t.Fs.MkDir(ctx, op)
+	r.Parent, r.Name, r.Mode = uint64(op.Parent), t.name(op.Name), uint32(op.Mode)
+	if err == nil {
+		r.entry(&op.Entry)
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) MkNode(ctx context.Context, op *fuseops.MkNodeOp) (err error) {
+	r := t.begin("MkNode")
+	err = t.Fs.MkNode(ctx, op)
+	r.Parent, r.Name, r.Mode = uint64(op.Parent), t.name(op.Name), uint32(op.Mode)
+	if err == nil {
+		r.entry(&op.Entry)
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) (err error) {
+	r := t.begin("CreateFile")
+	err = t.Fs.CreateFile(ctx, op)
+	r.Parent, r.Name, r.Mode = uint64(op.Parent), t.name(op.Name), uint32(op.Mode)
+	if err == nil {
+		r.entry(&op.Entry)
+		r.NewHandle = uint64(op.Handle)
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) (err error) {
+	r := t.begin("CreateLink")
+	err = t.Fs.CreateLink(ctx, op)
+	r.Parent, r.Name, r.Inode = uint64(op.Parent), t.name(op.Name), uint64(op.Target)
+	if err == nil {
+		r.entry(&op.Entry)
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) (err error) {
+	r := t.begin("CreateSymlink")
+	err = t.Fs.CreateSymlink(ctx, op)
+	r.Parent, r.Name, r.Target = uint64(op.Parent), t.name(op.Name), t.name(op.Target)
+	if err == nil {
+		r.entry(&op.Entry)
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) Rename(ctx context.Context, op *fuseops.RenameOp) (err error) {
+	r := t.begin("Rename")
+	err = t.Fs.Rename(ctx, op)
+	r.Parent, r.Name = uint64(op.OldParent), t.name(op.OldName)
+	r.NewParent, r.NewName = uint64(op.NewParent), t.name(op.NewName)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) RmDir(ctx context.Context, op *fuseops.RmDirOp) (err error) {
+	r := t.begin("RmDir")
+	err = t.Fs.RmDir(ctx, op)
+	r.Parent, r.Name = uint64(op.Parent), t.name(op.Name)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) Unlink(ctx context.Context, op *fuseops.UnlinkOp) (err error) {
+	r := t.begin("Unlink")
+	err = t.Fs.Unlink(ctx, op)
+	r.Parent, r.Name = uint64(op.Parent), t.name(op.Name)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) (err error) {
+	r := t.begin("OpenDir")
+	err = t.Fs.OpenDir(ctx, op)
+	r.Inode = uint64(op.Inode)
+	if err == nil {
+		r.NewHandle = uint64(op.Handle)
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) (err error) {
+	r := t.begin("ReadDir")
+	err = t.Fs.ReadDir(ctx, op)
+	r.Inode, r.Handle = uint64(op.Inode), uint64(op.Handle)
+	r.Offset, r.Size = uint64(op.Offset), uint64(len(op.Dst))
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) (err error) {
+	r := t.begin("ReleaseDirHandle")
+	err = t.Fs.ReleaseDirHandle(ctx, op)
+	r.Handle = uint64(op.Handle)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err error) {
+	r := t.begin("OpenFile")
+	err = t.Fs.OpenFile(ctx, op)
+	r.Inode = uint64(op.Inode)
+	if err == nil {
+		r.NewHandle = uint64(op.Handle)
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err error) {
+	r := t.begin("ReadFile")
+	err = t.Fs.ReadFile(ctx, op)
+	r.Inode, r.Handle = uint64(op.Inode), uint64(op.Handle)
+	r.Offset, r.Size = uint64(op.Offset), uint64(len(op.Dst))
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) (err error) {
+	r := t.begin("WriteFile")
+	err = t.Fs.WriteFile(ctx, op)
+	r.Inode, r.Handle = uint64(op.Inode), uint64(op.Handle)
+	r.Offset, r.Size = uint64(op.Offset), uint64(len(op.Data))
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) (err error) {
+	r := t.begin("SyncFile")
+	err = t.Fs.SyncFile(ctx, op)
+	r.Inode, r.Handle = uint64(op.Inode), uint64(op.Handle)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) (err error) {
+	r := t.begin("FlushFile")
+	err = t.Fs.FlushFile(ctx, op)
+	r.Inode, r.Handle = uint64(op.Inode), uint64(op.Handle)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) (err error) {
+	r := t.begin("ReleaseFileHandle")
+	err = t.Fs.ReleaseFileHandle(ctx, op)
+	r.Handle = uint64(op.Handle)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) (err error) {
+	r := t.begin("ReadSymlink")
+	err = t.Fs.ReadSymlink(ctx, op)
+	r.Inode = uint64(op.Inode)
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) (err error) {
+	r := t.begin("RemoveXattr")
+	err = t.Fs.RemoveXattr(ctx, op)
+	r.Inode, r.Name = uint64(op.Inode), op.Name
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) (err error) {
+	r := t.begin("GetXattr")
+	err = t.Fs.GetXattr(ctx, op)
+	r.Inode, r.Name, r.Size = uint64(op.Inode), op.Name, uint64(len(op.Dst))
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) (err error) {
+	r := t.begin("ListXattr")
+	err = t.Fs.ListXattr(ctx, op)
+	r.Inode, r.Size = uint64(op.Inode), uint64(len(op.Dst))
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) (err error) {
+	r := t.begin("SetXattr")
+	err = t.Fs.SetXattr(ctx, op)
+	r.Inode, r.Name, r.Size = uint64(op.Inode), op.Name, uint64(len(op.Value))
+	if isKnob(op.Name) {
+		r.Value = string(op.Value)
+		if k, ok := knobs[strings.TrimPrefix(op.Name, knobPrefix)]; ok && k.path {
+			r.Value = t.path(r.Value)
+		}
+	}
+	t.end(r, err)
+	return
+}
+
+func (t *TraceFS) Destroy() {
+	t.Fs.Destroy()
+
+	if c, ok := t.w.(io.Closer); ok {
+		t.mu.Lock()
+		c.Close()
+		t.mu.Unlock()
+	}
+}
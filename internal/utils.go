@@ -15,7 +15,12 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -162,3 +167,71 @@ func (sem semaphore) V(n int) {
 		<-sem
 	}
 }
+
+// cacheControlTTL returns how long an object may be cached according
+// to its Cache-Control and Expires headers, Cache-Control takes
+// precedence as in HTTP
+func cacheControlTTL(cacheControl *string, expires *string, now time.Time) (ttl time.Duration, ok bool) {
+	if cacheControl != nil {
+		for _, d := range strings.Split(*cacheControl, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			switch {
+			case d == "no-cache" || d == "no-store":
+				// always revalidate
+				return 0, true
+			case strings.HasPrefix(d, "max-age="):
+				secs, err := strconv.ParseInt(strings.Trim(d[8:], "\""), 10, 64)
+				if err == nil && secs >= 0 {
+					return time.Duration(secs) * time.Second, true
+				}
+			}
+		}
+	}
+
+	if expires != nil {
+		t, err := http.ParseTime(*expires)
+		if err != nil {
+			// invalid dates mean already expired
+			return 0, true
+		}
+		if t.Before(now) {
+			return 0, true
+		}
+		return t.Sub(now), true
+	}
+
+	return
+}
+
+// onInterrupt calls abort if ctx is cancelled before the returned
+// func is called. jacobsa/fuse cancels the context of an op when the
+// kernel interrupts it, ie: the process doing the IO got a signal.
+// abort is never called after done returns.
+func onInterrupt(ctx context.Context, abort func()) (done func()) {
+	if ctx == nil || ctx.Done() == nil {
+		return func() {}
+	}
+
+	var mu sync.Mutex
+	finished := false
+	stop := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !finished {
+				abort()
+			}
+			mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		close(stop)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
+)
+
+// SigV4A is the asymmetric variant of SigV4 that is required by
+// multi-region access points. The request is signed with an ECDSA
+// P-256 key derived from the secret key, and the scope names a set
+// of regions instead of a single one. aws-sdk-go doesn't implement
+// it so we do it here the same way as the v2 signer.
+
+const (
+	v4aAlgorithm  = "AWS4-ECDSA-P256-SHA256"
+	v4aTimeFormat = "20060102T150405Z"
+	v4aDateFormat = "20060102"
+)
+
+type v4aKey struct {
+	secret string
+	priv   *ecdsa.PrivateKey
+}
+
+var v4aKeys = struct {
+	mu   sync.Mutex
+	keys map[string]v4aKey
+}{keys: make(map[string]v4aKey)}
+
+// deriveV4AKey derives the signing key from the access key pair
+// with the NIST SP 800-108 counter mode KDF as specified by SigV4A
+func deriveV4AKey(accessKey string, secretKey string) (*ecdsa.PrivateKey, error) {
+	v4aKeys.mu.Lock()
+	defer v4aKeys.mu.Unlock()
+
+	if k, ok := v4aKeys.keys[accessKey]; ok && k.secret == secretKey {
+		return k.priv, nil
+	}
+
+	curve := elliptic.P256()
+	nMinusTwo := new(big.Int).Sub(curve.Params().N, big.NewInt(2))
+	inputKey := []byte("AWS4A" + secretKey)
+
+	var d *big.Int
+	for counter := 1; counter <= 0xff; counter++ {
+		context := append([]byte(accessKey), byte(counter))
+
+		var fixedInput []byte
+		fixedInput = append(fixedInput, v4aAlgorithm...)
+		fixedInput = append(fixedInput, 0)
+		fixedInput = append(fixedInput, context...)
+		fixedInput = append(fixedInput, 0, 0, 1, 0) // 256 bits
+
+		// a 256 bit key only needs one round of the KDF
+		h := hmac.New(sha256.New, inputKey)
+		binary.Write(h, binary.BigEndian, int32(1))
+		h.Write(fixedInput)
+
+		c := new(big.Int).SetBytes(h.Sum(nil))
+		if c.Cmp(nMinusTwo) <= 0 {
+			d = c.Add(c, big.NewInt(1))
+			break
+		}
+	}
+	if d == nil {
+		return nil, fmt.Errorf("unable to derive sigv4a key")
+	}
+
+	priv := &ecdsa.PrivateKey{D: d}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+
+	v4aKeys.keys[accessKey] = v4aKey{secret: secretKey, priv: priv}
+	return priv, nil
+}
+
+// headers that are never signed, same as the v4 signer
+var v4aIgnoredHeaders = map[string]bool{
+	"authorization":     true,
+	"user-agent":        true,
+	"x-amzn-trace-id":   true,
+	"transfer-encoding": true,
+}
+
+type v4aSigner struct {
+	Request     *http.Request
+	Body        io.ReadSeeker
+	Time        time.Time
+	Credentials *credentials.Credentials
+	RegionSet   string
+	Service     string
+	Debug       aws.LogLevelType
+	Logger      aws.Logger
+	// s3 paths are signed as they are sent
+	DisableURIPathEscaping bool
+
+	canonicalRequest string
+	stringToSign     string
+}
+
+// SignV4A returns a Sign handler that signs requests with SigV4A for
+// the given comma separated set of regions ("*" for all of them)
+func SignV4A(regionSet string) func(req *request.Request) {
+	return func(req *request.Request) {
+		if req.Config.Credentials == credentials.AnonymousCredentials {
+			return
+		}
+
+		v4a := v4aSigner{
+			Request:     req.HTTPRequest,
+			Body:        req.Body,
+			Time:        req.Time,
+			Credentials: req.Config.Credentials,
+			RegionSet:   regionSet,
+			Service:     req.ClientInfo.SigningName,
+			Debug:       req.Config.LogLevel.Value(),
+			Logger:      req.Config.Logger,
+		}
+		if v4a.Service == "" {
+			v4a.Service = req.ClientInfo.ServiceName
+		}
+		v4a.DisableURIPathEscaping = v4a.Service == "s3"
+
+		req.Error = v4a.Sign()
+	}
+}
+
+func v4aURIPath(u *url.URL) (uri string) {
+	if len(u.Opaque) > 0 {
+		uri = "/" + strings.Join(strings.Split(u.Opaque, "/")[3:], "/")
+	} else {
+		uri = u.EscapedPath()
+	}
+	if len(uri) == 0 {
+		uri = "/"
+	}
+	return
+}
+
+func (v4a *v4aSigner) payloadHash() (string, error) {
+	if v4a.Body == nil {
+		return hex.EncodeToString(sha256.New().Sum(nil)), nil
+	}
+
+	start, err := v4a.Body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	defer v4a.Body.Seek(start, io.SeekStart)
+
+	h := sha256.New()
+	_, err = io.Copy(h, v4a.Body)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (v4a *v4aSigner) Sign() error {
+	credValue, err := v4a.Credentials.Get()
+	if err != nil {
+		return err
+	}
+
+	priv, err := deriveV4AKey(credValue.AccessKeyID, credValue.SecretAccessKey)
+	if err != nil {
+		return err
+	}
+
+	payloadHash, err := v4a.payloadHash()
+	if err != nil {
+		return err
+	}
+
+	r := v4a.Request
+	t := v4a.Time.UTC()
+	date := t.Format(v4aTimeFormat)
+	scope := strings.Join([]string{t.Format(v4aDateFormat), v4a.Service, "aws4_request"}, "/")
+
+	// in case this is a retry, ensure no signature present
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Amz-Date", date)
+	r.Header.Set("X-Amz-Region-Set", v4a.RegionSet)
+	if v4a.Service == "s3" {
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if credValue.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", credValue.SessionToken)
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	headers := []string{"host"}
+	values := map[string][]string{"host": {host}}
+	if r.ContentLength > 0 {
+		headers = append(headers, "content-length")
+		values["content-length"] = []string{fmt.Sprint(r.ContentLength)}
+	}
+	for k, v := range r.Header {
+		k = strings.ToLower(k)
+		if v4aIgnoredHeaders[k] {
+			continue
+		}
+		if _, ok := values[k]; !ok {
+			headers = append(headers, k)
+		}
+		// canonicalize a copy, the request is sent as is
+		for _, s := range v {
+			values[k] = append(values[k], strings.Join(strings.Fields(s), " "))
+		}
+	}
+	sort.Strings(headers)
+
+	var canonicalHeaders []string
+	for _, k := range headers {
+		canonicalHeaders = append(canonicalHeaders, k+":"+strings.Join(values[k], ","))
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	query := r.URL.Query()
+	for k := range query {
+		sort.Strings(query[k])
+	}
+	// send the query exactly the way we signed it
+	r.URL.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+
+	uri := v4aURIPath(r.URL)
+	if !v4a.DisableURIPathEscaping {
+		uri = rest.EscapePath(uri, false)
+	}
+
+	v4a.canonicalRequest = strings.Join([]string{
+		r.Method,
+		uri,
+		r.URL.RawQuery,
+		strings.Join(canonicalHeaders, "\n") + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(v4a.canonicalRequest))
+	v4a.stringToSign = strings.Join([]string{
+		v4aAlgorithm,
+		date,
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(v4a.stringToSign))
+	R, S, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	if err != nil {
+		return err
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{R, S})
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		v4aAlgorithm, credValue.AccessKeyID, scope, signedHeaders, hex.EncodeToString(sig)))
+
+	if v4a.Debug.Matches(aws.LogDebugWithSigning) {
+		v4a.logSigningInfo()
+	}
+
+	return nil
+}
+
+const logV4ASignInfoMsg = `DEBUG: Request Signature:
+---[ CANONICAL STRING  ]-----------------------------
+%s
+---[ STRING TO SIGN ]--------------------------------
+%s
+---[ SIGNATURE ]-------------------------------------
+%s
+-----------------------------------------------------`
+
+func (v4a *v4aSigner) logSigningInfo() {
+	msg := fmt.Sprintf(logV4ASignInfoMsg, v4a.canonicalRequest, v4a.stringToSign,
+		v4a.Request.Header.Get("Authorization"))
+	v4a.Logger.Log(msg)
+}
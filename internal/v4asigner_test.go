@@ -0,0 +1,146 @@
+// Copyright 2019 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	. "gopkg.in/check.v1"
+
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// the known answers below are the SigV4A test vectors of
+// aws-sdk-go-v2 (internal/v4a/v4a_test.go)
+
+const (
+	v4aTestAccessKey = "AKISORANDOMAASORANDOM"
+	v4aTestSecretKey = "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom"
+)
+
+type V4ASignerTest struct {
+}
+
+var _ = Suite(&V4ASignerTest{})
+
+func v4aTestRequest() *http.Request {
+	req, _ := http.NewRequest("POST", "https://dynamodb.us-east-1.amazonaws.com", nil)
+	req.URL.Opaque = "//example.org/bucket/key-._~,!@%23$%25^&*()"
+	req.Header.Set("X-Amz-Target", "prefix.Operation")
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("Content-Length", "1024")
+	req.Header.Set("X-Amz-Meta-Other-Header", "some-value=!@#$%^&* (+)")
+	req.Header.Add("X-Amz-Meta-Other-Header_With_Underscore", "some-value=!@#$%^&* (+)")
+	req.Header.Add("X-amz-Meta-Other-Header_With_Underscore", "some-value=!@#$%^&* (+)")
+	return req
+}
+
+func (s *V4ASignerTest) sign(t *C, req *http.Request, token string) *v4aSigner {
+	v4a := &v4aSigner{
+		Request: req,
+		Time:    time.Unix(0, 0),
+		Credentials: credentials.NewStaticCredentials(v4aTestAccessKey,
+			v4aTestSecretKey, token),
+		RegionSet: "us-east-1",
+		Service:   "dynamodb",
+	}
+	t.Assert(v4a.Sign(), IsNil)
+	return v4a
+}
+
+func (s *V4ASignerTest) checkAuthorization(t *C, v4a *v4aSigner, signedHeaders string,
+	stringToSignHash string) {
+
+	hash := sha256.Sum256([]byte(v4a.stringToSign))
+	t.Assert(hex.EncodeToString(hash[:]), Equals, stringToSignHash)
+
+	auth := v4a.Request.Header.Get("Authorization")
+	prefix := "AWS4-ECDSA-P256-SHA256 Credential=AKISORANDOMAASORANDOM/19700101/dynamodb/aws4_request, " +
+		"SignedHeaders=" + signedHeaders + ", Signature="
+	t.Assert(strings.HasPrefix(auth, prefix), Equals, true, Commentf("%v", auth))
+
+	der, err := hex.DecodeString(auth[len(prefix):])
+	t.Assert(err, IsNil)
+	var sig struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(der, &sig)
+	t.Assert(err, IsNil)
+
+	priv, err := deriveV4AKey(v4aTestAccessKey, v4aTestSecretKey)
+	t.Assert(err, IsNil)
+	t.Assert(ecdsa.Verify(&priv.PublicKey, hash[:], sig.R, sig.S), Equals, true)
+}
+
+func (s *V4ASignerTest) TestDeriveKey(t *C) {
+	priv, err := deriveV4AKey(v4aTestAccessKey, v4aTestSecretKey)
+	t.Assert(err, IsNil)
+	t.Assert(priv.X.Text(16), Equals,
+		strings.ToLower("15D242CEEBF8D8169FD6A8B5A746C41140414C3B07579038DA06AF89190FFFCB"))
+	t.Assert(priv.Y.Text(16), Equals,
+		strings.ToLower("515242CEDD82E94799482E4C0514B505AFCCF2C0C98D6A553BF539F424C5EC0"))
+}
+
+func (s *V4ASignerTest) TestSign(t *C) {
+	req := v4aTestRequest()
+	// never signed
+	req.Header.Set("User-Agent", "foo")
+	req.Header.Set("X-Amzn-Trace-Id", "bar")
+	req.Header.Set("Transfer-Encoding", "qux")
+
+	v4a := s.sign(t, req, "TOKEN")
+	t.Assert(req.Header.Get("X-Amz-Date"), Equals, "19700101T000000Z")
+	s.checkAuthorization(t, v4a,
+		"content-length;content-type;host;x-amz-date;x-amz-meta-other-header;"+
+			"x-amz-meta-other-header_with_underscore;x-amz-region-set;"+
+			"x-amz-security-token;x-amz-target",
+		"4ba7d0482cf4d5450cefdc067a00de1a4a715e444856fa3e1d85c35fb34d9730")
+
+	// the request goes out with the headers we were given
+	t.Assert(req.Header.Get("X-Amz-Meta-Other-Header"), Equals, "some-value=!@#$%^&* (+)")
+}
+
+func (s *V4ASignerTest) TestSignNoSessionToken(t *C) {
+	v4a := s.sign(t, v4aTestRequest(), "")
+	s.checkAuthorization(t, v4a,
+		"content-length;content-type;host;x-amz-date;x-amz-meta-other-header;"+
+			"x-amz-meta-other-header_with_underscore;x-amz-region-set;x-amz-target",
+		"1aeefb422ae6aa0de7aec829da813e55cff35553cac212dffd5f9474c71e47ee")
+}
+
+func (s *V4ASignerTest) TestSignCanonicalHeaders(t *C) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/bucket/a%20b", nil)
+	req.Header.Set("X-Amz-Meta-Spaces", "  a   b  ")
+
+	v4a := s.sign(t, req, "")
+	t.Assert(v4a.canonicalRequest, Equals, strings.Join([]string{
+		"GET",
+		"/bucket/a%2520b",
+		"",
+		"host:example.amazonaws.com",
+		"x-amz-date:19700101T000000Z",
+		"x-amz-meta-spaces:a b",
+		"x-amz-region-set:us-east-1",
+		"",
+		"host;x-amz-date;x-amz-meta-spaces;x-amz-region-set",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}, "\n"))
+	t.Assert(req.Header.Get("X-Amz-Meta-Spaces"), Equals, "  a   b  ")
+}
@@ -55,6 +55,14 @@ func registerSIGINTHandler(fs *Goofys, flags *FlagStorage) {
 			}
 
 			if len(flags.Cache) == 0 {
+				if s == syscall.SIGTERM && flags.DrainTimeout != 0 {
+					log.Infof("Received %v, taking up to %v to upload the files being written...",
+						s, flags.DrainTimeout)
+					for _, f := range fs.Drain(flags.DrainTimeout) {
+						log.Errorf("%v was not persisted", f)
+					}
+				}
+
 				log.Infof("Received %v, attempting to unmount...", s)
 
 				err := TryUnmount(flags.MountPoint)
@@ -201,6 +209,10 @@ func main() {
 			InitLoggers(!flags.Foreground)
 		}
 
+		// a standby only tells our parent that it's mounted once it
+		// has taken over, until then it may still fail
+		notifyParent := !flags.Foreground
+
 		// Mount the file system.
 		var mfs *fuse.MountedFileSystem
 		var fs *Goofys
@@ -210,13 +222,13 @@ func main() {
 			flags)
 
 		if err != nil {
-			if !flags.Foreground {
+			if notifyParent {
 				kill(os.Getppid(), syscall.SIGUSR2)
 			}
 			log.Fatalf("Mounting file system: %v", err)
 			// fatal also terminates itself
 		} else {
-			if !flags.Foreground {
+			if notifyParent {
 				kill(os.Getppid(), syscall.SIGUSR1)
 			}
 			log.Println("File system has been successfully mounted.")
@@ -231,6 +243,8 @@ func main() {
 				err = fmt.Errorf("MountedFileSystem.Join: %v", err)
 				return
 			}
+			fs.FireHook(HOOK_UNMOUNTED, flags.MountPoint)
+			fs.WaitHooks(HOOK_TIMEOUT)
 
 			log.Println("Successfully exiting.")
 		}